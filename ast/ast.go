@@ -4,12 +4,15 @@ import (
 	"bytes"
 	"fmt"
 	"monkey/token"
+	"strconv"
 	"strings"
 )
 
 type Node interface {
 	TokenLiteral() string
 	String() string
+	Pos() token.Position // ノードの先頭位置
+	End() token.Position // ノードの直後の位置
 }
 
 type Statement interface {
@@ -34,6 +37,19 @@ func (p *Program) TokenLiteral() string {
 	}
 }
 
+func (p *Program) Pos() token.Position {
+	if len(p.Statements) > 0 {
+		return p.Statements[0].Pos()
+	}
+	return token.Position{}
+}
+func (p *Program) End() token.Position {
+	if len(p.Statements) > 0 {
+		return p.Statements[len(p.Statements)-1].End()
+	}
+	return token.Position{}
+}
+
 func (p *Program) String() string {
 	var out bytes.Buffer
 
@@ -52,6 +68,8 @@ func (i *Identifier) expressionNode() {}
 func (i *Identifier) TokenLiteral() string {
 	return i.Token.Literal
 }
+func (i *Identifier) Pos() token.Position { return i.Token.Pos }
+func (i *Identifier) End() token.Position { return i.Token.End }
 func (i *Identifier) String() string {
 	return i.Value
 }
@@ -66,6 +84,8 @@ func (ls *LetStatement) statementNode() {}
 func (ls *LetStatement) TokenLiteral() string {
 	return ls.Token.Literal
 }
+func (ls *LetStatement) Pos() token.Position { return ls.Token.Pos }
+func (ls *LetStatement) End() token.Position { return ls.Value.End() }
 func (ls *LetStatement) String() string {
 	var out bytes.Buffer
 
@@ -91,6 +111,8 @@ func (r *ReturnStatement) statementNode() {}
 func (r *ReturnStatement) TokenLiteral() string {
 	return r.Token.Literal
 }
+func (r *ReturnStatement) Pos() token.Position { return r.Token.Pos }
+func (r *ReturnStatement) End() token.Position { return r.ReturnValue.End() }
 func (r *ReturnStatement) String() string {
 	var out bytes.Buffer
 
@@ -105,6 +127,34 @@ func (r *ReturnStatement) String() string {
 	return out.String()
 }
 
+type BreakStatement struct {
+	Token *token.Token
+}
+
+func (bs *BreakStatement) statementNode() {}
+func (bs *BreakStatement) TokenLiteral() string {
+	return bs.Token.Literal
+}
+func (bs *BreakStatement) Pos() token.Position { return bs.Token.Pos }
+func (bs *BreakStatement) End() token.Position { return bs.Token.End }
+func (bs *BreakStatement) String() string {
+	return bs.TokenLiteral() + ";"
+}
+
+type ContinueStatement struct {
+	Token *token.Token
+}
+
+func (cs *ContinueStatement) statementNode() {}
+func (cs *ContinueStatement) TokenLiteral() string {
+	return cs.Token.Literal
+}
+func (cs *ContinueStatement) Pos() token.Position { return cs.Token.Pos }
+func (cs *ContinueStatement) End() token.Position { return cs.Token.End }
+func (cs *ContinueStatement) String() string {
+	return cs.TokenLiteral() + ";"
+}
+
 // x + 5; みたいな一つの式からなる文
 type ExpressionStatement struct {
 	Token      *token.Token
@@ -115,6 +165,18 @@ func (es *ExpressionStatement) statementNode() {}
 func (es *ExpressionStatement) TokenLiteral() string {
 	return es.Token.Literal
 }
+func (es *ExpressionStatement) Pos() token.Position {
+	if es.Expression == nil {
+		return es.Token.Pos
+	}
+	return es.Expression.Pos()
+}
+func (es *ExpressionStatement) End() token.Position {
+	if es.Expression == nil {
+		return es.Token.End
+	}
+	return es.Expression.End()
+}
 func (es *ExpressionStatement) String() string {
 	if es.Expression != nil {
 		return es.Expression.String()
@@ -132,10 +194,27 @@ func (il *IntegerLiteral) expressionNode() {}
 func (il *IntegerLiteral) TokenLiteral() string {
 	return il.Token.Literal
 }
+func (il *IntegerLiteral) Pos() token.Position { return il.Token.Pos }
+func (il *IntegerLiteral) End() token.Position { return il.Token.End }
 func (il *IntegerLiteral) String() string {
 	return fmt.Sprintf("%d", il.Value)
 }
 
+type FloatLiteral struct {
+	Token *token.Token
+	Value float64
+}
+
+func (fl *FloatLiteral) expressionNode() {}
+func (fl *FloatLiteral) TokenLiteral() string {
+	return fl.Token.Literal
+}
+func (fl *FloatLiteral) Pos() token.Position { return fl.Token.Pos }
+func (fl *FloatLiteral) End() token.Position { return fl.Token.End }
+func (fl *FloatLiteral) String() string {
+	return strconv.FormatFloat(fl.Value, 'g', -1, 64)
+}
+
 type PrefixExpression struct {
 	Token    *token.Token
 	Operator string
@@ -146,6 +225,8 @@ func (pe *PrefixExpression) expressionNode() {}
 func (pe *PrefixExpression) TokenLiteral() string {
 	return pe.Token.Literal
 }
+func (pe *PrefixExpression) Pos() token.Position { return pe.Token.Pos }
+func (pe *PrefixExpression) End() token.Position { return pe.Right.End() }
 func (pe *PrefixExpression) String() string {
 	return fmt.Sprintf("(%s%s)", pe.Operator, pe.Right.String())
 }
@@ -161,6 +242,8 @@ func (ie *InfixExpression) expressionNode() {}
 func (ie *InfixExpression) TokenLiteral() string {
 	return ie.Token.Literal
 }
+func (ie *InfixExpression) Pos() token.Position { return ie.Left.Pos() }
+func (ie *InfixExpression) End() token.Position { return ie.Right.End() }
 func (ie *InfixExpression) String() string {
 	return fmt.Sprintf("(%s %s %s)", ie.Left.String(), ie.Operator, ie.Right.String())
 }
@@ -174,6 +257,8 @@ func (b *Boolean) expressionNode() {}
 func (b *Boolean) TokenLiteral() string {
 	return b.Token.Literal
 }
+func (b *Boolean) Pos() token.Position { return b.Token.Pos }
+func (b *Boolean) End() token.Position { return b.Token.End }
 func (b *Boolean) String() string {
 	return b.Token.Literal
 }
@@ -182,24 +267,49 @@ type IfExpression struct {
 	Token       *token.Token
 	Condition   Expression
 	Consequence *BlockStatement
-	Alternative *BlockStatement
+	ElseIfs     []*ElseIfBranch // else if (...) { ... } の並び
+	Alternative *BlockStatement // 最後の else { ... }
+}
+
+type ElseIfBranch struct {
+	Token       *token.Token // if
+	Condition   Expression
+	Consequence *BlockStatement
 }
 
 func (ie *IfExpression) expressionNode() {}
 func (ie *IfExpression) TokenLiteral() string {
 	return ie.Token.Literal
 }
+func (ie *IfExpression) Pos() token.Position { return ie.Token.Pos }
+func (ie *IfExpression) End() token.Position {
+	if ie.Alternative != nil {
+		return ie.Alternative.End()
+	}
+	if len(ie.ElseIfs) > 0 {
+		return ie.ElseIfs[len(ie.ElseIfs)-1].Consequence.End()
+	}
+	return ie.Consequence.End()
+}
 func (ie *IfExpression) String() string {
 	var out bytes.Buffer
 
-	out.WriteString("if ")
+	out.WriteString("if (")
 	out.WriteString(ie.Condition.String())
-	out.WriteString("{ ")
+	out.WriteString(") { ")
 	out.WriteString(ie.Consequence.String())
 	out.WriteString(" }")
 
+	for _, branch := range ie.ElseIfs {
+		out.WriteString(" else if (")
+		out.WriteString(branch.Condition.String())
+		out.WriteString(") { ")
+		out.WriteString(branch.Consequence.String())
+		out.WriteString(" }")
+	}
+
 	if ie.Alternative != nil {
-		out.WriteString(" else {")
+		out.WriteString(" else { ")
 		out.WriteString(ie.Alternative.String())
 		out.WriteString(" }")
 	}
@@ -208,14 +318,17 @@ func (ie *IfExpression) String() string {
 }
 
 type BlockStatement struct {
-	Token      *token.Token
+	Token      *token.Token // {
 	Statements []Statement
+	Rbrace     *token.Token // }
 }
 
 func (bs *BlockStatement) statementNode() {}
 func (bs *BlockStatement) TokenLiteral() string {
 	return bs.Token.Literal
 }
+func (bs *BlockStatement) Pos() token.Position { return bs.Token.Pos }
+func (bs *BlockStatement) End() token.Position { return closingEnd(bs.Rbrace, bs.Token) }
 func (bs *BlockStatement) String() string {
 	var out bytes.Buffer
 
@@ -228,20 +341,42 @@ func (bs *BlockStatement) String() string {
 
 type FunctionLiteral struct {
 	Token      *token.Token
+	Name       string // let f = fn... の f (スタックトレース用)
 	Parameters []*Identifier
+	Defaults   []Expression // Parameters と同じ長さで、既定値の無い引数はnil
+	Rest       *Identifier  // ...rest の rest。無ければnil
 	Body       *BlockStatement
 }
 
+// 省略できない引数の数。既定値を持つ引数は省略できない引数より後にしか置けない
+func (fl *FunctionLiteral) NumRequired() int {
+	for i := range fl.Parameters {
+		if i < len(fl.Defaults) && fl.Defaults[i] != nil {
+			return i
+		}
+	}
+	return len(fl.Parameters)
+}
+
 func (fl *FunctionLiteral) expressionNode() {}
 func (fl *FunctionLiteral) TokenLiteral() string {
 	return fl.Token.Literal
 }
+func (fl *FunctionLiteral) Pos() token.Position { return fl.Token.Pos }
+func (fl *FunctionLiteral) End() token.Position { return fl.Body.End() }
 func (fl *FunctionLiteral) String() string {
 	var out bytes.Buffer
 
 	params := []string{}
-	for _, p := range fl.Parameters {
-		params = append(params, p.String())
+	for i, p := range fl.Parameters {
+		if i < len(fl.Defaults) && fl.Defaults[i] != nil {
+			params = append(params, p.String()+" = "+fl.Defaults[i].String())
+		} else {
+			params = append(params, p.String())
+		}
+	}
+	if fl.Rest != nil {
+		params = append(params, "..."+fl.Rest.String())
 	}
 
 	out.WriteString("fn(")
@@ -253,15 +388,19 @@ func (fl *FunctionLiteral) String() string {
 }
 
 type CallExpression struct {
-	Token     *token.Token
+	Token     *token.Token // (
 	Function  Expression
 	Arguments []Expression
+	Rparen    *token.Token // )
+	Tail      bool         // 関数本体の末尾位置にある呼び出し。パーサーが設定する
 }
 
 func (ce *CallExpression) expressionNode() {}
 func (ce *CallExpression) TokenLiteral() string {
 	return ce.Token.Literal
 }
+func (ce *CallExpression) Pos() token.Position { return ce.Function.Pos() }
+func (ce *CallExpression) End() token.Position { return closingEnd(ce.Rparen, ce.Token) }
 func (ce *CallExpression) String() string {
 	var out bytes.Buffer
 
@@ -287,19 +426,24 @@ func (sl *StringLiteral) expressionNode() {}
 func (sl *StringLiteral) TokenLiteral() string {
 	return sl.Token.Literal
 }
+func (sl *StringLiteral) Pos() token.Position { return sl.Token.Pos }
+func (sl *StringLiteral) End() token.Position { return sl.Token.End }
 func (sl *StringLiteral) String() string {
 	return sl.Token.Literal
 }
 
 type ArrayLiteral struct {
-	Token    *token.Token
+	Token    *token.Token // [
 	Elements []Expression
+	Rbracket *token.Token // ]
 }
 
 func (al *ArrayLiteral) expressionNode() {}
 func (al *ArrayLiteral) TokenLiteral() string {
 	return al.Token.Literal
 }
+func (al *ArrayLiteral) Pos() token.Position { return al.Token.Pos }
+func (al *ArrayLiteral) End() token.Position { return closingEnd(al.Rbracket, al.Token) }
 func (al *ArrayLiteral) String() string {
 	var out bytes.Buffer
 
@@ -316,15 +460,18 @@ func (al *ArrayLiteral) String() string {
 }
 
 type IndexExpression struct {
-	Token *token.Token
-	Left  Expression
-	Index Expression
+	Token    *token.Token // [
+	Left     Expression
+	Index    Expression
+	Rbracket *token.Token // ]
 }
 
 func (ie *IndexExpression) expressionNode() {}
 func (ie *IndexExpression) TokenLiteral() string {
 	return ie.Token.Literal
 }
+func (ie *IndexExpression) Pos() token.Position { return ie.Left.Pos() }
+func (ie *IndexExpression) End() token.Position { return closingEnd(ie.Rbracket, ie.Token) }
 func (ie *IndexExpression) String() string {
 	var out bytes.Buffer
 
@@ -338,15 +485,52 @@ func (ie *IndexExpression) String() string {
 	return out.String()
 }
 
+// a[low:high]。省略した端は nil
+type SliceExpression struct {
+	Token    *token.Token // [
+	Left     Expression
+	Low      Expression
+	High     Expression
+	Rbracket *token.Token // ]
+}
+
+func (se *SliceExpression) expressionNode() {}
+func (se *SliceExpression) TokenLiteral() string {
+	return se.Token.Literal
+}
+func (se *SliceExpression) Pos() token.Position { return se.Left.Pos() }
+func (se *SliceExpression) End() token.Position { return closingEnd(se.Rbracket, se.Token) }
+func (se *SliceExpression) String() string {
+	var out bytes.Buffer
+
+	out.WriteString("(")
+	out.WriteString(se.Left.String())
+	out.WriteString("[")
+	if se.Low != nil {
+		out.WriteString(se.Low.String())
+	}
+	out.WriteString(":")
+	if se.High != nil {
+		out.WriteString(se.High.String())
+	}
+	out.WriteString("]")
+	out.WriteString(")")
+
+	return out.String()
+}
+
 type HashLiteral struct {
-	Token *token.Token
-	Pairs map[Expression]Expression
+	Token  *token.Token // {
+	Pairs  map[Expression]Expression
+	Rbrace *token.Token // }
 }
 
 func (hl *HashLiteral) expressionNode() {}
 func (hl *HashLiteral) TokenLiteral() string {
 	return hl.Token.Literal
 }
+func (hl *HashLiteral) Pos() token.Position { return hl.Token.Pos }
+func (hl *HashLiteral) End() token.Position { return closingEnd(hl.Rbrace, hl.Token) }
 func (hl *HashLiteral) String() string {
 	var out bytes.Buffer
 
@@ -362,6 +546,57 @@ func (hl *HashLiteral) String() string {
 	return out.String()
 }
 
+// x = 1, x += 1, arr[0] = 1 など
+type AssignExpression struct {
+	Token    *token.Token // = や += など
+	Target   Expression   // *Identifier か *IndexExpression
+	Operator string
+	Value    Expression
+}
+
+func (ae *AssignExpression) expressionNode() {}
+func (ae *AssignExpression) TokenLiteral() string {
+	return ae.Token.Literal
+}
+func (ae *AssignExpression) Pos() token.Position { return ae.Target.Pos() }
+func (ae *AssignExpression) End() token.Position { return ae.Value.End() }
+func (ae *AssignExpression) String() string {
+	return fmt.Sprintf("(%s %s %s)", ae.Target.String(), ae.Operator, ae.Value.String())
+}
+
+// for (x in xs) { ... } / for (k, v in xs) { ... }
+type ForStatement struct {
+	Token    *token.Token
+	Key      *Identifier // 変数が1つの場合はnil
+	Value    *Identifier
+	Iterable Expression
+	Body     *BlockStatement
+}
+
+func (fs *ForStatement) statementNode() {}
+func (fs *ForStatement) TokenLiteral() string {
+	return fs.Token.Literal
+}
+func (fs *ForStatement) Pos() token.Position { return fs.Token.Pos }
+func (fs *ForStatement) End() token.Position { return fs.Body.End() }
+func (fs *ForStatement) String() string {
+	var out bytes.Buffer
+
+	out.WriteString("for (")
+	if fs.Key != nil {
+		out.WriteString(fs.Key.String())
+		out.WriteString(", ")
+	}
+	out.WriteString(fs.Value.String())
+	out.WriteString(" in ")
+	out.WriteString(fs.Iterable.String())
+	out.WriteString(") { ")
+	out.WriteString(fs.Body.String())
+	out.WriteString(" }")
+
+	return out.String()
+}
+
 type WhileStatement struct {
 	Token     *token.Token
 	Condition Expression
@@ -372,6 +607,8 @@ func (we *WhileStatement) statementNode() {}
 func (we *WhileStatement) TokenLiteral() string {
 	return we.Token.Literal
 }
+func (we *WhileStatement) Pos() token.Position { return we.Token.Pos }
+func (we *WhileStatement) End() token.Position { return we.Body.End() }
 func (we *WhileStatement) String() string {
 	var out bytes.Buffer
 
@@ -383,3 +620,89 @@ func (we *WhileStatement) String() string {
 
 	return out.String()
 }
+
+type ThrowStatement struct {
+	Token *token.Token
+	Value Expression
+}
+
+func (ts *ThrowStatement) statementNode() {}
+func (ts *ThrowStatement) TokenLiteral() string {
+	return ts.Token.Literal
+}
+func (ts *ThrowStatement) Pos() token.Position { return ts.Token.Pos }
+func (ts *ThrowStatement) End() token.Position { return ts.Value.End() }
+func (ts *ThrowStatement) String() string {
+	return ts.TokenLiteral() + " " + ts.Value.String() + ";"
+}
+
+// try { ... } catch (e) { ... } finally { ... }。catch と finally はどちらか一方を省略できる
+type TryExpression struct {
+	Token   *token.Token
+	Block   *BlockStatement
+	Param   *Identifier     // catch (e) の e
+	Catch   *BlockStatement // catch が無ければnil
+	Finally *BlockStatement // finally が無ければnil
+}
+
+func (te *TryExpression) expressionNode() {}
+func (te *TryExpression) TokenLiteral() string {
+	return te.Token.Literal
+}
+func (te *TryExpression) Pos() token.Position { return te.Token.Pos }
+func (te *TryExpression) End() token.Position {
+	if te.Finally != nil {
+		return te.Finally.End()
+	}
+	if te.Catch != nil {
+		return te.Catch.End()
+	}
+	return te.Block.End()
+}
+func (te *TryExpression) String() string {
+	var out bytes.Buffer
+
+	out.WriteString("try { ")
+	out.WriteString(te.Block.String())
+	out.WriteString(" }")
+
+	if te.Catch != nil {
+		out.WriteString(" catch (")
+		out.WriteString(te.Param.String())
+		out.WriteString(") { ")
+		out.WriteString(te.Catch.String())
+		out.WriteString(" }")
+	}
+
+	if te.Finally != nil {
+		out.WriteString(" finally { ")
+		out.WriteString(te.Finally.String())
+		out.WriteString(" }")
+	}
+
+	return out.String()
+}
+
+// import "path"。モジュールを読み込んで評価し、その値になる
+type ImportExpression struct {
+	Token *token.Token
+	Path  *StringLiteral
+}
+
+func (ie *ImportExpression) expressionNode() {}
+func (ie *ImportExpression) TokenLiteral() string {
+	return ie.Token.Literal
+}
+func (ie *ImportExpression) Pos() token.Position { return ie.Token.Pos }
+func (ie *ImportExpression) End() token.Position { return ie.Path.End() }
+func (ie *ImportExpression) String() string {
+	return ie.TokenLiteral() + " " + strconv.Quote(ie.Path.Value)
+}
+
+// 閉じ括弧があればその直後、無ければ(構文エラー時など)開き括弧の直後
+func closingEnd(closing, opening *token.Token) token.Position {
+	if closing != nil {
+		return closing.End
+	}
+	return opening.End
+}
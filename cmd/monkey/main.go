@@ -1,35 +1,213 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"io/ioutil"
+	"monkey/ast"
+	"monkey/compiler"
 	"monkey/evaluator"
 	"monkey/lexer"
 	"monkey/object"
 	"monkey/parser"
 	"monkey/repl"
+	"monkey/vm"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
+const usage = `usage:
+  monkey [-engine=eval|vm] [-trace] [-path dirs] [-noprelude] file.monkey  run a script
+  monkey build [-o file.mkc] [-noprelude] file.monkey                     compile a script to bytecode
+  monkey run [-trace] file.mkc                                            run compiled bytecode
+  monkey disasm file.monkey|file.mkc                                      print bytecode
+`
+
 func main() {
-	if len(os.Args) != 2 {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "build":
+			build(os.Args[2:])
+			return
+		case "run":
+			run(os.Args[2:])
+			return
+		case "disasm":
+			disasm(os.Args[2:])
+			return
+		}
+	}
+
+	flags := flag.NewFlagSet("monkey", flag.ExitOnError)
+	flags.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	engine := flags.String("engine", repl.EngineEval, "execution engine (eval or vm)")
+	trace := flags.Bool("trace", false, "log executed instructions to stderr (vm only)")
+	searchPath := flags.String("path", os.Getenv(repl.SearchPathEnv), "list of directories to search for imported files (eval only)")
+	noPrelude := flags.Bool("noprelude", false, "do not load the standard library written in Monkey")
+	flags.Parse(os.Args[1:])
+
+	if flags.NArg() != 1 {
+		fmt.Println("input file required")
+		os.Exit(1)
+	}
+
+	program := parseFile(flags.Arg(0))
+
+	switch *engine {
+	case repl.EngineEval:
+		runEval(program, filepath.SplitList(*searchPath), !*noPrelude)
+	case repl.EngineVM:
+		runBytecode(compile(program, !*noPrelude), *trace)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown engine: %s\n", *engine)
+		os.Exit(1)
+	}
+}
+
+// .monkey をコンパイルして .mkc に書き出す
+func build(args []string) {
+	flags := flag.NewFlagSet("build", flag.ExitOnError)
+	output := flags.String("o", "", "output file (default: input file with .mkc extension)")
+	noPrelude := flags.Bool("noprelude", false, "do not compile the standard library written in Monkey")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		fmt.Println("input file required")
+		os.Exit(1)
+	}
+
+	inputFile := flags.Arg(0)
+	if *output == "" {
+		*output = strings.TrimSuffix(inputFile, ".monkey") + ".mkc"
+	}
+
+	bytecode := compile(parseFile(inputFile), !*noPrelude)
+
+	f, err := os.Create(*output)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if _, err := bytecode.WriteTo(f); err != nil {
+		f.Close()
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := f.Close(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// .mkc を読み込んでVMで実行する
+func run(args []string) {
+	flags := flag.NewFlagSet("run", flag.ExitOnError)
+	trace := flags.Bool("trace", false, "log executed instructions to stderr")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		fmt.Println("input file required")
+		os.Exit(1)
+	}
+
+	runBytecode(readBytecode(flags.Arg(0)), *trace)
+}
+
+// .monkey ならコンパイルして、.mkc ならそのまま逆アセンブルする。
+// .monkey の場合は読みやすさのため標準ライブラリを含めない
+func disasm(args []string) {
+	if len(args) != 1 {
 		fmt.Println("input file required")
+		os.Exit(1)
+	}
+
+	inputFile := args[0]
+	if strings.HasSuffix(inputFile, ".mkc") {
+		compiler.Disassemble(os.Stdout, readBytecode(inputFile), "")
+		return
 	}
 
-	inputFile := os.Args[1]
+	source, err := ioutil.ReadFile(inputFile)
+	if err != nil {
+		panic(err)
+	}
+	compiler.Disassemble(os.Stdout, compile(parseFile(inputFile), false), string(source))
+}
+
+func readBytecode(inputFile string) *compiler.Bytecode {
+	f, err := os.Open(inputFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer f.Close()
+
+	bytecode, err := compiler.ReadBytecode(f)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", inputFile, err)
+		os.Exit(1)
+	}
+	return bytecode
+}
+
+func parseFile(inputFile string) *ast.Program {
 	bytes, err := ioutil.ReadFile(inputFile)
 	if err != nil {
 		panic(err)
 	}
-	l := lexer.New(string(bytes))
+	l := lexer.NewWithFilename(inputFile, string(bytes))
 	p := parser.New(l)
 
 	program := p.ParseProgram()
 	if len(p.Errors()) != 0 {
 		repl.PrintParserError(os.Stdout, p.Errors())
-		return
+		os.Exit(1)
 	}
 
+	return program
+}
+
+func runEval(program *ast.Program, searchPath []string, prelude bool) {
 	env := object.NewEnvironment()
-	evaluator.Eval(program, env)
+	opts := []evaluator.Option{evaluator.WithModules(evaluator.NewModules(nil, searchPath))}
+	if !prelude {
+		opts = append(opts, evaluator.WithoutPrelude())
+	}
+	evaluated := evaluator.EvalContext(context.Background(), program, env, evaluator.Limits{}, opts...)
+	if err, ok := evaluated.(*object.Error); ok {
+		repl.PrintRuntimeError(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func compile(program *ast.Program, prelude bool) *compiler.Bytecode {
+	comp := compiler.New()
+	if prelude {
+		if err := comp.CompilePrelude(); err != nil {
+			fmt.Fprintf(os.Stderr, "compilation failed: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	if err := comp.Compile(program); err != nil {
+		fmt.Fprintf(os.Stderr, "compilation failed: %s\n", err)
+		if errors.Is(err, compiler.ErrImportNotSupported) {
+			fmt.Fprintln(os.Stderr, "scripts that use import can only be run with -engine=eval")
+		}
+		os.Exit(1)
+	}
+	return comp.Bytecode()
+}
+
+func runBytecode(bytecode *compiler.Bytecode, trace bool) {
+	machine := vm.New(bytecode)
+	if trace {
+		machine.SetTrace(os.Stderr)
+	}
+	if err := machine.Run(); err != nil {
+		repl.PrintVMError(os.Stderr, err)
+		os.Exit(1)
+	}
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"monkey/repl"
 	"os"
@@ -8,6 +9,9 @@ import (
 )
 
 func main() {
+	engine := flag.String("engine", repl.EngineEval, "execution engine (eval or vm)")
+	flag.Parse()
+
 	user, err := user.Current()
 	if err != nil {
 		panic(err)
@@ -16,5 +20,5 @@ func main() {
 	fmt.Printf("Hello %s! This is the Monkey programming language!\n", user.Username)
 	fmt.Printf("Feel free to type in command\n")
 
-	repl.Start(os.Stdin, os.Stdout)
+	repl.Start(os.Stdin, os.Stdout, *engine)
 }
@@ -0,0 +1,269 @@
+package code
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+type Instructions []byte
+
+type Opcode byte
+
+const (
+	OpConstant Opcode = iota
+	OpPop
+
+	OpTrue
+	OpFalse
+	OpNull
+
+	// 二項演算子
+	OpAdd
+	OpSub
+	OpMul
+	OpDiv
+	OpMod
+	OpEqual
+	OpNotEqual
+	OpLessThan
+	OpGreaterThan
+	OpLessEqual
+	OpGreaterEqual
+	OpRange
+
+	// 単項演算子
+	OpMinus
+	OpBang
+
+	OpJump
+	OpJumpNotTruthy
+	OpAndJump // スタックトップが偽ならそのまま残してジャンプ、真なら捨てる (&&)
+	OpOrJump  // スタックトップが真ならそのまま残してジャンプ、偽なら捨てる (||)
+
+	OpGetGlobal
+	OpSetGlobal
+	OpGetLocal
+	OpSetLocal
+
+	// クロージャに捕捉されるローカル変数はセルに入れて共有する
+	OpGetCell  // セルに入ったローカル変数の値を読む
+	OpSetCell  // セルに入ったローカル変数に書く(セルが無ければ作る)
+	OpLoadCell // ローカル変数のセル自体を積む(クロージャ生成用)
+	OpBoxLocal // 引数をセルに入れ直す
+	OpGetFree  // 自由変数(セル)の値を読む
+	OpSetFree  // 自由変数(セル)に書く
+	OpLoadFree // 自由変数のセル自体を積む(クロージャ生成用)
+	OpMakeCell // スタックトップの値を新しいセルに入れる
+	OpClearLocals
+
+	OpCurrentClosure
+	OpClosure
+
+	OpArray
+	OpHash
+	OpIndex
+	OpSetIndex
+	OpDupTwo
+
+	OpCall
+	OpReturnValue
+	OpReturn
+
+	OpIterInit
+	OpIterNext
+
+	OpTailCall
+	OpJumpIfBound
+
+	OpTry    // エラーが起きたときの飛び先を登録する
+	OpEndTry // 登録した飛び先を取り除く
+	OpCatch  // 捕捉したエラーをスクリプトから扱える値にする
+	OpThrow
+
+	OpSlice
+)
+
+type Definition struct {
+	Name          string
+	OperandWidths []int
+}
+
+var definitions = map[Opcode]*Definition{
+	OpConstant: {"OpConstant", []int{2}},
+	OpPop:      {"OpPop", []int{}},
+
+	OpTrue:  {"OpTrue", []int{}},
+	OpFalse: {"OpFalse", []int{}},
+	OpNull:  {"OpNull", []int{}},
+
+	OpAdd:          {"OpAdd", []int{}},
+	OpSub:          {"OpSub", []int{}},
+	OpMul:          {"OpMul", []int{}},
+	OpDiv:          {"OpDiv", []int{}},
+	OpMod:          {"OpMod", []int{}},
+	OpEqual:        {"OpEqual", []int{}},
+	OpNotEqual:     {"OpNotEqual", []int{}},
+	OpLessThan:     {"OpLessThan", []int{}},
+	OpGreaterThan:  {"OpGreaterThan", []int{}},
+	OpLessEqual:    {"OpLessEqual", []int{}},
+	OpGreaterEqual: {"OpGreaterEqual", []int{}},
+	OpRange:        {"OpRange", []int{}},
+
+	OpMinus: {"OpMinus", []int{}},
+	OpBang:  {"OpBang", []int{}},
+
+	OpJump:          {"OpJump", []int{2}},
+	OpJumpNotTruthy: {"OpJumpNotTruthy", []int{2}},
+	OpAndJump:       {"OpAndJump", []int{2}},
+	OpOrJump:        {"OpOrJump", []int{2}},
+
+	OpGetGlobal: {"OpGetGlobal", []int{2}},
+	OpSetGlobal: {"OpSetGlobal", []int{2}},
+	OpGetLocal:  {"OpGetLocal", []int{2}},
+	OpSetLocal:  {"OpSetLocal", []int{2}},
+
+	OpGetCell:     {"OpGetCell", []int{2}},
+	OpSetCell:     {"OpSetCell", []int{2}},
+	OpLoadCell:    {"OpLoadCell", []int{2}},
+	OpBoxLocal:    {"OpBoxLocal", []int{2}},
+	OpGetFree:     {"OpGetFree", []int{1}},
+	OpSetFree:     {"OpSetFree", []int{1}},
+	OpLoadFree:    {"OpLoadFree", []int{1}},
+	OpMakeCell:    {"OpMakeCell", []int{}},
+	OpClearLocals: {"OpClearLocals", []int{2, 2}},
+
+	OpCurrentClosure: {"OpCurrentClosure", []int{}},
+	OpClosure:        {"OpClosure", []int{2, 1}},
+
+	OpArray:    {"OpArray", []int{2}},
+	OpHash:     {"OpHash", []int{2}},
+	OpIndex:    {"OpIndex", []int{}},
+	OpSetIndex: {"OpSetIndex", []int{}},
+	OpDupTwo:   {"OpDupTwo", []int{}},
+
+	OpCall:        {"OpCall", []int{1}},
+	OpReturnValue: {"OpReturnValue", []int{}},
+	OpReturn:      {"OpReturn", []int{}},
+
+	OpIterInit: {"OpIterInit", []int{}},
+	OpIterNext: {"OpIterNext", []int{1, 2}},
+
+	// 呼び出し元のフレームを再利用して呼び出す
+	OpTailCall: {"OpTailCall", []int{1}},
+	// 引数が渡されていれば(ローカル変数が空でなければ)既定値の評価を飛ばす
+	OpJumpIfBound: {"OpJumpIfBound", []int{2, 2}},
+
+	// エラーが起きるとスタックを OpTry の時点まで戻し、エラーを積んで飛ぶ
+	OpTry:    {"OpTry", []int{2}},
+	OpEndTry: {"OpEndTry", []int{}},
+	OpCatch:  {"OpCatch", []int{}},
+	// エラーはそのまま投げ直し、それ以外の値はエラーにして投げる
+	OpThrow: {"OpThrow", []int{}},
+
+	// 対象、下端、上端を取り出して部分を積む。省略した端は null
+	OpSlice: {"OpSlice", []int{}},
+}
+
+func Lookup(op byte) (*Definition, error) {
+	def, ok := definitions[Opcode(op)]
+	if !ok {
+		return nil, fmt.Errorf("opcode %d undefined", op)
+	}
+
+	return def, nil
+}
+
+func Make(op Opcode, operands ...int) []byte {
+	def, ok := definitions[op]
+	if !ok {
+		return []byte{}
+	}
+
+	instructionLen := 1
+	for _, w := range def.OperandWidths {
+		instructionLen += w
+	}
+
+	instruction := make([]byte, instructionLen)
+	instruction[0] = byte(op)
+
+	offset := 1
+	for i, o := range operands {
+		width := def.OperandWidths[i]
+		switch width {
+		case 2:
+			binary.BigEndian.PutUint16(instruction[offset:], uint16(o))
+		case 1:
+			instruction[offset] = byte(o)
+		}
+		offset += width
+	}
+
+	return instruction
+}
+
+func ReadOperands(def *Definition, ins Instructions) ([]int, int) {
+	operands := make([]int, len(def.OperandWidths))
+	offset := 0
+
+	for i, width := range def.OperandWidths {
+		switch width {
+		case 2:
+			operands[i] = int(ReadUint16(ins[offset:]))
+		case 1:
+			operands[i] = int(ReadUint8(ins[offset:]))
+		}
+		offset += width
+	}
+
+	return operands, offset
+}
+
+func ReadUint16(ins Instructions) uint16 {
+	return binary.BigEndian.Uint16(ins)
+}
+
+func ReadUint8(ins Instructions) uint8 {
+	return uint8(ins[0])
+}
+
+func (ins Instructions) String() string {
+	var out bytes.Buffer
+
+	i := 0
+	for i < len(ins) {
+		def, err := Lookup(ins[i])
+		if err != nil {
+			fmt.Fprintf(&out, "ERROR: %s\n", err)
+			return out.String()
+		}
+
+		operands, read := ReadOperands(def, ins[i+1:])
+
+		fmt.Fprintf(&out, "%04d %s\n", i, ins.fmtInstruction(def, operands))
+
+		i += 1 + read
+	}
+
+	return out.String()
+}
+
+func (ins Instructions) fmtInstruction(def *Definition, operands []int) string {
+	operandCount := len(def.OperandWidths)
+
+	if len(operands) != operandCount {
+		return fmt.Sprintf("ERROR: operand len %d does not match defined %d\n", len(operands), operandCount)
+	}
+
+	switch operandCount {
+	case 0:
+		return def.Name
+	case 1:
+		return fmt.Sprintf("%s %d", def.Name, operands[0])
+	case 2:
+		return fmt.Sprintf("%s %d %d", def.Name, operands[0], operands[1])
+	}
+
+	return fmt.Sprintf("ERROR: unhandled operandCount for %s\n", def.Name)
+}
@@ -0,0 +1,108 @@
+package compiler
+
+import "monkey/ast"
+
+// nodes の中の関数リテラルが参照している名前を集める。
+// 名前だけで判定するので、実際には捕捉されない変数がセルに入ることもあるが意味は変わらない
+func capturedNames(nodes ...ast.Node) map[string]bool {
+	names := map[string]bool{}
+	for _, node := range nodes {
+		collectIdentifiers(node, false, names)
+	}
+	return names
+}
+
+func collectIdentifiers(node ast.Node, inFunction bool, names map[string]bool) {
+	visit := func(n ast.Node) {
+		if n != nil {
+			collectIdentifiers(n, inFunction, names)
+		}
+	}
+
+	switch node := node.(type) {
+	case *ast.Program:
+		for _, s := range node.Statements {
+			visit(s)
+		}
+	case *ast.BlockStatement:
+		for _, s := range node.Statements {
+			visit(s)
+		}
+	case *ast.ExpressionStatement:
+		visit(node.Expression)
+	case *ast.LetStatement:
+		visit(node.Value)
+	case *ast.ReturnStatement:
+		visit(node.ReturnValue)
+	case *ast.WhileStatement:
+		visit(node.Condition)
+		visit(node.Body)
+	case *ast.ForStatement:
+		visit(node.Iterable)
+		visit(node.Body)
+	case *ast.ThrowStatement:
+		visit(node.Value)
+	case *ast.TryExpression:
+		visit(node.Block)
+		if node.Catch != nil {
+			visit(node.Catch)
+		}
+		if node.Finally != nil {
+			visit(node.Finally)
+		}
+	case *ast.Identifier:
+		if inFunction {
+			names[node.Value] = true
+		}
+	case *ast.PrefixExpression:
+		visit(node.Right)
+	case *ast.InfixExpression:
+		visit(node.Left)
+		visit(node.Right)
+	case *ast.AssignExpression:
+		visit(node.Target)
+		visit(node.Value)
+	case *ast.IfExpression:
+		visit(node.Condition)
+		visit(node.Consequence)
+		for _, branch := range node.ElseIfs {
+			visit(branch.Condition)
+			visit(branch.Consequence)
+		}
+		if node.Alternative != nil {
+			visit(node.Alternative)
+		}
+	case *ast.FunctionLiteral:
+		for _, d := range node.Defaults {
+			if d != nil {
+				collectIdentifiers(d, true, names)
+			}
+		}
+		collectIdentifiers(node.Body, true, names)
+	case *ast.CallExpression:
+		visit(node.Function)
+		for _, a := range node.Arguments {
+			visit(a)
+		}
+	case *ast.ArrayLiteral:
+		for _, e := range node.Elements {
+			visit(e)
+		}
+	case *ast.IndexExpression:
+		visit(node.Left)
+		visit(node.Index)
+	case *ast.SliceExpression:
+		visit(node.Left)
+		if node.Low != nil {
+			visit(node.Low)
+		}
+		if node.High != nil {
+			visit(node.High)
+		}
+	case *ast.HashLiteral:
+		for k, v := range node.Pairs {
+			visit(k)
+			visit(v)
+		}
+	}
+}
@@ -0,0 +1,940 @@
+package compiler
+
+import (
+	"errors"
+	"fmt"
+	"monkey/ast"
+	"monkey/code"
+	"monkey/evaluator"
+	"monkey/object"
+	"monkey/token"
+	"sort"
+)
+
+var infixOperators = map[string]code.Opcode{
+	"+":  code.OpAdd,
+	"-":  code.OpSub,
+	"*":  code.OpMul,
+	"/":  code.OpDiv,
+	"%":  code.OpMod,
+	"==": code.OpEqual,
+	"!=": code.OpNotEqual,
+	"<":  code.OpLessThan,
+	">":  code.OpGreaterThan,
+	"<=": code.OpLessEqual,
+	">=": code.OpGreaterEqual,
+	"..": code.OpRange,
+}
+
+// import はモジュールごとにトップレベルの環境を作る評価器でだけ使える
+var ErrImportNotSupported = errors.New("import is not supported by the vm engine")
+
+// VMで実行できない構文のエラー
+type UnsupportedError struct {
+	Node ast.Node
+	Err  error // 対応していない理由。無ければnil
+}
+
+func (e *UnsupportedError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %s", e.Node.Pos(), e.Err)
+	}
+	return fmt.Sprintf("unsupported node: %T", e.Node)
+}
+
+func (e *UnsupportedError) Unwrap() error { return e.Err }
+
+// += などの複合代入で使う演算
+var assignOperators = map[string]code.Opcode{
+	"+=": code.OpAdd,
+	"-=": code.OpSub,
+	"*=": code.OpMul,
+	"/=": code.OpDiv,
+	"%=": code.OpMod,
+}
+
+type EmittedInstruction struct {
+	Opcode   code.Opcode
+	Position int
+}
+
+// break/continue の飛び先
+type loopContext struct {
+	continueTarget int
+	breakJumps     []int // ループを抜ける位置が決まったら書き換える
+}
+
+// return/break/continue で try から抜けるときの後始末
+type tryContext struct {
+	finally *ast.BlockStatement // finally が無ければnil
+	handler bool                // OpTry で登録した飛び先が有効か
+	loops   int                 // try の外側にあるループの数
+}
+
+type CompilationScope struct {
+	instructions        code.Instructions
+	lastInstruction     EmittedInstruction
+	previousInstruction EmittedInstruction
+	positions           []object.SourcePosition
+	loops               []*loopContext
+	tries               []*tryContext
+}
+
+type Compiler struct {
+	constants []object.Object
+
+	symbolTable *SymbolTable
+
+	scopes     []CompilationScope
+	scopeIndex int
+
+	pos      token.Position // 現在コンパイル中のノードの位置
+	builtins map[string]int // 組み込み関数の定数インデックス
+}
+
+type Bytecode struct {
+	Main        *object.CompiledFunction // トップレベルのコード
+	Constants   []object.Object
+	GlobalNames []string // グローバル変数のインデックスごとの名前
+}
+
+func New() *Compiler {
+	mainScope := CompilationScope{}
+
+	return &Compiler{
+		constants:   []object.Object{},
+		symbolTable: NewSymbolTable(),
+		scopes:      []CompilationScope{mainScope},
+		scopeIndex:  0,
+		builtins:    map[string]int{},
+	}
+}
+
+// REPLのように前回までのグローバル変数と定数を引き継ぐ
+func NewWithState(s *SymbolTable, constants []object.Object) *Compiler {
+	compiler := New()
+	compiler.symbolTable = s
+	compiler.constants = constants
+	for i, c := range constants {
+		if builtin, ok := c.(*object.Builtin); ok {
+			compiler.builtins[builtin.Name] = i
+		}
+	}
+	return compiler
+}
+
+func (c *Compiler) Compile(node ast.Node) error {
+	saved := c.pos
+	c.pos = node.Pos()
+	defer func() { c.pos = saved }()
+
+	switch node := node.(type) {
+	case *ast.Program:
+		for _, s := range node.Statements {
+			if err := c.Compile(s); err != nil {
+				return err
+			}
+		}
+	case *ast.ExpressionStatement:
+		// 単独の ; は何もしない
+		if node.Expression == nil {
+			return nil
+		}
+		if err := c.Compile(node.Expression); err != nil {
+			return err
+		}
+		c.emit(code.OpPop)
+	case *ast.BlockStatement:
+		for _, s := range node.Statements {
+			if err := c.Compile(s); err != nil {
+				return err
+			}
+		}
+	case *ast.InfixExpression:
+		if node.Operator == "&&" || node.Operator == "||" {
+			return c.compileLogicalExpression(node)
+		}
+
+		op, ok := infixOperators[node.Operator]
+		if !ok {
+			return fmt.Errorf("unknown operator %s", node.Operator)
+		}
+		if err := c.Compile(node.Left); err != nil {
+			return err
+		}
+		if err := c.Compile(node.Right); err != nil {
+			return err
+		}
+		c.emit(op)
+	case *ast.PrefixExpression:
+		if err := c.Compile(node.Right); err != nil {
+			return err
+		}
+
+		switch node.Operator {
+		case "!":
+			c.emit(code.OpBang)
+		case "-":
+			c.emit(code.OpMinus)
+		default:
+			return fmt.Errorf("unknown operator %s", node.Operator)
+		}
+	case *ast.IntegerLiteral:
+		integer := &object.Integer{Value: node.Value}
+		c.emit(code.OpConstant, c.addConstant(integer))
+	case *ast.FloatLiteral:
+		float := &object.Float{Value: node.Value}
+		c.emit(code.OpConstant, c.addConstant(float))
+	case *ast.StringLiteral:
+		str := &object.String{Value: node.Value}
+		c.emit(code.OpConstant, c.addConstant(str))
+	case *ast.Boolean:
+		if node.Value {
+			c.emit(code.OpTrue)
+		} else {
+			c.emit(code.OpFalse)
+		}
+	case *ast.IfExpression:
+		return c.compileIfExpression(node)
+	case *ast.LetStatement:
+		// 右辺では同じ名前は外側の変数を指すので、右辺を先にコンパイルする
+		if err := c.Compile(node.Value); err != nil {
+			return err
+		}
+		symbol := c.symbolTable.Define(node.Name.Value)
+		c.storeSymbol(symbol)
+	case *ast.Identifier:
+		symbol, ok := c.symbolTable.Resolve(node.Value)
+		if !ok {
+			if builtin, ok := evaluator.LookupBuiltin(node.Value); ok {
+				c.emit(code.OpConstant, c.builtinConstant(builtin))
+				return nil
+			}
+			symbol = c.forwardGlobal(node.Value)
+		}
+		c.loadSymbol(symbol)
+	case *ast.AssignExpression:
+		return c.compileAssignExpression(node)
+	case *ast.ReturnStatement:
+		if err := c.Compile(node.ReturnValue); err != nil {
+			return err
+		}
+		if err := c.leaveTries(0); err != nil {
+			return err
+		}
+		c.emit(code.OpReturnValue)
+	case *ast.ThrowStatement:
+		if err := c.Compile(node.Value); err != nil {
+			return err
+		}
+		c.emit(code.OpThrow)
+	case *ast.TryExpression:
+		return c.compileTryExpression(node)
+	case *ast.WhileStatement:
+		return c.compileWhileStatement(node)
+	case *ast.ForStatement:
+		return c.compileForStatement(node)
+	case *ast.BreakStatement:
+		loop := c.currentLoop()
+		if loop == nil {
+			return fmt.Errorf("break is not in a loop")
+		}
+		if err := c.leaveTries(len(c.scopes[c.scopeIndex].loops)); err != nil {
+			return err
+		}
+		loop.breakJumps = append(loop.breakJumps, c.emit(code.OpJump, 9999))
+	case *ast.ContinueStatement:
+		loop := c.currentLoop()
+		if loop == nil {
+			return fmt.Errorf("continue is not in a loop")
+		}
+		if err := c.leaveTries(len(c.scopes[c.scopeIndex].loops)); err != nil {
+			return err
+		}
+		c.emit(code.OpJump, loop.continueTarget)
+	case *ast.FunctionLiteral:
+		return c.compileFunctionLiteral(node)
+	case *ast.CallExpression:
+		if err := c.Compile(node.Function); err != nil {
+			return err
+		}
+		for _, a := range node.Arguments {
+			if err := c.Compile(a); err != nil {
+				return err
+			}
+		}
+		if node.Tail {
+			// 組み込み関数はフレームを作らないので、続く OpReturnValue で戻る
+			c.emit(code.OpTailCall, len(node.Arguments))
+		} else {
+			c.emit(code.OpCall, len(node.Arguments))
+		}
+	case *ast.ArrayLiteral:
+		for _, el := range node.Elements {
+			if err := c.Compile(el); err != nil {
+				return err
+			}
+		}
+		c.emit(code.OpArray, len(node.Elements))
+	case *ast.HashLiteral:
+		// Goのmapは順序が不定なので、キーの文字列表現でソートしてから並べる
+		keys := []ast.Expression{}
+		for k := range node.Pairs {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return keys[i].String() < keys[j].String()
+		})
+
+		for _, k := range keys {
+			if err := c.Compile(k); err != nil {
+				return err
+			}
+			if err := c.Compile(node.Pairs[k]); err != nil {
+				return err
+			}
+		}
+		c.emit(code.OpHash, len(node.Pairs)*2)
+	case *ast.IndexExpression:
+		if err := c.Compile(node.Left); err != nil {
+			return err
+		}
+		if err := c.Compile(node.Index); err != nil {
+			return err
+		}
+		c.emit(code.OpIndex)
+	case *ast.SliceExpression:
+		if err := c.Compile(node.Left); err != nil {
+			return err
+		}
+		for _, e := range []ast.Expression{node.Low, node.High} {
+			if e == nil {
+				c.emit(code.OpNull)
+				continue
+			}
+			if err := c.Compile(e); err != nil {
+				return err
+			}
+		}
+		c.emit(code.OpSlice)
+	case *ast.ImportExpression:
+		return &UnsupportedError{Node: node, Err: ErrImportNotSupported}
+	default:
+		return &UnsupportedError{Node: node}
+	}
+
+	return nil
+}
+
+func (c *Compiler) Bytecode() *Bytecode {
+	global := c.symbolTable.global()
+	scope := c.scopes[0]
+
+	return &Bytecode{
+		Main: &object.CompiledFunction{
+			Instructions:    scope.instructions,
+			NumLocals:       global.numLocals,
+			LocalNames:      global.localNames,
+			SourcePositions: scope.positions,
+		},
+		Constants:   c.constants,
+		GlobalNames: global.GlobalNames(),
+	}
+}
+
+func (c *Compiler) compileLogicalExpression(node *ast.InfixExpression) error {
+	if err := c.Compile(node.Left); err != nil {
+		return err
+	}
+
+	op := code.OpAndJump
+	if node.Operator == "||" {
+		op = code.OpOrJump
+	}
+	jumpPos := c.emit(op, 9999)
+
+	if err := c.Compile(node.Right); err != nil {
+		return err
+	}
+	c.changeOperand(jumpPos, len(c.currentInstructions()))
+
+	return nil
+}
+
+func (c *Compiler) compileIfExpression(node *ast.IfExpression) error {
+	endJumps := []int{}
+
+	branches := append([]*ast.ElseIfBranch{{Condition: node.Condition, Consequence: node.Consequence}}, node.ElseIfs...)
+	for _, branch := range branches {
+		if err := c.Compile(branch.Condition); err != nil {
+			return err
+		}
+		jumpNotTruthyPos := c.emit(code.OpJumpNotTruthy, 9999)
+
+		if err := c.compileBlockExpression(branch.Consequence); err != nil {
+			return err
+		}
+		endJumps = append(endJumps, c.emit(code.OpJump, 9999))
+
+		c.changeOperand(jumpNotTruthyPos, len(c.currentInstructions()))
+	}
+
+	if node.Alternative == nil {
+		c.emit(code.OpNull)
+	} else {
+		if err := c.compileBlockExpression(node.Alternative); err != nil {
+			return err
+		}
+	}
+
+	for _, pos := range endJumps {
+		c.changeOperand(pos, len(c.currentInstructions()))
+	}
+
+	return nil
+}
+
+// ブロックの最後の式の値をスタックに残す。値が無ければnullを積む
+func (c *Compiler) compileBlockExpression(block *ast.BlockStatement) error {
+	start := len(c.currentInstructions())
+
+	if err := c.Compile(block); err != nil {
+		return err
+	}
+
+	if c.lastInstructionIs(code.OpPop) && c.scopes[c.scopeIndex].lastInstruction.Position >= start {
+		c.removeLastPop()
+	} else {
+		c.emit(code.OpNull)
+	}
+
+	return nil
+}
+
+func (c *Compiler) compileAssignExpression(node *ast.AssignExpression) error {
+	switch target := node.Target.(type) {
+	case *ast.Identifier:
+		symbol, ok := c.symbolTable.Resolve(target.Value)
+		if !ok {
+			symbol = c.forwardGlobal(target.Value)
+		}
+		if symbol.Scope == FunctionScope {
+			return fmt.Errorf("cannot assign to function name %s", target.Value)
+		}
+
+		if node.Operator == "=" {
+			if symbol.Scope == GlobalScope {
+				// 未定義の変数への代入はエラーにするため、一度読んで確かめる
+				c.loadSymbol(symbol)
+				c.emit(code.OpPop)
+			}
+			if err := c.Compile(node.Value); err != nil {
+				return err
+			}
+		} else {
+			op, ok := assignOperators[node.Operator]
+			if !ok {
+				return fmt.Errorf("unknown operator %s", node.Operator)
+			}
+			c.loadSymbol(symbol)
+			if err := c.Compile(node.Value); err != nil {
+				return err
+			}
+			c.emit(op)
+		}
+
+		c.storeSymbol(symbol)
+		c.loadSymbol(symbol)
+	case *ast.IndexExpression:
+		if err := c.Compile(target.Left); err != nil {
+			return err
+		}
+		if err := c.Compile(target.Index); err != nil {
+			return err
+		}
+
+		if node.Operator == "=" {
+			if err := c.Compile(node.Value); err != nil {
+				return err
+			}
+		} else {
+			op, ok := assignOperators[node.Operator]
+			if !ok {
+				return fmt.Errorf("unknown operator %s", node.Operator)
+			}
+			c.emit(code.OpDupTwo)
+			c.emit(code.OpIndex)
+			if err := c.Compile(node.Value); err != nil {
+				return err
+			}
+			c.emit(op)
+		}
+
+		c.emit(code.OpSetIndex)
+	default:
+		return fmt.Errorf("invalid assignment target: %s", node.Target.String())
+	}
+
+	return nil
+}
+
+// while は文なので値としてnullを残して捨てる(評価器の結果と合わせるため)
+func (c *Compiler) compileWhileStatement(node *ast.WhileStatement) error {
+	loopStart := len(c.currentInstructions())
+
+	if err := c.Compile(node.Condition); err != nil {
+		return err
+	}
+	exitJumpPos := c.emit(code.OpJumpNotTruthy, 9999)
+
+	loop := c.enterLoop(loopStart)
+	if err := c.Compile(node.Body); err != nil {
+		return err
+	}
+	c.emit(code.OpJump, loopStart)
+	c.leaveLoop()
+
+	exit := len(c.currentInstructions())
+	c.changeOperand(exitJumpPos, exit)
+	for _, pos := range loop.breakJumps {
+		c.changeOperand(pos, exit)
+	}
+
+	c.emit(code.OpNull)
+	c.emit(code.OpPop)
+
+	return nil
+}
+
+// for の本体はブロックスコープになり、毎回の繰り返しで変数のスロットを空にする。
+// そのためクロージャはそれぞれの回の変数(セル)を捕捉する
+func (c *Compiler) compileForStatement(node *ast.ForStatement) error {
+	if err := c.Compile(node.Iterable); err != nil {
+		return err
+	}
+	c.emit(code.OpIterInit)
+
+	c.symbolTable = NewBlockSymbolTable(c.symbolTable)
+	c.symbolTable.captured = capturedNames(node.Body)
+	frame := c.symbolTable.frame()
+	firstLocal := frame.numLocals
+
+	loopStart := c.emit(code.OpClearLocals, firstLocal, 9999)
+
+	nvars := 1
+	if node.Key != nil {
+		nvars = 2
+	}
+	iterNextPos := c.emit(code.OpIterNext, nvars, 9999)
+
+	var key Symbol
+	if node.Key != nil {
+		key = c.symbolTable.Define(node.Key.Value)
+	}
+	value := c.symbolTable.Define(node.Value.Value)
+	c.storeSymbol(value)
+	if node.Key != nil {
+		c.storeSymbol(key)
+	}
+
+	loop := c.enterLoop(loopStart)
+	if err := c.Compile(node.Body); err != nil {
+		return err
+	}
+	c.emit(code.OpJump, loopStart)
+	c.leaveLoop()
+
+	// break した場合はイテレータを捨てる
+	breakTarget := c.emit(code.OpPop)
+	for _, pos := range loop.breakJumps {
+		c.changeOperand(pos, breakTarget)
+	}
+	c.changeOperands(iterNextPos, nvars, len(c.currentInstructions()))
+
+	c.symbolTable = c.symbolTable.Outer
+	c.changeOperands(loopStart, firstLocal, frame.numLocals-firstLocal)
+
+	c.emit(code.OpNull)
+	c.emit(code.OpPop)
+
+	return nil
+}
+
+// try の値は本体か catch の最後の式の値になる。finally は抜け方ごとに複製して置く
+//
+//	    OpTry catch
+//	    <本体>
+//	    OpEndTry
+//	    OpJump end
+//	catch:                  エラーが積まれている
+//	    OpCatch
+//	    <e に束縛>
+//	    OpTry rethrow       (finally がある場合)
+//	    <catch>
+//	    OpEndTry
+//	    OpJump end
+//	rethrow:
+//	    <finally>
+//	    OpThrow
+//	end:
+//	    <finally>
+func (c *Compiler) compileTryExpression(node *ast.TryExpression) error {
+	try := &tryContext{
+		finally: node.Finally,
+		handler: true,
+		loops:   len(c.scopes[c.scopeIndex].loops),
+	}
+	c.scopes[c.scopeIndex].tries = append(c.scopes[c.scopeIndex].tries, try)
+
+	tryPos := c.emit(code.OpTry, 9999)
+	if err := c.compileBlockExpression(node.Block); err != nil {
+		return err
+	}
+	c.emit(code.OpEndTry)
+	endJumps := []int{c.emit(code.OpJump, 9999)}
+	c.changeOperand(tryPos, len(c.currentInstructions()))
+
+	if node.Catch != nil {
+		c.emit(code.OpCatch)
+
+		// e は catch の中だけのブロックスコープの変数になる
+		c.symbolTable = NewBlockSymbolTable(c.symbolTable)
+		c.symbolTable.captured = capturedNames(node.Catch)
+		frame := c.symbolTable.frame()
+		firstLocal := frame.numLocals
+		clearPos := c.emit(code.OpClearLocals, firstLocal, 9999)
+		c.storeSymbol(c.symbolTable.Define(node.Param.Value))
+
+		try.handler = node.Finally != nil
+		rethrowPos := -1
+		if node.Finally != nil {
+			rethrowPos = c.emit(code.OpTry, 9999)
+		}
+		if err := c.compileBlockExpression(node.Catch); err != nil {
+			return err
+		}
+		if node.Finally != nil {
+			c.emit(code.OpEndTry)
+			endJumps = append(endJumps, c.emit(code.OpJump, 9999))
+			c.changeOperand(rethrowPos, len(c.currentInstructions()))
+		}
+
+		c.symbolTable = c.symbolTable.Outer
+		c.changeOperands(clearPos, firstLocal, frame.numLocals-firstLocal)
+	}
+
+	tries := c.scopes[c.scopeIndex].tries
+	c.scopes[c.scopeIndex].tries = tries[:len(tries)-1]
+
+	if node.Finally != nil {
+		// エラーで抜ける場合は finally の後で投げ直す
+		if err := c.Compile(node.Finally); err != nil {
+			return err
+		}
+		c.emit(code.OpThrow)
+	}
+
+	for _, pos := range endJumps {
+		c.changeOperand(pos, len(c.currentInstructions()))
+	}
+	if node.Finally != nil {
+		if err := c.Compile(node.Finally); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// return/break/continue で try から抜ける前に、飛び先の登録を取り除いて finally を実行する。
+// loops 個のループの内側で始まった try が対象になる
+func (c *Compiler) leaveTries(loops int) error {
+	tries := c.scopes[c.scopeIndex].tries
+	defer func() { c.scopes[c.scopeIndex].tries = tries }()
+
+	for i := len(tries) - 1; i >= 0 && tries[i].loops >= loops; i-- {
+		if tries[i].handler {
+			c.emit(code.OpEndTry)
+		}
+		if tries[i].finally != nil {
+			// finally の中はその try の外側として扱う
+			c.scopes[c.scopeIndex].tries = tries[:i]
+			if err := c.Compile(tries[i].finally); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (c *Compiler) compileFunctionLiteral(node *ast.FunctionLiteral) error {
+	c.enterScope()
+	scanned := []ast.Node{node.Body}
+	for _, d := range node.Defaults {
+		scanned = append(scanned, d)
+	}
+	c.symbolTable.captured = capturedNames(scanned...)
+
+	if node.Name != "" {
+		c.symbolTable.DefineFunctionName(node.Name)
+	}
+
+	// 引数は渡された順にローカル変数の先頭に置かれ、残りの引数の配列がその次に入る
+	var unbound []string
+	params := make([]Symbol, len(node.Parameters))
+	for i, p := range node.Parameters {
+		params[i] = c.symbolTable.Define(p.Value)
+		unbound = append(unbound, p.Value)
+	}
+	var rest Symbol
+	if node.Rest != nil {
+		rest = c.symbolTable.Define(node.Rest.Value)
+		unbound = append(unbound, node.Rest.Value)
+	}
+
+	for i, symbol := range params {
+		if i < len(node.Defaults) && node.Defaults[i] != nil {
+			// 評価器と同じく、既定値からは前の引数だけが見える
+			hidden := c.symbolTable.hide(unbound[i:])
+			jumpPos := c.emit(code.OpJumpIfBound, symbol.Index, 9999)
+			if err := c.Compile(node.Defaults[i]); err != nil {
+				return err
+			}
+			c.emit(code.OpSetLocal, symbol.Index)
+			c.changeOperands(jumpPos, symbol.Index, len(c.currentInstructions()))
+			c.symbolTable.unhide(hidden)
+		}
+		if symbol.Boxed {
+			c.emit(code.OpBoxLocal, symbol.Index)
+		}
+	}
+	if node.Rest != nil && rest.Boxed {
+		c.emit(code.OpBoxLocal, rest.Index)
+	}
+
+	if err := c.Compile(node.Body); err != nil {
+		return err
+	}
+
+	if c.lastInstructionIs(code.OpPop) {
+		c.replaceLastPopWithReturn()
+	}
+	if !c.lastInstructionIs(code.OpReturnValue) {
+		c.emit(code.OpReturn)
+	}
+
+	freeSymbols := c.symbolTable.FreeSymbols
+	numLocals := c.symbolTable.numLocals
+	localNames := c.symbolTable.localNames
+	positions := c.scopes[c.scopeIndex].positions
+	instructions := c.leaveScope()
+
+	var freeNames []string
+	for _, s := range freeSymbols {
+		c.loadCell(s)
+		freeNames = append(freeNames, s.Name)
+	}
+
+	compiledFn := &object.CompiledFunction{
+		Instructions:    instructions,
+		NumLocals:       numLocals,
+		NumParameters:   len(node.Parameters),
+		NumRequired:     node.NumRequired(),
+		Variadic:        node.Rest != nil,
+		Name:            node.Name,
+		LocalNames:      localNames,
+		FreeNames:       freeNames,
+		SourcePositions: positions,
+	}
+
+	fnIndex := c.addConstant(compiledFn)
+	c.emit(code.OpClosure, fnIndex, len(freeSymbols))
+
+	return nil
+}
+
+func (c *Compiler) loadSymbol(s Symbol) {
+	switch s.Scope {
+	case GlobalScope:
+		c.emit(code.OpGetGlobal, s.Index)
+	case LocalScope:
+		if s.Boxed {
+			c.emit(code.OpGetCell, s.Index)
+		} else {
+			c.emit(code.OpGetLocal, s.Index)
+		}
+	case FreeScope:
+		c.emit(code.OpGetFree, s.Index)
+	case FunctionScope:
+		c.emit(code.OpCurrentClosure)
+	}
+}
+
+func (c *Compiler) storeSymbol(s Symbol) {
+	switch s.Scope {
+	case GlobalScope:
+		c.emit(code.OpSetGlobal, s.Index)
+	case LocalScope:
+		if s.Boxed {
+			c.emit(code.OpSetCell, s.Index)
+		} else {
+			c.emit(code.OpSetLocal, s.Index)
+		}
+	case FreeScope:
+		c.emit(code.OpSetFree, s.Index)
+	}
+}
+
+// クロージャに渡すため、変数のセル自体を積む
+func (c *Compiler) loadCell(s Symbol) {
+	switch {
+	case s.Scope == LocalScope && s.Boxed:
+		c.emit(code.OpLoadCell, s.Index)
+	case s.Scope == FreeScope:
+		c.emit(code.OpLoadFree, s.Index)
+	default:
+		// 関数自身など書き換えられない値は新しいセルに入れて渡す
+		c.loadSymbol(s)
+		c.emit(code.OpMakeCell)
+	}
+}
+
+// まだ定義されていない名前は後で定義されるグローバル変数とみなす。
+// 実行時までに定義されなければ identifier not found になる
+func (c *Compiler) forwardGlobal(name string) Symbol {
+	return c.symbolTable.global().Define(name)
+}
+
+func (c *Compiler) builtinConstant(builtin *object.Builtin) int {
+	if index, ok := c.builtins[builtin.Name]; ok {
+		return index
+	}
+	index := c.addConstant(builtin)
+	c.builtins[builtin.Name] = index
+	return index
+}
+
+func (c *Compiler) addConstant(obj object.Object) int {
+	c.constants = append(c.constants, obj)
+	return len(c.constants) - 1
+}
+
+func (c *Compiler) emit(op code.Opcode, operands ...int) int {
+	ins := code.Make(op, operands...)
+	pos := c.addInstruction(ins)
+
+	c.setLastInstruction(op, pos)
+
+	return pos
+}
+
+func (c *Compiler) addInstruction(ins []byte) int {
+	scope := &c.scopes[c.scopeIndex]
+	posNewInstruction := len(scope.instructions)
+
+	// 位置が変わったところだけ記録する
+	if n := len(scope.positions); n == 0 || scope.positions[n-1].Pos != c.pos {
+		scope.positions = append(scope.positions, object.SourcePosition{Offset: posNewInstruction, Pos: c.pos})
+	}
+
+	scope.instructions = append(scope.instructions, ins...)
+
+	return posNewInstruction
+}
+
+func (c *Compiler) setLastInstruction(op code.Opcode, pos int) {
+	previous := c.scopes[c.scopeIndex].lastInstruction
+	last := EmittedInstruction{Opcode: op, Position: pos}
+
+	c.scopes[c.scopeIndex].previousInstruction = previous
+	c.scopes[c.scopeIndex].lastInstruction = last
+}
+
+func (c *Compiler) currentInstructions() code.Instructions {
+	return c.scopes[c.scopeIndex].instructions
+}
+
+func (c *Compiler) lastInstructionIs(op code.Opcode) bool {
+	if len(c.currentInstructions()) == 0 {
+		return false
+	}
+
+	return c.scopes[c.scopeIndex].lastInstruction.Opcode == op
+}
+
+func (c *Compiler) removeLastPop() {
+	scope := &c.scopes[c.scopeIndex]
+	last := scope.lastInstruction
+
+	scope.instructions = scope.instructions[:last.Position]
+	scope.lastInstruction = scope.previousInstruction
+
+	for n := len(scope.positions); n > 0 && scope.positions[n-1].Offset >= last.Position; n-- {
+		scope.positions = scope.positions[:n-1]
+	}
+}
+
+func (c *Compiler) replaceLastPopWithReturn() {
+	lastPos := c.scopes[c.scopeIndex].lastInstruction.Position
+	c.replaceInstruction(lastPos, code.Make(code.OpReturnValue))
+
+	c.scopes[c.scopeIndex].lastInstruction.Opcode = code.OpReturnValue
+}
+
+func (c *Compiler) replaceInstruction(pos int, newInstruction []byte) {
+	ins := c.currentInstructions()
+
+	for i := 0; i < len(newInstruction); i++ {
+		ins[pos+i] = newInstruction[i]
+	}
+}
+
+func (c *Compiler) changeOperand(opPos int, operand int) {
+	c.changeOperands(opPos, operand)
+}
+
+func (c *Compiler) changeOperands(opPos int, operands ...int) {
+	op := code.Opcode(c.currentInstructions()[opPos])
+	newInstruction := code.Make(op, operands...)
+
+	c.replaceInstruction(opPos, newInstruction)
+}
+
+func (c *Compiler) enterScope() {
+	c.scopes = append(c.scopes, CompilationScope{})
+	c.scopeIndex++
+
+	c.symbolTable = NewEnclosedSymbolTable(c.symbolTable)
+}
+
+func (c *Compiler) leaveScope() code.Instructions {
+	instructions := c.currentInstructions()
+
+	c.scopes = c.scopes[:len(c.scopes)-1]
+	c.scopeIndex--
+
+	c.symbolTable = c.symbolTable.Outer
+
+	return instructions
+}
+
+func (c *Compiler) enterLoop(continueTarget int) *loopContext {
+	loop := &loopContext{continueTarget: continueTarget}
+	scope := &c.scopes[c.scopeIndex]
+	scope.loops = append(scope.loops, loop)
+	return loop
+}
+
+func (c *Compiler) leaveLoop() {
+	scope := &c.scopes[c.scopeIndex]
+	scope.loops = scope.loops[:len(scope.loops)-1]
+}
+
+func (c *Compiler) currentLoop() *loopContext {
+	loops := c.scopes[c.scopeIndex].loops
+	if len(loops) == 0 {
+		return nil
+	}
+	return loops[len(loops)-1]
+}
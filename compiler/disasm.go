@@ -0,0 +1,117 @@
+package compiler
+
+import (
+	"fmt"
+	"io"
+	"monkey/code"
+	"monkey/object"
+	"strconv"
+	"strings"
+)
+
+// バイトコードを人が読める形で書き出す。
+// source を渡すと、ソースの行が変わるところにその行を注記する
+func Disassemble(w io.Writer, b *Bytecode, source string) {
+	var lines []string
+	if source != "" {
+		lines = strings.Split(source, "\n")
+	}
+
+	disassembleFunction(w, b, b.Main, "<main>", lines)
+
+	for i, c := range b.Constants {
+		if fn, ok := c.(*object.CompiledFunction); ok {
+			name := fmt.Sprintf("constant %d: fn %s", i, fn.DisplayName())
+			disassembleFunction(w, b, fn, name, lines)
+		}
+	}
+}
+
+func disassembleFunction(w io.Writer, b *Bytecode, fn *object.CompiledFunction, name string, lines []string) {
+	fmt.Fprintf(w, "== %s (params=%d, locals=%d, free=%d) ==\n", name, fn.NumParameters, fn.NumLocals, len(fn.FreeNames))
+
+	line := 0
+	for ip := 0; ip < len(fn.Instructions); {
+		pos := fn.PositionAt(ip)
+		if pos.Line != line && pos.IsValid() {
+			line = pos.Line
+			location := strconv.Itoa(line)
+			if pos.Filename != "" {
+				location = pos.Filename + ":" + location
+			}
+			if line <= len(lines) {
+				fmt.Fprintf(w, "     ; %s: %s\n", location, strings.TrimSpace(lines[line-1]))
+			} else {
+				fmt.Fprintf(w, "     ; %s\n", location)
+			}
+		}
+
+		text, width := FormatInstruction(b, fn, ip)
+		fmt.Fprintf(w, "%04d %s\n", ip, text)
+		ip += width
+	}
+
+	fmt.Fprintln(w)
+}
+
+// ip の命令をオペランドの参照先(定数や変数名)付きで整形し、命令の長さと共に返す
+func FormatInstruction(b *Bytecode, fn *object.CompiledFunction, ip int) (string, int) {
+	ins := fn.Instructions
+	def, err := code.Lookup(ins[ip])
+	if err != nil {
+		return "ERROR: " + err.Error(), 1
+	}
+
+	operands, read := code.ReadOperands(def, ins[ip+1:])
+
+	text := def.Name
+	for _, o := range operands {
+		text += " " + strconv.Itoa(o)
+	}
+
+	if note := operandNote(b, fn, code.Opcode(ins[ip]), operands); note != "" {
+		text = fmt.Sprintf("%-24s ; %s", text, note)
+	}
+
+	return text, 1 + read
+}
+
+func operandNote(b *Bytecode, fn *object.CompiledFunction, op code.Opcode, operands []int) string {
+	name := func(names []string, i int) string {
+		if i < len(names) {
+			return names[i]
+		}
+		return "?"
+	}
+
+	switch op {
+	case code.OpConstant:
+		if operands[0] < len(b.Constants) {
+			return describeConstant(b.Constants[operands[0]])
+		}
+	case code.OpClosure:
+		if operands[0] < len(b.Constants) {
+			return describeConstant(b.Constants[operands[0]])
+		}
+	case code.OpGetGlobal, code.OpSetGlobal:
+		return name(b.GlobalNames, operands[0])
+	case code.OpGetLocal, code.OpSetLocal, code.OpGetCell, code.OpSetCell, code.OpLoadCell, code.OpBoxLocal, code.OpJumpIfBound:
+		return name(fn.LocalNames, operands[0])
+	case code.OpGetFree, code.OpSetFree, code.OpLoadFree:
+		return name(fn.FreeNames, operands[0])
+	}
+	return ""
+}
+
+func describeConstant(obj object.Object) string {
+	switch obj := obj.(type) {
+	case *object.String:
+		return strconv.Quote(obj.Value)
+	case *object.Builtin:
+		return "builtin " + obj.Name
+	case *object.CompiledFunction:
+		return "fn " + obj.DisplayName()
+	default:
+		return obj.Inspect()
+	}
+}
@@ -0,0 +1,76 @@
+package compiler
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDisassemble(t *testing.T) {
+	input := "let add = fn(a, b) { a + b };\nputs(add(1, \"x\"));"
+
+	compiler := New()
+	if err := compiler.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	var out bytes.Buffer
+	Disassemble(&out, compiler.Bytecode(), input)
+
+	expected := `== <main> (params=0, locals=0, free=0) ==
+     ; 1: let add = fn(a, b) { a + b };
+0000 OpClosure 0 0            ; fn add
+0004 OpSetGlobal 0            ; add
+     ; 2: puts(add(1, "x"));
+0007 OpConstant 1             ; builtin puts
+0010 OpGetGlobal 0            ; add
+0013 OpConstant 2             ; 1
+0016 OpConstant 3             ; "x"
+0019 OpCall 2
+0021 OpCall 1
+0023 OpPop
+
+== constant 0: fn add (params=2, locals=2, free=0) ==
+     ; 1: let add = fn(a, b) { a + b };
+0000 OpGetLocal 0             ; a
+0003 OpGetLocal 1             ; b
+0006 OpAdd
+0007 OpReturnValue
+
+`
+	if out.String() != expected {
+		t.Errorf("wrong disassembly.\nwant=\n%s\ngot=\n%s", expected, out.String())
+	}
+}
+
+func TestDisassembleWithoutSource(t *testing.T) {
+	compiler := New()
+	if err := compiler.Compile(parse("let f = fn() { let x = 1; fn() { x } }")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	var out bytes.Buffer
+	Disassemble(&out, compiler.Bytecode(), "")
+
+	expected := `== <main> (params=0, locals=0, free=0) ==
+     ; 1
+0000 OpClosure 2 0            ; fn f
+0004 OpSetGlobal 0            ; f
+
+== constant 1: fn <anonymous> (params=0, locals=0, free=1) ==
+     ; 1
+0000 OpGetFree 0              ; x
+0002 OpReturnValue
+
+== constant 2: fn f (params=0, locals=1, free=0) ==
+     ; 1
+0000 OpConstant 0             ; 1
+0003 OpSetCell 0              ; x
+0006 OpLoadCell 0             ; x
+0009 OpClosure 1 1            ; fn <anonymous>
+0013 OpReturnValue
+
+`
+	if out.String() != expected {
+		t.Errorf("wrong disassembly.\nwant=\n%s\ngot=\n%s", expected, out.String())
+	}
+}
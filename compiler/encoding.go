@@ -0,0 +1,519 @@
+package compiler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math"
+	"monkey/code"
+	"monkey/evaluator"
+	"monkey/object"
+	"monkey/token"
+)
+
+// コンパイル済みファイル(.mkc)の形式
+//
+//	magic    "MKC\x00"
+//	version  uint16 (big endian)
+//	payload  グローバル変数名、定数、トップレベルの関数
+//	checksum payloadのCRC32 (big endian)
+//
+// payload中の整数は可変長(varint)で書く。
+// 位置情報のファイル名は初出の時だけ文字列を書き、以降は番号で参照する。
+// 命令や形式を変えたらVersionを上げる
+const (
+	Magic   = "MKC\x00"
+	Version = 3
+)
+
+// 定数の種類
+const (
+	tagInteger  byte = 'i'
+	tagFloat    byte = 'f'
+	tagString   byte = 's'
+	tagBuiltin  byte = 'b'
+	tagFunction byte = 'c'
+)
+
+var (
+	ErrBadMagic = errors.New("not a monkey bytecode file")
+	ErrCorrupt  = errors.New("corrupt bytecode")
+)
+
+type VersionError struct {
+	Version int
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("unsupported bytecode version %d (want %d)", e.Version, Version)
+}
+
+func (b *Bytecode) WriteTo(w io.Writer) (int64, error) {
+	enc := &encoder{files: map[string]int{}}
+
+	enc.uvarint(uint64(len(b.GlobalNames)))
+	for _, name := range b.GlobalNames {
+		enc.string(name)
+	}
+
+	enc.uvarint(uint64(len(b.Constants)))
+	for i, c := range b.Constants {
+		if err := enc.constant(c); err != nil {
+			return 0, fmt.Errorf("constant %d: %s", i, err)
+		}
+	}
+
+	enc.function(b.Main)
+
+	var out bytes.Buffer
+	out.WriteString(Magic)
+	binary.Write(&out, binary.BigEndian, uint16(Version))
+	out.Write(enc.buf.Bytes())
+	binary.Write(&out, binary.BigEndian, crc32.ChecksumIEEE(enc.buf.Bytes()))
+
+	n, err := w.Write(out.Bytes())
+	return int64(n), err
+}
+
+func ReadBytecode(r io.Reader) (*Bytecode, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < len(Magic) || string(data[:len(Magic)]) != Magic {
+		return nil, ErrBadMagic
+	}
+	data = data[len(Magic):]
+
+	if len(data) < 2 {
+		return nil, corrupt("missing version")
+	}
+	if version := int(binary.BigEndian.Uint16(data)); version != Version {
+		return nil, &VersionError{Version: version}
+	}
+	data = data[2:]
+
+	if len(data) < 4 {
+		return nil, corrupt("missing checksum")
+	}
+	payload, sum := data[:len(data)-4], binary.BigEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(payload) != sum {
+		return nil, corrupt("checksum mismatch")
+	}
+
+	dec := &decoder{data: payload}
+	bytecode, err := dec.bytecode()
+	if err != nil {
+		return nil, err
+	}
+	if len(dec.data) != 0 {
+		return nil, corrupt("trailing data")
+	}
+
+	return bytecode, nil
+}
+
+func corrupt(format string, a ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrCorrupt, fmt.Sprintf(format, a...))
+}
+
+type encoder struct {
+	buf   bytes.Buffer
+	files map[string]int
+}
+
+func (e *encoder) uvarint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	e.buf.Write(b[:n])
+}
+
+func (e *encoder) varint(v int64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(b[:], v)
+	e.buf.Write(b[:n])
+}
+
+func (e *encoder) string(s string) {
+	e.uvarint(uint64(len(s)))
+	e.buf.WriteString(s)
+}
+
+func (e *encoder) strings(ss []string) {
+	e.uvarint(uint64(len(ss)))
+	for _, s := range ss {
+		e.string(s)
+	}
+}
+
+func (e *encoder) constant(obj object.Object) error {
+	switch obj := obj.(type) {
+	case *object.Integer:
+		e.buf.WriteByte(tagInteger)
+		e.varint(obj.Value)
+	case *object.Float:
+		e.buf.WriteByte(tagFloat)
+		e.uvarint(math.Float64bits(obj.Value))
+	case *object.String:
+		e.buf.WriteByte(tagString)
+		e.string(obj.Value)
+	case *object.Builtin:
+		e.buf.WriteByte(tagBuiltin)
+		e.string(obj.Name)
+	case *object.CompiledFunction:
+		e.buf.WriteByte(tagFunction)
+		e.function(obj)
+	default:
+		return fmt.Errorf("cannot encode %s", obj.Type())
+	}
+	return nil
+}
+
+func (e *encoder) function(fn *object.CompiledFunction) {
+	e.string(fn.Name)
+	e.uvarint(uint64(fn.NumLocals))
+	e.uvarint(uint64(fn.NumParameters))
+	e.uvarint(uint64(fn.NumRequired))
+	variadic := 0
+	if fn.Variadic {
+		variadic = 1
+	}
+	e.uvarint(uint64(variadic))
+	e.strings(fn.LocalNames)
+	e.strings(fn.FreeNames)
+
+	e.uvarint(uint64(len(fn.Instructions)))
+	e.buf.Write(fn.Instructions)
+
+	e.uvarint(uint64(len(fn.SourcePositions)))
+	for _, sp := range fn.SourcePositions {
+		e.uvarint(uint64(sp.Offset))
+		e.position(sp.Pos)
+	}
+}
+
+func (e *encoder) position(pos token.Position) {
+	index, ok := e.files[pos.Filename]
+	if !ok {
+		index = len(e.files)
+		e.files[pos.Filename] = index
+	}
+	e.uvarint(uint64(index))
+	if !ok {
+		e.string(pos.Filename)
+	}
+
+	e.uvarint(uint64(pos.Offset))
+	e.uvarint(uint64(pos.Line))
+	e.uvarint(uint64(pos.Column))
+}
+
+type decoder struct {
+	data  []byte
+	files []string
+}
+
+func (d *decoder) bytecode() (*Bytecode, error) {
+	globalNames, err := d.strings()
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := d.length()
+	if err != nil {
+		return nil, err
+	}
+	constants := make([]object.Object, n)
+	for i := range constants {
+		if constants[i], err = d.constant(); err != nil {
+			return nil, err
+		}
+	}
+
+	main, err := d.function()
+	if err != nil {
+		return nil, err
+	}
+
+	// 壊れた命令列でVMがpanicしないよう、読み込み時に確かめておく
+	for _, c := range constants {
+		if fn, ok := c.(*object.CompiledFunction); ok {
+			if err := verifyFunction(fn, constants, len(globalNames)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := verifyFunction(main, constants, len(globalNames)); err != nil {
+		return nil, err
+	}
+
+	return &Bytecode{Main: main, Constants: constants, GlobalNames: globalNames}, nil
+}
+
+func (d *decoder) uvarint() (uint64, error) {
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		return 0, corrupt("bad integer")
+	}
+	d.data = d.data[n:]
+	return v, nil
+}
+
+func (d *decoder) varint() (int64, error) {
+	v, n := binary.Varint(d.data)
+	if n <= 0 {
+		return 0, corrupt("bad integer")
+	}
+	d.data = d.data[n:]
+	return v, nil
+}
+
+// 要素数や長さ。残りのデータより大きければ壊れている
+func (d *decoder) length() (int, error) {
+	v, err := d.uvarint()
+	if err != nil {
+		return 0, err
+	}
+	if v > uint64(len(d.data)) {
+		return 0, corrupt("length %d out of range", v)
+	}
+	return int(v), nil
+}
+
+// 上限のある整数(ローカル変数の数など)
+func (d *decoder) int(max int) (int, error) {
+	v, err := d.uvarint()
+	if err != nil {
+		return 0, err
+	}
+	if v > uint64(max) {
+		return 0, corrupt("value %d out of range", v)
+	}
+	return int(v), nil
+}
+
+func (d *decoder) bytes() ([]byte, error) {
+	n, err := d.length()
+	if err != nil {
+		return nil, err
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b, nil
+}
+
+func (d *decoder) string() (string, error) {
+	b, err := d.bytes()
+	return string(b), err
+}
+
+func (d *decoder) strings() ([]string, error) {
+	n, err := d.length()
+	if err != nil || n == 0 {
+		return nil, err
+	}
+	ss := make([]string, n)
+	for i := range ss {
+		if ss[i], err = d.string(); err != nil {
+			return nil, err
+		}
+	}
+	return ss, nil
+}
+
+func (d *decoder) constant() (object.Object, error) {
+	if len(d.data) == 0 {
+		return nil, corrupt("missing constant")
+	}
+	tag := d.data[0]
+	d.data = d.data[1:]
+
+	switch tag {
+	case tagInteger:
+		v, err := d.varint()
+		return &object.Integer{Value: v}, err
+	case tagFloat:
+		v, err := d.uvarint()
+		return &object.Float{Value: math.Float64frombits(v)}, err
+	case tagString:
+		s, err := d.string()
+		return &object.String{Value: s}, err
+	case tagBuiltin:
+		name, err := d.string()
+		if err != nil {
+			return nil, err
+		}
+		builtin, ok := evaluator.LookupBuiltin(name)
+		if !ok {
+			return nil, corrupt("unknown builtin %q", name)
+		}
+		return builtin, nil
+	case tagFunction:
+		return d.function()
+	default:
+		return nil, corrupt("unknown constant tag %q", tag)
+	}
+}
+
+func (d *decoder) function() (*object.CompiledFunction, error) {
+	var err error
+	fn := &object.CompiledFunction{}
+
+	if fn.Name, err = d.string(); err != nil {
+		return nil, err
+	}
+	if fn.NumLocals, err = d.int(math.MaxUint16); err != nil {
+		return nil, err
+	}
+	if fn.NumParameters, err = d.int(fn.NumLocals); err != nil {
+		return nil, err
+	}
+	if fn.NumRequired, err = d.int(fn.NumParameters); err != nil {
+		return nil, err
+	}
+	variadic, err := d.int(1)
+	if err != nil {
+		return nil, err
+	}
+	fn.Variadic = variadic == 1
+	if fn.Variadic && fn.NumParameters >= fn.NumLocals {
+		return nil, corrupt("no local for rest parameter")
+	}
+	if fn.LocalNames, err = d.strings(); err != nil {
+		return nil, err
+	}
+	if fn.FreeNames, err = d.strings(); err != nil {
+		return nil, err
+	}
+
+	instructions, err := d.bytes()
+	if err != nil {
+		return nil, err
+	}
+	if len(instructions) > 0 {
+		fn.Instructions = append(code.Instructions{}, instructions...)
+	}
+
+	n, err := d.length()
+	if err != nil || n == 0 {
+		return fn, err
+	}
+	fn.SourcePositions = make([]object.SourcePosition, n)
+	for i := range fn.SourcePositions {
+		offset, err := d.int(len(fn.Instructions))
+		if err != nil {
+			return nil, err
+		}
+		pos, err := d.position()
+		if err != nil {
+			return nil, err
+		}
+		fn.SourcePositions[i] = object.SourcePosition{Offset: offset, Pos: pos}
+	}
+
+	return fn, nil
+}
+
+func (d *decoder) position() (token.Position, error) {
+	var pos token.Position
+
+	index, err := d.uvarint()
+	if err != nil {
+		return pos, err
+	}
+	switch {
+	case index < uint64(len(d.files)):
+		pos.Filename = d.files[index]
+	case index == uint64(len(d.files)):
+		if pos.Filename, err = d.string(); err != nil {
+			return pos, err
+		}
+		d.files = append(d.files, pos.Filename)
+	default:
+		return pos, corrupt("bad file index %d", index)
+	}
+
+	fields := []*int{&pos.Offset, &pos.Line, &pos.Column}
+	for _, f := range fields {
+		if *f, err = d.int(math.MaxInt32); err != nil {
+			return pos, err
+		}
+	}
+
+	return pos, nil
+}
+
+// 命令が定義済みで、オペランドの参照先が範囲内かを確かめる
+func verifyFunction(fn *object.CompiledFunction, constants []object.Object, numGlobals int) error {
+	ins := fn.Instructions
+
+	for i := 0; i < len(ins); {
+		def, err := code.Lookup(ins[i])
+		if err != nil {
+			return corrupt("%s at %d", err, i)
+		}
+
+		width := 0
+		for _, w := range def.OperandWidths {
+			width += w
+		}
+		if i+1+width > len(ins) {
+			return corrupt("truncated %s at %d", def.Name, i)
+		}
+
+		operands, _ := code.ReadOperands(def, ins[i+1:])
+		switch code.Opcode(ins[i]) {
+		case code.OpConstant:
+			if operands[0] >= len(constants) {
+				return corrupt("constant %d out of range at %d", operands[0], i)
+			}
+		case code.OpClosure:
+			if operands[0] >= len(constants) {
+				return corrupt("constant %d out of range at %d", operands[0], i)
+			}
+			if _, ok := constants[operands[0]].(*object.CompiledFunction); !ok {
+				return corrupt("constant %d is not a function at %d", operands[0], i)
+			}
+		case code.OpGetGlobal, code.OpSetGlobal:
+			if operands[0] >= numGlobals {
+				return corrupt("global %d out of range at %d", operands[0], i)
+			}
+		case code.OpGetLocal, code.OpSetLocal, code.OpGetCell, code.OpSetCell, code.OpLoadCell, code.OpBoxLocal:
+			if operands[0] >= fn.NumLocals {
+				return corrupt("local %d out of range at %d", operands[0], i)
+			}
+		case code.OpClearLocals:
+			if operands[0]+operands[1] > fn.NumLocals {
+				return corrupt("locals %d..%d out of range at %d", operands[0], operands[0]+operands[1], i)
+			}
+		case code.OpGetFree, code.OpSetFree, code.OpLoadFree:
+			if operands[0] >= len(fn.FreeNames) {
+				return corrupt("free variable %d out of range at %d", operands[0], i)
+			}
+		case code.OpJump, code.OpJumpNotTruthy, code.OpAndJump, code.OpOrJump, code.OpTry:
+			if operands[0] > len(ins) {
+				return corrupt("jump target %d out of range at %d", operands[0], i)
+			}
+		case code.OpJumpIfBound:
+			if operands[0] >= fn.NumLocals {
+				return corrupt("local %d out of range at %d", operands[0], i)
+			}
+			if operands[1] > len(ins) {
+				return corrupt("jump target %d out of range at %d", operands[1], i)
+			}
+		case code.OpIterNext:
+			if operands[1] > len(ins) {
+				return corrupt("jump target %d out of range at %d", operands[1], i)
+			}
+		}
+
+		i += 1 + width
+	}
+
+	return nil
+}
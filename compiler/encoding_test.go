@@ -0,0 +1,146 @@
+package compiler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"monkey/code"
+	"monkey/lexer"
+	"monkey/object"
+	"monkey/parser"
+	"reflect"
+	"testing"
+)
+
+func TestBytecodeRoundTrip(t *testing.T) {
+	input := `
+let add = fn(a, b) { a + b };
+let counter = fn() { let n = 0; fn() { n += 1 } };
+let opt = fn(a, b = a, ...rest) { a + b + len(rest) };
+let safe = fn(x) { try { x + 1 } catch (e) { throw e } finally { 0 } };
+for (i in 0..3) { puts(add(i, 1.5), "x") }
+len([1, 2]);
+`
+	l := lexer.NewWithFilename("sample.monkey", input)
+	p := parser.New(l)
+	program := p.ParseProgram()
+
+	compiler := New()
+	if err := compiler.Compile(program); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	original := compiler.Bytecode()
+
+	var buf bytes.Buffer
+	if _, err := original.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo failed: %s", err)
+	}
+
+	decoded, err := ReadBytecode(&buf)
+	if err != nil {
+		t.Fatalf("ReadBytecode failed: %s", err)
+	}
+
+	if !reflect.DeepEqual(decoded.GlobalNames, original.GlobalNames) {
+		t.Errorf("global names differ. want=%v, got=%v", original.GlobalNames, decoded.GlobalNames)
+	}
+	if !reflect.DeepEqual(decoded.Main, original.Main) {
+		t.Errorf("main function differs.\nwant=%+v\ngot =%+v", original.Main, decoded.Main)
+	}
+	if len(decoded.Constants) != len(original.Constants) {
+		t.Fatalf("wrong number of constants. want=%d, got=%d", len(original.Constants), len(decoded.Constants))
+	}
+	for i, c := range original.Constants {
+		switch c := c.(type) {
+		case *object.Builtin:
+			// 組み込み関数は名前で引き直すので同じオブジェクトになる
+			if decoded.Constants[i] != c {
+				t.Errorf("constant %d differs. want=%s, got=%+v", i, c.Name, decoded.Constants[i])
+			}
+		default:
+			if !reflect.DeepEqual(decoded.Constants[i], c) {
+				t.Errorf("constant %d differs. want=%+v, got=%+v", i, c, decoded.Constants[i])
+			}
+		}
+	}
+}
+
+func encode(b *Bytecode) []byte {
+	var buf bytes.Buffer
+	b.WriteTo(&buf)
+	return buf.Bytes()
+}
+
+// 命令を増やしたらVersionを上げて、ここも合わせる
+func TestVersionCoversOpcodes(t *testing.T) {
+	const last = code.OpSlice
+	if Version != 3 {
+		t.Fatalf("Version changed to %d: update the last opcode here", Version)
+	}
+	if _, err := code.Lookup(byte(last + 1)); err == nil {
+		t.Errorf("opcode %d was added after %s: bump Version", last+1, "OpSlice")
+	}
+}
+
+func TestReadBytecodeErrors(t *testing.T) {
+	compiler := New()
+	if err := compiler.Compile(parse("let a = 1; a + 2")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	var buf bytes.Buffer
+	compiler.Bytecode().WriteTo(&buf)
+	valid := buf.Bytes()
+
+	modify := func(f func(b []byte) []byte) []byte {
+		return f(append([]byte{}, valid...))
+	}
+	// チェックサムを付け直して中身だけ壊す
+	resign := func(b []byte) []byte {
+		payload := b[len(Magic)+2 : len(b)-4]
+		binary.BigEndian.PutUint32(b[len(b)-4:], crc32.ChecksumIEEE(payload))
+		return b
+	}
+
+	tests := []struct {
+		name     string
+		data     []byte
+		expected string
+	}{
+		{"empty", []byte{}, "not a monkey bytecode file"},
+		{"source file", []byte("let a = 1;"), "not a monkey bytecode file"},
+		{"version", modify(func(b []byte) []byte { b[5] = 2; return b }), "unsupported bytecode version 2 (want 3)"},
+		{"truncated", valid[:len(valid)-3], "corrupt bytecode: checksum mismatch"},
+		{"flipped", modify(func(b []byte) []byte { b[10] ^= 0xff; return b }), "corrupt bytecode: checksum mismatch"},
+		{"bad opcode", encode(&Bytecode{Main: &object.CompiledFunction{
+			Instructions: []byte{byte(code.OpTrue), 0xff},
+		}}), "corrupt bytecode: opcode 255 undefined at 1"},
+		{"bad constant", encode(&Bytecode{Main: &object.CompiledFunction{
+			Instructions: code.Make(code.OpConstant, 3),
+		}}), "corrupt bytecode: constant 3 out of range at 0"},
+		{"truncated operand", encode(&Bytecode{Main: &object.CompiledFunction{
+			Instructions: code.Make(code.OpConstant, 0)[:2],
+		}}), "corrupt bytecode: truncated OpConstant at 0"},
+		{"bad length", modify(func(b []byte) []byte {
+			// グローバル変数の数を大きくする
+			b[len(Magic)+2] = 0x7f
+			return resign(b)
+		}), "corrupt bytecode: length 127 out of range"},
+	}
+
+	for _, tt := range tests {
+		_, err := ReadBytecode(bytes.NewReader(tt.data))
+		if err == nil {
+			t.Errorf("%s: expected error, got none", tt.name)
+			continue
+		}
+		if err.Error() != tt.expected {
+			t.Errorf("%s: wrong error. want=%q, got=%q", tt.name, tt.expected, err)
+		}
+	}
+
+	_, err := ReadBytecode(bytes.NewReader(modify(func(b []byte) []byte { b[10] ^= 0xff; return b })))
+	if !errors.Is(err, ErrCorrupt) {
+		t.Errorf("error is not ErrCorrupt. got=%v", err)
+	}
+}
@@ -0,0 +1,45 @@
+package compiler
+
+import (
+	"fmt"
+	"monkey/ast"
+	"monkey/evaluator"
+	"monkey/lexer"
+	"monkey/parser"
+	"strings"
+	"sync"
+)
+
+var (
+	preludeOnce    sync.Once
+	preludeProgram *ast.Program
+)
+
+// 標準ライブラリ全体を1つの関数で包み、その関数が返す公開の値だけをグローバル変数に束縛する。
+// 標準ライブラリの関数どうしの参照は自由変数になるので、プログラムがグローバル変数を
+// 上書きしても影響を受けない。最初の行に続けて包むので、行番号は元のファイルと変わらない
+func loadPrelude() *ast.Program {
+	preludeOnce.Do(func() {
+		names := evaluator.PreludeNames()
+
+		var src strings.Builder
+		src.WriteString("let _prelude = fn() { ")
+		src.WriteString(evaluator.PreludeSource)
+		fmt.Fprintf(&src, "\n;[%s] }();\n", strings.Join(names, ", "))
+		for i, name := range names {
+			fmt.Fprintf(&src, "let %s = _prelude[%d];\n", name, i)
+		}
+
+		p := parser.New(lexer.NewWithFilename(evaluator.PreludeFilename, src.String()))
+		preludeProgram = p.ParseProgram()
+		if len(p.Errors()) != 0 {
+			panic("prelude: " + strings.Join(p.Errors(), "; "))
+		}
+	})
+	return preludeProgram
+}
+
+// 標準ライブラリ(map, filter など)をコンパイルする。プログラムより先に呼ぶ
+func (c *Compiler) CompilePrelude() error {
+	return c.Compile(loadPrelude())
+}
@@ -0,0 +1,160 @@
+package compiler
+
+type SymbolScope string
+
+const (
+	GlobalScope   SymbolScope = "GLOBAL"
+	LocalScope    SymbolScope = "LOCAL"
+	FreeScope     SymbolScope = "FREE"
+	FunctionScope SymbolScope = "FUNCTION"
+)
+
+type Symbol struct {
+	Name  string
+	Scope SymbolScope
+	Index int
+	Boxed bool // クロージャに捕捉されるローカル変数はセルに入れる
+}
+
+type SymbolTable struct {
+	Outer *SymbolTable
+
+	store          map[string]Symbol
+	numDefinitions int // グローバル変数の数
+	numLocals      int // ローカル変数のスロット数(トップレベルではブロック内の変数の分)
+	localNames     []string
+	FreeSymbols    []Symbol
+
+	// ブロックスコープ(forの本体)は外側の関数とスロットを共有する
+	block bool
+	// 内側の関数から参照される名前。これらのローカル変数はセルに入れる
+	captured map[string]bool
+}
+
+func NewSymbolTable() *SymbolTable {
+	return &SymbolTable{
+		store:       map[string]Symbol{},
+		FreeSymbols: []Symbol{},
+	}
+}
+
+func NewEnclosedSymbolTable(outer *SymbolTable) *SymbolTable {
+	s := NewSymbolTable()
+	s.Outer = outer
+	return s
+}
+
+func NewBlockSymbolTable(outer *SymbolTable) *SymbolTable {
+	s := NewEnclosedSymbolTable(outer)
+	s.block = true
+	return s
+}
+
+func (s *SymbolTable) isGlobal() bool {
+	return s.Outer == nil
+}
+
+// ローカル変数のスロットを割り当てる関数(またはトップレベル)のテーブル
+func (s *SymbolTable) frame() *SymbolTable {
+	t := s
+	for t.block {
+		t = t.Outer
+	}
+	return t
+}
+
+// 同じスコープで定義済みの名前は同じスロットを再利用する
+func (s *SymbolTable) Define(name string) Symbol {
+	if symbol, ok := s.store[name]; ok && symbol.Scope != FunctionScope {
+		return symbol
+	}
+
+	symbol := Symbol{Name: name}
+	if s.isGlobal() {
+		symbol.Scope = GlobalScope
+		symbol.Index = s.numDefinitions
+		s.numDefinitions++
+	} else {
+		frame := s.frame()
+		symbol.Scope = LocalScope
+		symbol.Index = frame.numLocals
+		symbol.Boxed = s.captured[name]
+		frame.numLocals++
+		frame.localNames = append(frame.localNames, name)
+	}
+
+	s.store[name] = symbol
+	return symbol
+}
+
+func (s *SymbolTable) DefineFunctionName(name string) Symbol {
+	symbol := Symbol{Name: name, Index: 0, Scope: FunctionScope}
+	s.store[name] = symbol
+	return symbol
+}
+
+func (s *SymbolTable) defineFree(original Symbol) Symbol {
+	s.FreeSymbols = append(s.FreeSymbols, original)
+
+	symbol := Symbol{Name: original.Name, Index: len(s.FreeSymbols) - 1, Scope: FreeScope}
+	s.store[original.Name] = symbol
+	return symbol
+}
+
+func (s *SymbolTable) Resolve(name string) (Symbol, bool) {
+	symbol, ok := s.store[name]
+	if ok || s.Outer == nil {
+		return symbol, ok
+	}
+
+	symbol, ok = s.Outer.Resolve(name)
+	if !ok {
+		return symbol, ok
+	}
+
+	// ブロックは外側と同じフレームなのでそのまま使える
+	if s.block || symbol.Scope == GlobalScope {
+		return symbol, ok
+	}
+
+	return s.defineFree(symbol), true
+}
+
+// 最も外側のテーブル
+func (s *SymbolTable) global() *SymbolTable {
+	t := s
+	for t.Outer != nil {
+		t = t.Outer
+	}
+	return t
+}
+
+// グローバル変数の名前をインデックス順に返す
+func (s *SymbolTable) GlobalNames() []string {
+	names := make([]string, s.numDefinitions)
+	for name, symbol := range s.store {
+		if symbol.Scope == GlobalScope {
+			names[symbol.Index] = name
+		}
+	}
+	return names
+}
+
+// 引数の既定値から、まだ束縛されていない引数が見えないように一時的に名前を隠す。
+// 隠した名前は外側のスコープで解決される
+func (s *SymbolTable) hide(names []string) map[string]Symbol {
+	hidden := map[string]Symbol{}
+	for _, name := range names {
+		if symbol, ok := s.store[name]; ok {
+			hidden[name] = symbol
+			delete(s.store, name)
+		}
+	}
+	return hidden
+}
+
+func (s *SymbolTable) unhide(hidden map[string]Symbol) {
+	for name, symbol := range hidden {
+		s.store[name] = symbol
+	}
+}
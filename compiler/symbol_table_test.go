@@ -0,0 +1,117 @@
+package compiler
+
+import "testing"
+
+func TestDefine(t *testing.T) {
+	global := NewSymbolTable()
+	a := global.Define("a")
+	b := global.Define("b")
+	if a != (Symbol{Name: "a", Scope: GlobalScope, Index: 0}) {
+		t.Errorf("a wrong. got=%+v", a)
+	}
+	if b != (Symbol{Name: "b", Scope: GlobalScope, Index: 1}) {
+		t.Errorf("b wrong. got=%+v", b)
+	}
+
+	// 同じスコープで再定義しても同じスロットを使う
+	if again := global.Define("a"); again != a {
+		t.Errorf("redefined a wrong. got=%+v", again)
+	}
+
+	local := NewEnclosedSymbolTable(global)
+	local.captured = map[string]bool{"d": true}
+	c := local.Define("c")
+	d := local.Define("d")
+	if c != (Symbol{Name: "c", Scope: LocalScope, Index: 0}) {
+		t.Errorf("c wrong. got=%+v", c)
+	}
+	if d != (Symbol{Name: "d", Scope: LocalScope, Index: 1, Boxed: true}) {
+		t.Errorf("d wrong. got=%+v", d)
+	}
+}
+
+func TestResolveFree(t *testing.T) {
+	global := NewSymbolTable()
+	global.Define("a")
+
+	firstLocal := NewEnclosedSymbolTable(global)
+	firstLocal.Define("b")
+
+	secondLocal := NewEnclosedSymbolTable(firstLocal)
+	secondLocal.Define("c")
+
+	expected := []Symbol{
+		{Name: "a", Scope: GlobalScope, Index: 0},
+		{Name: "b", Scope: FreeScope, Index: 0},
+		{Name: "c", Scope: LocalScope, Index: 0},
+	}
+	for _, sym := range expected {
+		result, ok := secondLocal.Resolve(sym.Name)
+		if !ok {
+			t.Fatalf("name %s not resolvable", sym.Name)
+		}
+		if result != sym {
+			t.Errorf("expected %s to resolve to %+v, got=%+v", sym.Name, sym, result)
+		}
+	}
+
+	if len(secondLocal.FreeSymbols) != 1 || secondLocal.FreeSymbols[0].Name != "b" {
+		t.Errorf("free symbols wrong. got=%+v", secondLocal.FreeSymbols)
+	}
+
+	if _, ok := secondLocal.Resolve("d"); ok {
+		t.Errorf("name d resolved, but was expected not to")
+	}
+}
+
+func TestBlockScope(t *testing.T) {
+	global := NewSymbolTable()
+	global.Define("a")
+
+	// トップレベルのブロックの変数はmainのローカル変数になる
+	block := NewBlockSymbolTable(global)
+	x := block.Define("x")
+	if x != (Symbol{Name: "x", Scope: LocalScope, Index: 0}) {
+		t.Errorf("x wrong. got=%+v", x)
+	}
+	if a, _ := block.Resolve("a"); a.Scope != GlobalScope {
+		t.Errorf("a wrong. got=%+v", a)
+	}
+
+	fn := NewEnclosedSymbolTable(global)
+	fn.Define("p")
+	inner := NewBlockSymbolTable(fn)
+	y := inner.Define("y")
+	if y != (Symbol{Name: "y", Scope: LocalScope, Index: 1}) {
+		t.Errorf("y wrong. got=%+v", y)
+	}
+	if p, _ := inner.Resolve("p"); p != (Symbol{Name: "p", Scope: LocalScope, Index: 0}) {
+		t.Errorf("p wrong. got=%+v", p)
+	}
+	if fn.numLocals != 2 {
+		t.Errorf("numLocals wrong. want=2, got=%d", fn.numLocals)
+	}
+	if _, ok := fn.Resolve("y"); ok {
+		t.Errorf("y resolved outside of its block")
+	}
+}
+
+func TestDefineAndResolveFunctionName(t *testing.T) {
+	global := NewSymbolTable()
+	fn := NewEnclosedSymbolTable(global)
+	fn.DefineFunctionName("f")
+
+	result, ok := fn.Resolve("f")
+	if !ok {
+		t.Fatalf("function name f not resolvable")
+	}
+	if result != (Symbol{Name: "f", Scope: FunctionScope, Index: 0}) {
+		t.Errorf("f wrong. got=%+v", result)
+	}
+
+	// 引数などで同じ名前を定義したら関数名は隠れる
+	shadow := fn.Define("f")
+	if shadow.Scope != LocalScope {
+		t.Errorf("shadowing f wrong. got=%+v", shadow)
+	}
+}
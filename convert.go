@@ -0,0 +1,499 @@
+package monkey
+
+import (
+	"fmt"
+	"monkey/evaluator"
+	"monkey/object"
+	"reflect"
+)
+
+var (
+	objectType = reflect.TypeOf((*object.Object)(nil)).Elem()
+	errorType  = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// Goの値をMonkeyの値に変換する。
+//
+//	nil, nilポインタ           -> null
+//	bool                       -> BOOLEAN
+//	int*, uint*                -> INTEGER (int64に収まらなければエラー)
+//	float*                     -> FLOAT
+//	string                     -> STRING
+//	スライス, 配列             -> ARRAY
+//	マップ                     -> HASH
+//	構造体                     -> HASH (キーはフィールド名か `monkey:"name"` タグ)
+//	関数                       -> 組み込み関数 (WrapFunc を参照)
+//
+// object.Object はそのまま返す
+func ToObject(v interface{}) (object.Object, error) {
+	if v == nil {
+		return evaluator.NULL, nil
+	}
+	return toObject(reflect.ValueOf(v))
+}
+
+func toObject(v reflect.Value) (object.Object, error) {
+	if !v.IsValid() {
+		return evaluator.NULL, nil
+	}
+	if v.Type().Implements(objectType) {
+		if v.IsNil() {
+			return evaluator.NULL, nil
+		}
+		return v.Interface().(object.Object), nil
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return evaluator.NULL, nil
+		}
+		return toObject(v.Elem())
+	case reflect.Bool:
+		if v.Bool() {
+			return evaluator.TRUE, nil
+		}
+		return evaluator.FALSE, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return &object.Integer{Value: v.Int()}, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if v.Uint() > 1<<63-1 {
+			return nil, fmt.Errorf("%d overflows INTEGER", v.Uint())
+		}
+		return &object.Integer{Value: int64(v.Uint())}, nil
+	case reflect.Float32, reflect.Float64:
+		return &object.Float{Value: v.Float()}, nil
+	case reflect.String:
+		return &object.String{Value: v.String()}, nil
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return evaluator.NULL, nil
+		}
+		elements := make([]object.Object, v.Len())
+		for i := range elements {
+			elem, err := toObject(v.Index(i))
+			if err != nil {
+				return nil, fmt.Errorf("index %d: %w", i, err)
+			}
+			elements[i] = elem
+		}
+		return &object.Array{Elements: elements}, nil
+	case reflect.Map:
+		if v.IsNil() {
+			return evaluator.NULL, nil
+		}
+		hash := &object.Hash{Pairs: make(map[object.HashKey]object.HashPair, v.Len())}
+		iter := v.MapRange()
+		for iter.Next() {
+			key, err := toObject(iter.Key())
+			if err != nil {
+				return nil, fmt.Errorf("key %v: %w", iter.Key(), err)
+			}
+			value, err := toObject(iter.Value())
+			if err != nil {
+				return nil, fmt.Errorf("key %v: %w", iter.Key(), err)
+			}
+			if err := setPair(hash, key, value); err != nil {
+				return nil, err
+			}
+		}
+		return hash, nil
+	case reflect.Struct:
+		hash := &object.Hash{Pairs: make(map[object.HashKey]object.HashPair)}
+		for _, field := range structFields(v.Type()) {
+			value, err := toObject(v.FieldByIndex(field.index))
+			if err != nil {
+				return nil, fmt.Errorf("field %s: %w", field.name, err)
+			}
+			setPair(hash, &object.String{Value: field.name}, value)
+		}
+		return hash, nil
+	case reflect.Func:
+		if v.IsNil() {
+			return evaluator.NULL, nil
+		}
+		return WrapFunc("", v.Interface())
+	default:
+		return nil, fmt.Errorf("unsupported Go type: %s", v.Type())
+	}
+}
+
+func setPair(hash *object.Hash, key, value object.Object) error {
+	hashKey, ok := key.(object.Hashable)
+	if !ok {
+		return fmt.Errorf("unusable as hash key: %s", key.Type())
+	}
+	hash.Pairs[hashKey.HashKey()] = object.HashPair{Key: key, Value: value}
+	return nil
+}
+
+type structField struct {
+	name  string
+	index []int
+}
+
+// 変換の対象になるフィールド。非公開のフィールドと `monkey:"-"` は除く
+func structFields(t reflect.Type) []structField {
+	var fields []structField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name := f.Name
+		if tag, ok := f.Tag.Lookup("monkey"); ok {
+			if tag == "-" {
+				continue
+			}
+			if tag != "" {
+				name = tag
+			}
+		}
+		fields = append(fields, structField{name: name, index: f.Index})
+	}
+	return fields
+}
+
+// Monkeyの値を target (ポインタ) の指す先に変換して格納する。
+// target が *interface{} の場合は null は nil、INTEGER は int64、FLOAT は float64、
+// ARRAY は []interface{}、HASH はキーが全て文字列なら map[string]interface{}、
+// そうでなければ map[interface{}]interface{} になる
+func FromObject(obj object.Object, target interface{}) error {
+	v := reflect.ValueOf(target)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return fmt.Errorf("target must be a non-nil pointer, got %T", target)
+	}
+
+	value, err := fromObject(obj, v.Type().Elem())
+	if err != nil {
+		return err
+	}
+	v.Elem().Set(value)
+	return nil
+}
+
+func fromObject(obj object.Object, t reflect.Type) (reflect.Value, error) {
+	if obj == nil {
+		obj = evaluator.NULL
+	}
+	// object.Object や *object.Array などを受け取る場合は変換しない
+	if t == objectType {
+		return reflect.ValueOf(&obj).Elem(), nil
+	}
+	if t.Implements(objectType) && reflect.TypeOf(obj).AssignableTo(t) {
+		return reflect.ValueOf(obj), nil
+	}
+
+	mismatch := func() (reflect.Value, error) {
+		return reflect.Value{}, fmt.Errorf("cannot convert %s to %s", obj.Type(), t)
+	}
+
+	if obj == evaluator.NULL {
+		switch t.Kind() {
+		case reflect.Ptr, reflect.Interface, reflect.Slice, reflect.Map:
+			return reflect.Zero(t), nil
+		default:
+			return mismatch()
+		}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		elem, err := fromObject(obj, t.Elem())
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		ptr := reflect.New(t.Elem())
+		ptr.Elem().Set(elem)
+		return ptr, nil
+	case reflect.Interface:
+		if t.NumMethod() != 0 {
+			return mismatch()
+		}
+		value, err := toGo(obj)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		result := reflect.New(t).Elem()
+		if value != nil {
+			result.Set(reflect.ValueOf(value))
+		}
+		return result, nil
+	case reflect.Bool:
+		b, ok := obj.(*object.Boolean)
+		if !ok {
+			return mismatch()
+		}
+		return reflect.ValueOf(b.Value).Convert(t), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, ok := obj.(*object.Integer)
+		if !ok {
+			return mismatch()
+		}
+		result := reflect.New(t).Elem()
+		if result.OverflowInt(i.Value) {
+			return reflect.Value{}, fmt.Errorf("%d overflows %s", i.Value, t)
+		}
+		result.SetInt(i.Value)
+		return result, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		i, ok := obj.(*object.Integer)
+		if !ok {
+			return mismatch()
+		}
+		result := reflect.New(t).Elem()
+		if i.Value < 0 || result.OverflowUint(uint64(i.Value)) {
+			return reflect.Value{}, fmt.Errorf("%d overflows %s", i.Value, t)
+		}
+		result.SetUint(uint64(i.Value))
+		return result, nil
+	case reflect.Float32, reflect.Float64:
+		result := reflect.New(t).Elem()
+		switch obj := obj.(type) {
+		case *object.Float:
+			result.SetFloat(obj.Value)
+		case *object.Integer:
+			result.SetFloat(float64(obj.Value))
+		default:
+			return mismatch()
+		}
+		return result, nil
+	case reflect.String:
+		s, ok := obj.(*object.String)
+		if !ok {
+			return mismatch()
+		}
+		return reflect.ValueOf(s.Value).Convert(t), nil
+	case reflect.Slice, reflect.Array:
+		array, ok := obj.(*object.Array)
+		if !ok {
+			return mismatch()
+		}
+		var result reflect.Value
+		if t.Kind() == reflect.Slice {
+			result = reflect.MakeSlice(t, len(array.Elements), len(array.Elements))
+		} else {
+			if len(array.Elements) != t.Len() {
+				return reflect.Value{}, fmt.Errorf("cannot convert ARRAY of length %d to %s", len(array.Elements), t)
+			}
+			result = reflect.New(t).Elem()
+		}
+		for i, e := range array.Elements {
+			elem, err := fromObject(e, t.Elem())
+			if err != nil {
+				return reflect.Value{}, fmt.Errorf("index %d: %w", i, err)
+			}
+			result.Index(i).Set(elem)
+		}
+		return result, nil
+	case reflect.Map:
+		hash, ok := obj.(*object.Hash)
+		if !ok {
+			return mismatch()
+		}
+		result := reflect.MakeMapWithSize(t, len(hash.Pairs))
+		for _, pair := range hash.SortedPairs() {
+			key, err := fromObject(pair.Key, t.Key())
+			if err != nil {
+				return reflect.Value{}, fmt.Errorf("key %s: %w", pair.Key.Inspect(), err)
+			}
+			value, err := fromObject(pair.Value, t.Elem())
+			if err != nil {
+				return reflect.Value{}, fmt.Errorf("key %s: %w", pair.Key.Inspect(), err)
+			}
+			result.SetMapIndex(key, value)
+		}
+		return result, nil
+	case reflect.Struct:
+		hash, ok := obj.(*object.Hash)
+		if !ok {
+			return mismatch()
+		}
+		// ハッシュに無いフィールドはゼロ値のまま、対応するフィールドの無いキーは無視する
+		result := reflect.New(t).Elem()
+		for _, field := range structFields(t) {
+			key := &object.String{Value: field.name}
+			pair, ok := hash.Pairs[key.HashKey()]
+			if !ok {
+				continue
+			}
+			value, err := fromObject(pair.Value, t.FieldByIndex(field.index).Type)
+			if err != nil {
+				return reflect.Value{}, fmt.Errorf("field %s: %w", field.name, err)
+			}
+			result.FieldByIndex(field.index).Set(value)
+		}
+		return result, nil
+	default:
+		return mismatch()
+	}
+}
+
+// interface{} に変換するときのGoの値
+func toGo(obj object.Object) (interface{}, error) {
+	switch obj := obj.(type) {
+	case *object.Null:
+		return nil, nil
+	case *object.Boolean:
+		return obj.Value, nil
+	case *object.Integer:
+		return obj.Value, nil
+	case *object.Float:
+		return obj.Value, nil
+	case *object.String:
+		return obj.Value, nil
+	case *object.Array:
+		result := make([]interface{}, len(obj.Elements))
+		for i, e := range obj.Elements {
+			elem, err := toGo(e)
+			if err != nil {
+				return nil, fmt.Errorf("index %d: %w", i, err)
+			}
+			result[i] = elem
+		}
+		return result, nil
+	case *object.Hash:
+		stringKeys := true
+		for _, pair := range obj.Pairs {
+			if pair.Key.Type() != object.STRING_OBJ {
+				stringKeys = false
+				break
+			}
+		}
+
+		if stringKeys {
+			result := make(map[string]interface{}, len(obj.Pairs))
+			for _, pair := range obj.Pairs {
+				value, err := toGo(pair.Value)
+				if err != nil {
+					return nil, fmt.Errorf("key %s: %w", pair.Key.Inspect(), err)
+				}
+				result[pair.Key.(*object.String).Value] = value
+			}
+			return result, nil
+		}
+
+		result := make(map[interface{}]interface{}, len(obj.Pairs))
+		for _, pair := range obj.Pairs {
+			key, err := toGo(pair.Key)
+			if err != nil {
+				return nil, err
+			}
+			value, err := toGo(pair.Value)
+			if err != nil {
+				return nil, fmt.Errorf("key %s: %w", pair.Key.Inspect(), err)
+			}
+			result[key] = value
+		}
+		return result, nil
+	default:
+		return nil, fmt.Errorf("cannot convert %s to Go value", obj.Type())
+	}
+}
+
+// Goの関数を組み込み関数にする。引数は FromObject で、戻り値は ToObject で変換する。
+// 戻り値は無し、値1つ、error 1つ、(値, error) のいずれか。
+// 引数の数や型が合わない場合、関数が error を返した場合、パニックした場合は
+// Monkeyのエラーになる。メッセージの先頭には関数の名前を付ける
+func WrapFunc(name string, fn interface{}) (*object.Builtin, error) {
+	v := reflect.ValueOf(fn)
+	if v.Kind() != reflect.Func || v.IsNil() {
+		return nil, fmt.Errorf("not a function: %T", fn)
+	}
+
+	t := v.Type()
+	returnsError := t.NumOut() > 0 && t.Out(t.NumOut()-1) == errorType
+	switch {
+	case t.NumOut() > 2,
+		t.NumOut() == 2 && !returnsError:
+		return nil, fmt.Errorf("unsupported return values: %s", t)
+	}
+
+	label := name
+	if label == "" {
+		label = "function"
+	}
+
+	builtin := &object.Builtin{Name: name}
+	builtin.Fn = func(args ...object.Object) (result object.Object) {
+		in, err := funcArgs(t, args)
+		if err != nil {
+			return newError("%s: %s", label, err)
+		}
+
+		defer func() {
+			if r := recover(); r != nil {
+				result = newError("%s: panic: %v", label, r)
+			}
+		}()
+
+		out := v.Call(in)
+		if returnsError {
+			if err, _ := out[len(out)-1].Interface().(error); err != nil {
+				return newError("%s: %s", label, err)
+			}
+			out = out[:len(out)-1]
+		}
+		if len(out) == 0 {
+			return evaluator.NULL
+		}
+
+		obj, err := toObject(out[0])
+		if err != nil {
+			return newError("%s: cannot convert return value: %s", label, err)
+		}
+		return obj
+	}
+	return builtin, nil
+}
+
+func funcArgs(t reflect.Type, args []object.Object) ([]reflect.Value, error) {
+	fixed, max := t.NumIn(), t.NumIn()
+	if t.IsVariadic() {
+		fixed, max = fixed-1, -1
+	}
+	if err := evaluator.CheckArgumentCount(fixed, max, len(args)); err != nil {
+		return nil, err
+	}
+
+	in := make([]reflect.Value, len(args))
+	for i, arg := range args {
+		var argType reflect.Type
+		if i < fixed {
+			argType = t.In(i)
+		} else {
+			argType = t.In(fixed).Elem()
+		}
+
+		value, err := fromObject(arg, argType)
+		if err != nil {
+			return nil, fmt.Errorf("argument %d: %s", i+1, err)
+		}
+		in[i] = value
+	}
+	return in, nil
+}
+
+func newError(format string, a ...interface{}) *object.Error {
+	return &object.Error{Message: fmt.Sprintf(format, a...)}
+}
+
+// Goの関数を組み込み関数として登録する
+func (i *Interpreter) RegisterFunc(name string, fn interface{}) error {
+	builtin, err := WrapFunc(name, fn)
+	if err != nil {
+		return err
+	}
+	i.builtins.Set(name, builtin)
+	return nil
+}
+
+// Goの値を変換してグローバル変数に束縛する
+func (i *Interpreter) SetGlobalValue(name string, value interface{}) error {
+	obj, err := ToObject(value)
+	if err != nil {
+		return err
+	}
+	i.SetGlobal(name, obj)
+	return nil
+}
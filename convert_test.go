@@ -0,0 +1,295 @@
+package monkey
+
+import (
+	"context"
+	"errors"
+	"monkey/evaluator"
+	"monkey/object"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type person struct {
+	Name    string `monkey:"name"`
+	Age     int    `monkey:"age"`
+	Tags    []string
+	Secret  string `monkey:"-"`
+	private int
+}
+
+func TestToObject(t *testing.T) {
+	var nilPtr *int
+	seven := 7
+
+	tests := []struct {
+		input    interface{}
+		expected string
+	}{
+		{nil, "null"},
+		{nilPtr, "null"},
+		{&seven, "7"},
+		{true, "true"},
+		{int8(-5), "-5"},
+		{uint32(5), "5"},
+		{2.5, "2.5"},
+		{float32(1), "1.0"},
+		{"hello", "hello"},
+		{[]int{1, 2, 3}, "[1, 2, 3]"},
+		{[2]string{"a", "b"}, "[a, b]"},
+		{[]interface{}{1, "a", nil}, "[1, a, null]"},
+		{map[int]bool{1: true}, "{1: true}"},
+		{&object.String{Value: "as is"}, "as is"},
+	}
+
+	for _, tt := range tests {
+		obj, err := ToObject(tt.input)
+		if err != nil {
+			t.Errorf("ToObject(%#v) failed: %s", tt.input, err)
+			continue
+		}
+		if obj.Inspect() != tt.expected {
+			t.Errorf("ToObject(%#v) wrong. want=%q, got=%q", tt.input, tt.expected, obj.Inspect())
+		}
+	}
+
+	obj, err := ToObject(person{Name: "Alice", Age: 20, Tags: []string{"x"}, Secret: "s", private: 1})
+	if err != nil {
+		t.Fatalf("ToObject failed: %s", err)
+	}
+	hash := obj.(*object.Hash)
+	if len(hash.Pairs) != 3 {
+		t.Errorf("hash has wrong number of pairs. got=%d", len(hash.Pairs))
+	}
+	for key, expected := range map[string]string{"name": "Alice", "age": "20", "Tags": "[x]"} {
+		pair, ok := hash.Pairs[(&object.String{Value: key}).HashKey()]
+		if !ok {
+			t.Errorf("no pair for key %q", key)
+			continue
+		}
+		if pair.Value.Inspect() != expected {
+			t.Errorf("wrong value for key %q. want=%q, got=%q", key, expected, pair.Value.Inspect())
+		}
+	}
+
+	// 真偽値は評価器と同じシングルトンになる
+	if obj, _ := ToObject(false); obj != evaluator.FALSE {
+		t.Errorf("false is not evaluator.FALSE")
+	}
+}
+
+func TestToObjectErrors(t *testing.T) {
+	tests := []struct {
+		input    interface{}
+		expected string
+	}{
+		{uint64(1 << 63), "9223372036854775808 overflows INTEGER"},
+		{make(chan int), "unsupported Go type: chan int"},
+		{[]interface{}{1, complex(1, 2)}, "index 1: unsupported Go type: complex128"},
+		{map[[2]int]int{{1, 2}: 3}, "unusable as hash key: ARRAY"},
+	}
+
+	for _, tt := range tests {
+		_, err := ToObject(tt.input)
+		if err == nil || err.Error() != tt.expected {
+			t.Errorf("wrong error for %#v. want=%q, got=%v", tt.input, tt.expected, err)
+		}
+	}
+}
+
+func TestFromObject(t *testing.T) {
+	interp := New()
+	obj, err := interp.Run(context.Background(), `{"name": "Bob", "age": 21, "Tags": ["a", "b"], "unknown": 1}`)
+	if err != nil {
+		t.Fatalf("Run failed: %s", err)
+	}
+
+	var p person
+	if err := FromObject(obj, &p); err != nil {
+		t.Fatalf("FromObject failed: %s", err)
+	}
+	expected := person{Name: "Bob", Age: 21, Tags: []string{"a", "b"}}
+	if !reflect.DeepEqual(p, expected) {
+		t.Errorf("wrong struct. want=%+v, got=%+v", expected, p)
+	}
+
+	var m map[string]int
+	obj, _ = interp.Run(context.Background(), `{"a": 1, "b": 2}`)
+	if err := FromObject(obj, &m); err != nil {
+		t.Fatalf("FromObject failed: %s", err)
+	}
+	if !reflect.DeepEqual(m, map[string]int{"a": 1, "b": 2}) {
+		t.Errorf("wrong map. got=%v", m)
+	}
+
+	var any interface{}
+	obj, _ = interp.Run(context.Background(), `[1, 2.5, "s", true, {"k": [1]}, {1: 2}]`)
+	if err := FromObject(obj, &any); err != nil {
+		t.Fatalf("FromObject failed: %s", err)
+	}
+	expectedAny := []interface{}{
+		int64(1), 2.5, "s", true,
+		map[string]interface{}{"k": []interface{}{int64(1)}},
+		map[interface{}]interface{}{int64(1): int64(2)},
+	}
+	if !reflect.DeepEqual(any, expectedAny) {
+		t.Errorf("wrong value. want=%#v, got=%#v", expectedAny, any)
+	}
+
+	var f float64
+	if err := FromObject(&object.Integer{Value: 3}, &f); err != nil || f != 3 {
+		t.Errorf("INTEGER should convert to float64. got=%v, err=%v", f, err)
+	}
+
+	var ptr *int
+	if err := FromObject(&object.Integer{Value: 3}, &ptr); err != nil || ptr == nil || *ptr != 3 {
+		t.Errorf("INTEGER should convert to *int. got=%v, err=%v", ptr, err)
+	}
+	if err := FromObject(evaluator.NULL, &ptr); err != nil || ptr != nil {
+		t.Errorf("null should convert to nil pointer. got=%v, err=%v", ptr, err)
+	}
+
+	var array *object.Array
+	if err := FromObject(&object.Array{}, &array); err != nil || array == nil {
+		t.Errorf("object types should be passed through. err=%v", err)
+	}
+}
+
+func TestFromObjectErrors(t *testing.T) {
+	var i8 int8
+	var u uint
+	var s string
+	var ints []int
+	var pair [2]int
+
+	tests := []struct {
+		obj      object.Object
+		target   interface{}
+		expected string
+	}{
+		{&object.Integer{Value: 300}, &i8, "300 overflows int8"},
+		{&object.Integer{Value: -1}, &u, "-1 overflows uint"},
+		{&object.Integer{Value: 1}, &s, "cannot convert INTEGER to string"},
+		{evaluator.NULL, &s, "cannot convert NULL to string"},
+		{&object.Array{Elements: []object.Object{&object.String{Value: "x"}}}, &ints, "index 0: cannot convert STRING to int"},
+		{&object.Array{}, &pair, "cannot convert ARRAY of length 0 to [2]int"},
+		{&object.Integer{Value: 1}, s, "target must be a non-nil pointer, got string"},
+	}
+
+	for _, tt := range tests {
+		err := FromObject(tt.obj, tt.target)
+		if err == nil || err.Error() != tt.expected {
+			t.Errorf("wrong error. want=%q, got=%v", tt.expected, err)
+		}
+	}
+}
+
+func TestRegisterFunc(t *testing.T) {
+	interp := New()
+
+	funcs := map[string]interface{}{
+		"add":   func(a, b int) int { return a + b },
+		"join":  func(sep string, parts ...string) string { return strings.Join(parts, sep) },
+		"greet": func(p person) string { return "hi " + p.Name },
+		"older": func(p person) person { p.Age++; return p },
+		"noop":  func() {},
+		"fail": func(fail bool) error {
+			if fail {
+				return errors.New("failed")
+			}
+			return nil
+		},
+		"div": func(a, b int) (int, error) {
+			if b == 0 {
+				return 0, errors.New("division by zero")
+			}
+			return a / b, nil
+		},
+		"boom":  func() int { panic("oops") },
+		"apply": func(fn object.Object) string { return string(fn.Type()) },
+		"double": func(xs []float64) []float64 {
+			for i := range xs {
+				xs[i] *= 2
+			}
+			return xs
+		},
+	}
+	for name, fn := range funcs {
+		if err := interp.RegisterFunc(name, fn); err != nil {
+			t.Fatalf("RegisterFunc(%s) failed: %s", name, err)
+		}
+	}
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`add(1, 2)`, "3"},
+		{`join("-", "a", "b", "c")`, "a-b-c"},
+		{`join(",")`, ""},
+		{`greet({"name": "Carol"})`, "hi Carol"},
+		{`older({"name": "Carol", "age": 30})["age"]`, "31"},
+		{`noop()`, "null"},
+		{`fail(false)`, "null"},
+		{`div(7, 2)`, "3"},
+		{`apply(fn(x) { x })`, "FUNCTION"},
+		{`double([1, 1.5])`, "[2.0, 3.0]"},
+		{`add(1)`, "ERROR: add: wrong number of arguments. got=1, want=2"},
+		{`join()`, "ERROR: join: wrong number of arguments. got=0, want>=1"},
+		{`add(1, "2")`, "ERROR: add: argument 2: cannot convert STRING to int"},
+		{`join("-", "a", 1)`, "ERROR: join: argument 3: cannot convert INTEGER to string"},
+		{`fail(true)`, "ERROR: fail: failed"},
+		{`div(1, 0)`, "ERROR: div: division by zero"},
+		{`boom()`, "ERROR: boom: panic: oops"},
+	}
+
+	for _, tt := range tests {
+		result, err := interp.Run(context.Background(), tt.input)
+		var got string
+		if err != nil {
+			got = "ERROR: " + err.(*object.Error).Message
+		} else {
+			got = result.Inspect()
+		}
+		if got != tt.expected {
+			t.Errorf("%s: want=%q, got=%q", tt.input, tt.expected, got)
+		}
+	}
+}
+
+func TestWrapFuncErrors(t *testing.T) {
+	tests := []struct {
+		fn       interface{}
+		expected string
+	}{
+		{1, "not a function: int"},
+		{func() (int, int) { return 0, 0 }, "unsupported return values: func() (int, int)"},
+		{func() (int, string, error) { return 0, "", nil }, "unsupported return values: func() (int, string, error)"},
+	}
+
+	for _, tt := range tests {
+		_, err := WrapFunc("f", tt.fn)
+		if err == nil || err.Error() != tt.expected {
+			t.Errorf("wrong error. want=%q, got=%v", tt.expected, err)
+		}
+	}
+}
+
+func TestSetGlobalValue(t *testing.T) {
+	interp := New()
+	if err := interp.SetGlobalValue("people", []person{{Name: "Alice", Age: 20}, {Name: "Bob", Age: 21}}); err != nil {
+		t.Fatalf("SetGlobalValue failed: %s", err)
+	}
+
+	result, err := interp.Run(context.Background(), `people[1]["name"] + ":" + people[0]["name"]`)
+	if err != nil {
+		t.Fatalf("Run failed: %s", err)
+	}
+	if result.Inspect() != "Bob:Alice" {
+		t.Errorf("wrong result. got=%q", result.Inspect())
+	}
+
+	if err := interp.SetGlobalValue("ch", make(chan int)); err == nil {
+		t.Errorf("expected error for unsupported type")
+	}
+}
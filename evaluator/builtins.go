@@ -1,28 +1,46 @@
 package evaluator
 
 import (
+	"bufio"
 	"fmt"
+	"io"
 	"monkey/object"
+	"os"
+	"strings"
+	"unicode/utf8"
 )
 
-var builtins = map[string]*object.Builtin{
-	"len":   {Fn: builtinLen},
-	"first": {Fn: builtinFirst},
-	"last":  {Fn: builtinLast},
-	"push":  {Fn: builtinPush},
-	"rest":  {Fn: builtinRest},
-	"puts":  {Fn: builtinPuts},
+var builtins = NewBuiltins(os.Stdout, os.Stdin)
+
+// 入出力先を指定して組み込み関数の表を作る。インタプリタごとに別の表を持てる
+func NewBuiltins(stdout io.Writer, stdin io.Reader) map[string]*object.Builtin {
+	builtins := map[string]*object.Builtin{
+		"len":    {Name: "len", Fn: builtinLen},
+		"first":  {Name: "first", Fn: builtinFirst},
+		"last":   {Name: "last", Fn: builtinLast},
+		"push":   {Name: "push", Fn: builtinPush},
+		"append": {Name: "append", Fn: builtinAppend},
+		"rest":   {Name: "rest", Fn: builtinRest},
+		"puts":   {Name: "puts", Fn: newBuiltinPuts(stdout)},
+		"gets":   {Name: "gets", Fn: newBuiltinGets(stdin)},
+		"type":   {Name: "type", Fn: builtinType},
+	}
+	for name, fn := range stringBuiltins {
+		builtins[name] = &object.Builtin{Name: name, Fn: fn}
+	}
+	return builtins
 }
 
 func builtinLen(args ...object.Object) object.Object {
-	if len(args) != 1 {
-		return newError("wrong number of arguments. got=%d, want=1", len(args))
+	if err := CheckArgumentCount(1, 1, len(args)); err != nil {
+		return err
 	}
 
 	switch arg := args[0].(type) {
 	case *object.String:
+		// バイト数ではなく文字数
 		return &object.Integer{
-			Value: int64(len(arg.Value)),
+			Value: int64(utf8.RuneCountInString(arg.Value)),
 		}
 	case *object.Array:
 		return &object.Integer{
@@ -33,9 +51,18 @@ func builtinLen(args ...object.Object) object.Object {
 	}
 }
 
+// 値の型の名前 (INTEGER, STRING, ARRAY など)
+func builtinType(args ...object.Object) object.Object {
+	if err := CheckArgumentCount(1, 1, len(args)); err != nil {
+		return err
+	}
+
+	return &object.String{Value: string(args[0].Type())}
+}
+
 func builtinFirst(args ...object.Object) object.Object {
-	if len(args) != 1 {
-		return newError("wrong number of arguments. got=%d, want=1", len(args))
+	if err := CheckArgumentCount(1, 1, len(args)); err != nil {
+		return err
 	}
 
 	switch arg := args[0].(type) {
@@ -47,8 +74,8 @@ func builtinFirst(args ...object.Object) object.Object {
 }
 
 func builtinLast(args ...object.Object) object.Object {
-	if len(args) != 1 {
-		return newError("wrong number of arguments. got=%d, want=1", len(args))
+	if err := CheckArgumentCount(1, 1, len(args)); err != nil {
+		return err
 	}
 
 	switch arg := args[0].(type) {
@@ -60,8 +87,8 @@ func builtinLast(args ...object.Object) object.Object {
 }
 
 func builtinRest(args ...object.Object) object.Object {
-	if len(args) != 1 {
-		return newError("wrong number of arguments. got=%d, want=1", len(args))
+	if err := CheckArgumentCount(1, 1, len(args)); err != nil {
+		return err
 	}
 
 	switch arg := args[0].(type) {
@@ -81,8 +108,8 @@ func builtinRest(args ...object.Object) object.Object {
 }
 
 func builtinPush(args ...object.Object) object.Object {
-	if len(args) != 2 {
-		return newError("wrong number of arguments. got=%d, want=2", len(args))
+	if err := CheckArgumentCount(2, 2, len(args)); err != nil {
+		return err
 	}
 
 	switch arg := args[0].(type) {
@@ -99,9 +126,49 @@ func builtinPush(args ...object.Object) object.Object {
 	}
 }
 
-func builtinPuts(args ...object.Object) object.Object {
-	for _, arg := range args {
-		fmt.Println(arg.Inspect())
+// push と違い、配列そのものに要素を加えてその配列を返す。
+// 容量に余裕を持たせて伸ばすので、繰り返し加えても全体で線形の時間で済む
+func builtinAppend(args ...object.Object) object.Object {
+	if err := CheckArgumentCount(2, 2, len(args)); err != nil {
+		return err
+	}
+
+	switch arg := args[0].(type) {
+	case *object.Array:
+		arg.Elements = append(arg.Elements, args[1])
+		return arg
+	default:
+		return newError("argument to `append` not supported, got %s", args[0].Type())
+	}
+}
+
+func newBuiltinPuts(out io.Writer) object.BuiltinFunction {
+	return func(args ...object.Object) object.Object {
+		for _, arg := range args {
+			fmt.Fprintln(out, arg.Inspect())
+		}
+		return NULL
+	}
+}
+
+// 1行読んで改行を除いた文字列を返す。入力が終わっていればnull
+func newBuiltinGets(in io.Reader) object.BuiltinFunction {
+	var reader *bufio.Reader
+
+	return func(args ...object.Object) object.Object {
+		if err := CheckArgumentCount(0, 0, len(args)); err != nil {
+			return err
+		}
+
+		// 使われるまで読み込みを始めない
+		if reader == nil {
+			reader = bufio.NewReader(in)
+		}
+
+		line, err := reader.ReadString('\n')
+		if line == "" && err != nil {
+			return NULL
+		}
+		return &object.String{Value: strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")}
 	}
-	return NULL
 }
@@ -0,0 +1,135 @@
+package evaluator_test
+
+import (
+	"errors"
+	"monkey/ast"
+	"monkey/compiler"
+	"monkey/object"
+	"monkey/vm"
+	"testing"
+)
+
+// 評価器のテストケースをVMでも実行し、同じ結果になることを確かめる
+func testConformance(t *testing.T, input string, program *ast.Program, evaluated object.Object) {
+	t.Helper()
+
+	comp := compiler.New()
+	if err := comp.CompilePrelude(); err != nil {
+		t.Fatalf("vm: compile error for prelude: %s", err)
+	}
+	if err := comp.Compile(program); err != nil {
+		if vmUnsupported(err) {
+			return
+		}
+		t.Errorf("vm: compile error for %q: %s", input, err)
+		return
+	}
+
+	machine := vm.New(comp.Bytecode())
+	var result object.Object
+	if err := machine.Run(); err != nil {
+		rtErr, ok := err.(*object.Error)
+		if !ok {
+			t.Errorf("vm: internal error for %q: %s", input, err)
+			return
+		}
+		result = rtErr
+	} else {
+		result = machine.LastPoppedStackElem()
+	}
+
+	// 最後の文がletなど値の無い場合は比較しない
+	if evaluated == nil {
+		return
+	}
+
+	if !sameResult(evaluated, result) {
+		t.Errorf("vm result differs for %q.\nevaluator=%s\nvm=%s", input, describe(evaluated), describe(result))
+	}
+}
+
+// VMが対応していないと決めてある構文。これを使うプログラムは比較しない。
+// それ以外の構文がコンパイルできなければテストを失敗させる
+func vmUnsupported(err error) bool {
+	var unsupported *compiler.UnsupportedError
+	if !errors.As(err, &unsupported) {
+		return false
+	}
+
+	switch unsupported.Node.(type) {
+	case *ast.ImportExpression:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestVMUnsupported(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected bool
+	}{
+		{&compiler.UnsupportedError{Node: &ast.ImportExpression{}, Err: compiler.ErrImportNotSupported}, true},
+		// 新しくVMで扱えない構文が増えたら、ここに加えるまでテストを失敗させる
+		{&compiler.UnsupportedError{Node: &ast.WhileStatement{}}, false},
+		{errors.New("unsupported node: *ast.ImportExpression"), false},
+	}
+
+	for i, tt := range tests {
+		if got := vmUnsupported(tt.err); got != tt.expected {
+			t.Errorf("case %d: vmUnsupported returned %t, want %t", i, got, tt.expected)
+		}
+	}
+}
+
+func describe(obj object.Object) string {
+	if obj == nil {
+		return "nil"
+	}
+	if err, ok := obj.(*object.Error); ok {
+		return err.StackTrace()
+	}
+	return string(obj.Type()) + " " + obj.Inspect()
+}
+
+func sameResult(expected, actual object.Object) bool {
+	if expected == nil || actual == nil {
+		return expected == actual
+	}
+	if expected.Type() != actual.Type() {
+		return false
+	}
+
+	switch expected := expected.(type) {
+	case *object.Error:
+		return expected.StackTrace() == actual.(*object.Error).StackTrace()
+	case *object.Function:
+		// 評価器の関数とVMのクロージャは中身を比べられない
+		return true
+	case *object.Array:
+		actual := actual.(*object.Array)
+		if len(expected.Elements) != len(actual.Elements) {
+			return false
+		}
+		for i := range expected.Elements {
+			if !sameResult(expected.Elements[i], actual.Elements[i]) {
+				return false
+			}
+		}
+		return true
+	case *object.Hash:
+		actual := actual.(*object.Hash)
+		if len(expected.Pairs) != len(actual.Pairs) {
+			return false
+		}
+		for key, pair := range expected.Pairs {
+			other, ok := actual.Pairs[key]
+			if !ok || !sameResult(pair.Value, other.Value) {
+				return false
+			}
+		}
+		return true
+	default:
+		return expected.Inspect() == actual.Inspect()
+	}
+}
@@ -1,87 +1,240 @@
 package evaluator
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"math"
 	"monkey/ast"
 	"monkey/object"
+	"monkey/token"
+	"strings"
+	"unicode/utf8"
 )
 
 var (
-	NULL  = &object.Null{}
-	TRUE  = &object.Boolean{Value: true}
-	FALSE = &object.Boolean{Value: false}
+	NULL     = &object.Null{}
+	TRUE     = &object.Boolean{Value: true}
+	FALSE    = &object.Boolean{Value: false}
+	BREAK    = &object.Break{}
+	CONTINUE = &object.Continue{}
 )
 
+// 評価を打ち切ったときのエラーの原因。errors.Is で判別できる
+var (
+	ErrTimeout        = errors.New("timeout")
+	ErrCancelled      = errors.New("cancelled")
+	ErrBudgetExceeded = errors.New("budget exceeded")
+)
+
+// 関数呼び出しの深さの既定の上限。これより深い再帰はGoのスタックを使い切る恐れがある
+const DefaultMaxDepth = 10000
+
+// 組み込み関数が返した文字列は、このバイト数ごとに1ステップと数える
+const StringStepBytes = 1024
+
+// 評価に課す制限。MaxSteps のゼロ値は無制限、MaxDepth のゼロ値は DefaultMaxDepth
+type Limits struct {
+	// ループの1回と関数呼び出し1回(組み込み関数も含む)をそれぞれ1ステップと数える。
+	// 組み込み関数が返した文字列は、さらに StringStepBytes バイトごとに1ステップと数える
+	MaxSteps int64
+	MaxDepth int // 関数呼び出しの深さ
+}
+
 func Eval(node ast.Node, env *object.Environment) object.Object {
+	return EvalContext(context.Background(), node, env, Limits{})
+}
+
+// ctx が終了するかステップ数が上限を超えると評価を打ち切り、
+// ErrTimeout / ErrCancelled / ErrBudgetExceeded を原因とするエラーを返す。
+// 確認はループと関数呼び出しのたびに行う。組み込み関数(RegisterBuiltin で登録したものを含む)の
+// 実行中は確認できないので、1回の呼び出しが長くかかる場合は戻るまで打ち切れない
+func EvalContext(ctx context.Context, node ast.Node, env *object.Environment, limits Limits, opts ...Option) object.Object {
+	ev := newEvaluation(ctx, limits, opts)
+	ev.globals = env
+	return ev.Eval(node, env)
+}
+
+// 1回の評価の状態
+type evaluation struct {
+	ctx    context.Context
+	limits Limits
+	steps  int64
+	calls  []object.StackFrame // 呼び出し中の関数。外側から順に並ぶ
+
+	// 評価しているプログラムのトップレベルの環境。組み込み関数の環境がわからない時に topLevel の目印にする
+	globals *object.Environment
+
+	modules   *Modules
+	noPrelude bool
+}
+
+func newEvaluation(ctx context.Context, limits Limits, opts []Option) *evaluation {
+	if limits.MaxDepth <= 0 {
+		limits.MaxDepth = DefaultMaxDepth
+	}
+	ev := &evaluation{ctx: ctx, limits: limits}
+	for _, opt := range opts {
+		opt(ev)
+	}
+	return ev
+}
+
+// env を含むトップレベル(プログラムかモジュール)の環境。組み込み関数の環境のすぐ内側まで外側にたどる
+func (ev *evaluation) topLevel(env *object.Environment) *object.Environment {
+	var builtins *object.Environment
+	if ev.modules != nil {
+		builtins = ev.modules.builtins
+	}
+	for env != ev.globals && env.Outer() != nil && env.Outer() != builtins {
+		env = env.Outer()
+	}
+	return env
+}
+
+// 1ステップ進める。打ち切る場合はエラーを返す
+func (ev *evaluation) step() *object.Error {
+	return ev.advance(1)
+}
+
+// n ステップ進める
+func (ev *evaluation) advance(n int64) *object.Error {
+	ev.steps += n
+	if ev.limits.MaxSteps > 0 && ev.steps > ev.limits.MaxSteps {
+		return interrupted(ErrBudgetExceeded)
+	}
+	return CheckContext(ev.ctx)
+}
+
+// ctx が終了していれば、評価を打ち切った時と同じ ErrTimeout / ErrCancelled を原因とするエラーを返す
+func CheckContext(ctx context.Context) *object.Error {
+	select {
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return interrupted(ErrTimeout)
+		}
+		return interrupted(ErrCancelled)
+	default:
+		return nil
+	}
+}
+
+func interrupted(cause error) *object.Error {
+	return &object.Error{Message: cause.Error(), Cause: cause}
+}
+
+func (ev *evaluation) Eval(node ast.Node, env *object.Environment) object.Object {
+	result := ev.eval(node, env)
+
+	// 最も内側で発生したノードの位置をエラーに記録する
+	if err, ok := result.(*object.Error); ok && !err.Pos.IsValid() {
+		err.Pos = node.Pos()
+	}
+
+	return result
+}
+
+func (ev *evaluation) eval(node ast.Node, env *object.Environment) object.Object {
 	switch node := node.(type) {
 	case *ast.Program:
-		return evalProgram(node.Statements, env)
+		return ev.evalProgram(node.Statements, env)
 	case *ast.ExpressionStatement:
-		return Eval(node.Expression, env)
+		return ev.Eval(node.Expression, env)
 	case *ast.IntegerLiteral:
 		return &object.Integer{
 			Value: node.Value,
 		}
+	case *ast.FloatLiteral:
+		return &object.Float{
+			Value: node.Value,
+		}
 	case *ast.Boolean:
 		return nativeBoolToBooleanObject(node.Value)
 	case *ast.PrefixExpression:
-		right := Eval(node.Right, env)
+		right := ev.Eval(node.Right, env)
 		if isError(right) {
 			return right
 		}
 		return evalPrefixExpression(node.Operator, right)
 	case *ast.InfixExpression:
-		left := Eval(node.Left, env)
+		if node.Operator == "&&" || node.Operator == "||" {
+			return ev.evalLogicalExpression(node, env)
+		}
+		left := ev.Eval(node.Left, env)
 		if isError(left) {
 			return left
 		}
-		right := Eval(node.Right, env)
+		right := ev.Eval(node.Right, env)
 		if isError(right) {
 			return right
 		}
 		return evalInfixExpression(node.Operator, left, right)
 	case *ast.BlockStatement:
-		return evalBlockStatement(node, env)
+		return ev.evalBlockStatement(node, env)
 	case *ast.IfExpression:
-		return evalIfExpression(node, env)
+		return ev.evalIfExpression(node, env)
 	case *ast.ReturnStatement:
-		val := Eval(node.ReturnValue, env)
+		val := ev.Eval(node.ReturnValue, env)
 		if isError(val) {
 			return val
 		}
 		return &object.ReturnValue{Value: val}
+	case *ast.ThrowStatement:
+		val := ev.Eval(node.Value, env)
+		if isError(val) {
+			return val
+		}
+		return newThrownError(val)
+	case *ast.TryExpression:
+		return ev.evalTryExpression(node, env)
+	case *ast.ImportExpression:
+		return ev.evalImportExpression(node)
 	case *ast.LetStatement:
-		val := Eval(node.Value, env)
+		val := ev.Eval(node.Value, env)
 		if isError(val) {
 			return val
 		}
 		env.Set(node.Name.Value, val)
+	case *ast.AssignExpression:
+		return ev.evalAssignExpression(node, env)
 	case *ast.WhileStatement:
-		return evalWhileStatement(node, env)
+		return ev.evalWhileStatement(node, env)
+	case *ast.ForStatement:
+		return ev.evalForStatement(node, env)
+	case *ast.BreakStatement:
+		return BREAK
+	case *ast.ContinueStatement:
+		return CONTINUE
 	case *ast.Identifier:
-		return evalIdentifier(node, env)
+		return ev.evalIdentifier(node, env)
 	case *ast.FunctionLiteral:
 		return &object.Function{
+			Name:       node.Name,
 			Parameters: node.Parameters,
+			Defaults:   node.Defaults,
+			Rest:       node.Rest,
 			Body:       node.Body,
 			Env:        env,
 		}
 	case *ast.CallExpression:
-		f := Eval(node.Function, env)
+		f := ev.Eval(node.Function, env)
 		if isError(f) {
 			return f
 		}
-		args := evalExpressions(node.Arguments, env)
+		args := ev.evalExpressions(node.Arguments, env)
 		if len(args) == 1 && isError(args[0]) {
 			return args[0]
 		}
-		return applyFunction(f, args)
+		if node.Tail {
+			return &object.TailCall{Fn: f, Args: args, CallSite: node.Pos()}
+		}
+		return ev.applyFunction(node.Pos(), f, args)
 	case *ast.StringLiteral:
 		return &object.String{
 			Value: node.Value,
 		}
 	case *ast.ArrayLiteral:
-		elements := evalExpressions(node.Elements, env)
+		elements := ev.evalExpressions(node.Elements, env)
 		if len(elements) == 1 && isError(elements[0]) {
 			return elements[0]
 		}
@@ -90,26 +243,28 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 			Elements: elements,
 		}
 	case *ast.HashLiteral:
-		return evalHashLiteral(node, env)
+		return ev.evalHashLiteral(node, env)
 	case *ast.IndexExpression:
-		left := Eval(node.Left, env)
+		left := ev.Eval(node.Left, env)
 		if isError(left) {
 			return left
 		}
-		index := Eval(node.Index, env)
+		index := ev.Eval(node.Index, env)
 		if isError(index) {
 			return index
 		}
 		return evalIndexExpression(left, index)
+	case *ast.SliceExpression:
+		return ev.evalSliceExpression(node, env)
 	}
 	return nil
 }
 
-func evalProgram(stmts []ast.Statement, env *object.Environment) object.Object {
+func (ev *evaluation) evalProgram(stmts []ast.Statement, env *object.Environment) object.Object {
 	var result object.Object
 
 	for _, stmt := range stmts {
-		result = Eval(stmt, env)
+		result = ev.Eval(stmt, env)
 
 		switch result := result.(type) {
 		case *object.ReturnValue:
@@ -122,15 +277,15 @@ func evalProgram(stmts []ast.Statement, env *object.Environment) object.Object {
 	return result
 }
 
-func evalBlockStatement(block *ast.BlockStatement, env *object.Environment) object.Object {
+func (ev *evaluation) evalBlockStatement(block *ast.BlockStatement, env *object.Environment) object.Object {
 	var result object.Object
 
 	for _, stmt := range block.Statements {
-		result = Eval(stmt, env)
+		result = ev.Eval(stmt, env)
 
 		if result != nil {
 			rt := result.Type()
-			if rt == object.RETURN_VALUE_OBJ || rt == object.ERROR_OBJ {
+			if rt == object.RETURN_VALUE_OBJ || rt == object.ERROR_OBJ || rt == object.BREAK_OBJ || rt == object.CONTINUE_OBJ {
 				return result
 			}
 		}
@@ -172,17 +327,21 @@ func evalBangOperatorExpression(right object.Object) object.Object {
 }
 
 func evalMinusPrefixOperatorExpression(right object.Object) object.Object {
-	if right.Type() != object.INTEGER_OBJ {
+	switch right := right.(type) {
+	case *object.Integer:
+		return &object.Integer{Value: -right.Value}
+	case *object.Float:
+		return &object.Float{Value: -right.Value}
+	default:
 		return newError("unknown operator: -%s", right.Type())
 	}
-
-	return &object.Integer{
-		Value: -right.(*object.Integer).Value,
-	}
 }
 
 func evalInfixExpression(operator string, left, right object.Object) object.Object {
 	switch {
+	case isNumber(left) && isNumber(right) && (left.Type() == object.FLOAT_OBJ || right.Type() == object.FLOAT_OBJ):
+		// 片方でもFloatなら両方Floatに昇格して計算する
+		return evalFloatInfixExpression(operator, left, right)
 	case left.Type() != right.Type():
 		return newError("type mismatch: %s %s %s", left.Type(), operator, right.Type())
 	case left.Type() == object.INTEGER_OBJ && right.Type() == object.INTEGER_OBJ:
@@ -190,14 +349,87 @@ func evalInfixExpression(operator string, left, right object.Object) object.Obje
 	case left.Type() == object.STRING_OBJ && right.Type() == object.STRING_OBJ:
 		return evalStringInfixExpression(operator, left, right)
 	case operator == "==":
-		return nativeBoolToBooleanObject(left == right)
+		return nativeBoolToBooleanObject(objectsEqual(left, right))
 	case operator == "!=":
-		return nativeBoolToBooleanObject(left != right)
+		return nativeBoolToBooleanObject(!objectsEqual(left, right))
 	default:
 		return newError("unknown operator: %s %s %s", left.Type(), operator, right.Type())
 	}
 }
 
+// 値による比較。配列とハッシュは要素ごとに比較する
+func objectsEqual(left, right object.Object) bool {
+	return valuesEqual(left, right, nil)
+}
+
+// 比べている(または等しいとわかった)配列とハッシュの組
+type comparedPairs map[[2]object.Object]bool
+
+// 循環した値では、比べている途中の組にもう一度出会ったらその組は等しいとみなす
+func valuesEqual(left, right object.Object, compared comparedPairs) bool {
+	if isNumber(left) && isNumber(right) {
+		if left.Type() == object.INTEGER_OBJ && right.Type() == object.INTEGER_OBJ {
+			return left.(*object.Integer).Value == right.(*object.Integer).Value
+		}
+		return toFloat(left) == toFloat(right)
+	}
+
+	if left.Type() != right.Type() {
+		return false
+	}
+
+	switch left := left.(type) {
+	case *object.String:
+		return left.Value == right.(*object.String).Value
+	case *object.Array:
+		r := right.(*object.Array)
+		if len(left.Elements) != len(r.Elements) {
+			return false
+		}
+		var seen bool
+		if compared, seen = compare(compared, left, r); seen {
+			return true
+		}
+		for i, e := range left.Elements {
+			if !valuesEqual(e, r.Elements[i], compared) {
+				return false
+			}
+		}
+		return true
+	case *object.Hash:
+		r := right.(*object.Hash)
+		if len(left.Pairs) != len(r.Pairs) {
+			return false
+		}
+		var seen bool
+		if compared, seen = compare(compared, left, r); seen {
+			return true
+		}
+		for key, pair := range left.Pairs {
+			other, ok := r.Pairs[key]
+			if !ok || !valuesEqual(pair.Value, other.Value, compared) {
+				return false
+			}
+		}
+		return true
+	default:
+		return left == right
+	}
+}
+
+// 組を記録する。すでに記録してあれば true を返す
+func compare(compared comparedPairs, left, right object.Object) (comparedPairs, bool) {
+	pair := [2]object.Object{left, right}
+	if compared[pair] {
+		return compared, true
+	}
+	if compared == nil {
+		compared = comparedPairs{}
+	}
+	compared[pair] = true
+	return compared, false
+}
+
 func evalIntegerInfixExpression(operator string, left, right object.Object) object.Object {
 	l := left.(*object.Integer).Value
 	r := right.(*object.Integer).Value
@@ -209,44 +441,143 @@ func evalIntegerInfixExpression(operator string, left, right object.Object) obje
 	case "*":
 		return &object.Integer{Value: l * r}
 	case "%":
+		if r == 0 {
+			return newError("division by zero: %d %% %d", l, r)
+		}
 		return &object.Integer{Value: l % r}
 	case "/":
+		if r == 0 {
+			return newError("division by zero: %d / %d", l, r)
+		}
 		return &object.Integer{Value: l / r}
 	case "<":
 		return nativeBoolToBooleanObject(l < r)
 	case ">":
 		return nativeBoolToBooleanObject(l > r)
+	case "<=":
+		return nativeBoolToBooleanObject(l <= r)
+	case ">=":
+		return nativeBoolToBooleanObject(l >= r)
 	case "==":
 		return nativeBoolToBooleanObject(l == r)
 	case "!=":
 		return nativeBoolToBooleanObject(l != r)
+	case "..":
+		return &object.Range{Start: l, End: r}
 	default:
 		return newError("unknown operator: %s %s %s", left.Type(), operator, right.Type())
 	}
 }
 
+// 0除算はIEEE 754に従い Inf / NaN になる
+func evalFloatInfixExpression(operator string, left, right object.Object) object.Object {
+	l := toFloat(left)
+	r := toFloat(right)
+	switch operator {
+	case "+":
+		return &object.Float{Value: l + r}
+	case "-":
+		return &object.Float{Value: l - r}
+	case "*":
+		return &object.Float{Value: l * r}
+	case "%":
+		return &object.Float{Value: math.Mod(l, r)}
+	case "/":
+		return &object.Float{Value: l / r}
+	case "<":
+		return nativeBoolToBooleanObject(l < r)
+	case ">":
+		return nativeBoolToBooleanObject(l > r)
+	case "<=":
+		return nativeBoolToBooleanObject(l <= r)
+	case ">=":
+		return nativeBoolToBooleanObject(l >= r)
+	case "==":
+		return nativeBoolToBooleanObject(l == r)
+	case "!=":
+		return nativeBoolToBooleanObject(l != r)
+	default:
+		return newError("unknown operator: %s %s %s", left.Type(), operator, right.Type())
+	}
+}
+
+func isNumber(obj object.Object) bool {
+	return obj.Type() == object.INTEGER_OBJ || obj.Type() == object.FLOAT_OBJ
+}
+
+func toFloat(obj object.Object) float64 {
+	switch obj := obj.(type) {
+	case *object.Integer:
+		return float64(obj.Value)
+	case *object.Float:
+		return obj.Value
+	default:
+		return 0
+	}
+}
+
 func evalStringInfixExpression(operator string, left, right object.Object) object.Object {
 	l := left.(*object.String).Value
 	r := right.(*object.String).Value
 	switch operator {
 	case "+":
 		return &object.String{Value: l + r}
+	case "==":
+		return nativeBoolToBooleanObject(l == r)
+	case "!=":
+		return nativeBoolToBooleanObject(l != r)
+	case "<":
+		return nativeBoolToBooleanObject(l < r)
+	case ">":
+		return nativeBoolToBooleanObject(l > r)
+	case "<=":
+		return nativeBoolToBooleanObject(l <= r)
+	case ">=":
+		return nativeBoolToBooleanObject(l >= r)
 	default:
 		return newError("unknown operator: %s %s %s", left.Type(), operator, right.Type())
 	}
 }
-func evalIfExpression(node *ast.IfExpression, env *object.Environment) object.Object {
-	condition := Eval(node.Condition, env)
+
+// && と || は短絡評価し、結果を決めた方の値をそのまま返す
+func (ev *evaluation) evalLogicalExpression(node *ast.InfixExpression, env *object.Environment) object.Object {
+	left := ev.Eval(node.Left, env)
+	if isError(left) {
+		return left
+	}
+
+	if node.Operator == "&&" && !isTruthy(left) {
+		return left
+	}
+	if node.Operator == "||" && isTruthy(left) {
+		return left
+	}
+
+	return ev.Eval(node.Right, env)
+}
+
+func (ev *evaluation) evalIfExpression(node *ast.IfExpression, env *object.Environment) object.Object {
+	condition := ev.Eval(node.Condition, env)
 	if isError(condition) {
 		return condition
 	}
 
 	if isTruthy(condition) {
-		return Eval(node.Consequence, env)
-	} else {
-		if node.Alternative != nil {
-			return Eval(node.Alternative, env)
+		return ev.Eval(node.Consequence, env)
+	}
+
+	for _, branch := range node.ElseIfs {
+		condition := ev.Eval(branch.Condition, env)
+		if isError(condition) {
+			return condition
 		}
+		if isTruthy(condition) {
+			return ev.Eval(branch.Consequence, env)
+		}
+	}
+
+	if node.Alternative != nil {
+		return ev.Eval(node.Alternative, env)
 	}
 	return NULL
 }
@@ -275,7 +606,8 @@ func isError(obj object.Object) bool {
 	return false
 }
 
-func evalIdentifier(node *ast.Identifier, env *object.Environment) object.Object {
+// 環境、組み込み関数、標準ライブラリの順に探す
+func (ev *evaluation) evalIdentifier(node *ast.Identifier, env *object.Environment) object.Object {
 	if val, ok := env.Get(node.Value); ok {
 		return val
 	}
@@ -284,14 +616,18 @@ func evalIdentifier(node *ast.Identifier, env *object.Environment) object.Object
 		return builtin
 	}
 
+	if val, ok := ev.lookupPrelude(node.Value); ok {
+		return val
+	}
+
 	return newError("identifier not found: " + node.Value)
 }
 
-func evalExpressions(exps []ast.Expression, env *object.Environment) []object.Object {
+func (ev *evaluation) evalExpressions(exps []ast.Expression, env *object.Environment) []object.Object {
 	var result []object.Object
 
 	for _, e := range exps {
-		evaluated := Eval(e, env)
+		evaluated := ev.Eval(e, env)
 		if isError(evaluated) {
 			return []object.Object{evaluated}
 		}
@@ -301,27 +637,126 @@ func evalExpressions(exps []ast.Expression, env *object.Environment) []object.Ob
 	return result
 }
 
-func applyFunction(fn object.Object, args []object.Object) object.Object {
+func (ev *evaluation) applyFunction(callSite token.Position, fn object.Object, args []object.Object) object.Object {
 	switch function := fn.(type) {
 	case *object.Function:
-		extendedEnv := extendFunctionEnv(function, args)
-		evaluated := Eval(function.Body, extendedEnv)
-		return unwrapReturnValue(evaluated)
+		if err := checkArguments(function, len(args)); err != nil {
+			return err
+		}
+		if err := ev.step(); err != nil {
+			return err
+		}
+		// エラーの位置は呼び出し式になる
+		if len(ev.calls) >= ev.limits.MaxDepth {
+			return newError("maximum recursion depth exceeded")
+		}
+
+		ev.calls = append(ev.calls, object.StackFrame{Function: function.DisplayName(), CallSite: callSite})
+		evaluated, last := ev.callFunction(function, args)
+		ev.calls = ev.calls[:len(ev.calls)-1]
+		if err, ok := evaluated.(*object.Error); ok {
+			err.PushFrame(last.DisplayName(), callSite)
+		}
+		return evaluated
 	case *object.Builtin:
-		return function.Fn(args...)
+		if err := ev.step(); err != nil {
+			return err
+		}
+		result := function.Fn(args...)
+		// 大きな文字列を作る処理は、その大きさに応じて数える
+		if str, ok := result.(*object.String); ok {
+			if err := ev.advance(int64(len(str.Value) / StringStepBytes)); err != nil {
+				return err
+			}
+		}
+		return result
 	default:
 		return newError("not a function: %s", fn.Type())
 	}
 }
 
-func extendFunctionEnv(fn *object.Function, args []object.Object) *object.Environment {
+// 関数本体を評価する。末尾呼び出しはGoのスタックを伸ばさずにこのループで続けて実行し、
+// 呼び出し元のフレームは残さない。戻り値と共に最後に実行していた関数を返す
+func (ev *evaluation) callFunction(fn *object.Function, args []object.Object) (object.Object, *object.Function) {
+	for {
+		env, err := ev.extendFunctionEnv(fn, args)
+		if err != nil {
+			return err, fn
+		}
+		evaluated := unwrapReturnValue(ev.Eval(fn.Body, env))
+
+		tail, ok := evaluated.(*object.TailCall)
+		if !ok {
+			return evaluated, fn
+		}
+
+		next, ok := tail.Fn.(*object.Function)
+		if ok {
+			if err := checkArguments(next, len(tail.Args)); err != nil {
+				err.Pos = tail.CallSite
+				return err, fn
+			}
+			if err := ev.step(); err != nil {
+				err.Pos = tail.CallSite
+				return err, fn
+			}
+			fn, args = next, tail.Args
+			ev.calls[len(ev.calls)-1].Function = fn.DisplayName()
+			continue
+		}
+
+		// 組み込み関数はそのまま呼び出す
+		result := ev.applyFunction(tail.CallSite, tail.Fn, tail.Args)
+		if err, ok := result.(*object.Error); ok && !err.Pos.IsValid() {
+			err.Pos = tail.CallSite
+		}
+		return result, fn
+	}
+}
+
+func checkArguments(fn *object.Function, got int) *object.Error {
+	required := len(fn.Parameters)
+	for i, d := range fn.Defaults {
+		if d != nil {
+			required = i
+			break
+		}
+	}
+
+	max := len(fn.Parameters)
+	if fn.Rest != nil {
+		max = -1
+	}
+	return CheckArgumentCount(required, max, got)
+}
+
+// 引数を束縛した環境を作る。省略された引数の既定値はこの環境で順に評価するので、
+// 前の引数を参照できる。残りの引数は配列にまとめる
+func (ev *evaluation) extendFunctionEnv(fn *object.Function, args []object.Object) (*object.Environment, *object.Error) {
 	env := object.NewEnclosedEnvironment(fn.Env)
 
 	for i, p := range fn.Parameters {
-		env.Set(p.Value, args[i])
+		if i < len(args) {
+			env.Set(p.Value, args[i])
+			continue
+		}
+
+		value := ev.Eval(fn.Defaults[i], env)
+		if err, ok := value.(*object.Error); ok {
+			return nil, err
+		}
+		env.Set(p.Value, value)
 	}
 
-	return env
+	if fn.Rest != nil {
+		rest := []object.Object{}
+		if len(args) > len(fn.Parameters) {
+			rest = append(rest, args[len(fn.Parameters):]...)
+		}
+		env.Set(fn.Rest.Value, &object.Array{Elements: rest})
+	}
+
+	return env, nil
 }
 
 func unwrapReturnValue(obj object.Object) object.Object {
@@ -335,25 +770,117 @@ func evalIndexExpression(left, index object.Object) object.Object {
 	switch {
 	case left.Type() == object.ARRAY_OBJ && index.Type() == object.INTEGER_OBJ:
 		return evalArrayIndexExpression(left, index)
+	case left.Type() == object.STRING_OBJ && index.Type() == object.INTEGER_OBJ:
+		return evalStringIndexExpression(left, index)
 	case left.Type() == object.HASH_OBJ:
 		return evalHashIndexExpression(left, index)
+	case left.Type() == object.MODULE_OBJ:
+		return evalModuleIndexExpression(left, index)
 	default:
 		return newError("index operator not supported: %s", left.Type())
 	}
 }
 
+// 負の添字は末尾から数える。範囲内かどうかも返す
+func normalizeIndex(idx int64, length int) (int64, bool) {
+	if idx < 0 {
+		idx += int64(length)
+	}
+	return idx, idx >= 0 && idx < int64(length)
+}
+
 func evalArrayIndexExpression(array, index object.Object) object.Object {
 	arrayObject := array.(*object.Array)
-	idx := index.(*object.Integer).Value
-	max := int64(len(arrayObject.Elements) - 1)
-
-	if idx < 0 || idx > max {
+	idx, ok := normalizeIndex(index.(*object.Integer).Value, len(arrayObject.Elements))
+	if !ok {
 		return NULL
 	}
 
 	return arrayObject.Elements[idx]
 }
 
+// 添字は文字単位で数え、1文字の文字列を返す
+func evalStringIndexExpression(str, index object.Object) object.Object {
+	runes := []rune(str.(*object.String).Value)
+	idx, ok := normalizeIndex(index.(*object.Integer).Value, len(runes))
+	if !ok {
+		return NULL
+	}
+
+	return &object.String{Value: string(runes[idx])}
+}
+
+func (ev *evaluation) evalSliceExpression(node *ast.SliceExpression, env *object.Environment) object.Object {
+	left := ev.Eval(node.Left, env)
+	if isError(left) {
+		return left
+	}
+
+	bounds := []object.Object{NULL, NULL}
+	for i, e := range []ast.Expression{node.Low, node.High} {
+		if e == nil {
+			continue
+		}
+		bounds[i] = ev.Eval(e, env)
+		if isError(bounds[i]) {
+			return bounds[i]
+		}
+	}
+
+	return evalSliceExpression(left, bounds[0], bounds[1])
+}
+
+// Pythonと同じく、省略した端(null)は先頭と末尾、負の値は末尾から数えた位置になる。
+// 範囲からはみ出した部分は切り詰め、low が high 以降なら空になる
+func evalSliceExpression(left, low, high object.Object) object.Object {
+	var length int
+	switch left := left.(type) {
+	case *object.Array:
+		length = len(left.Elements)
+	case *object.String:
+		length = utf8.RuneCountInString(left.Value)
+	default:
+		return newError("slice operator not supported: %s", left.Type())
+	}
+
+	start, err := sliceBound(low, 0, length)
+	if err != nil {
+		return err
+	}
+	end, err := sliceBound(high, int64(length), length)
+	if err != nil {
+		return err
+	}
+	if end < start {
+		end = start
+	}
+
+	switch left := left.(type) {
+	case *object.Array:
+		elements := make([]object.Object, end-start)
+		copy(elements, left.Elements[start:end])
+		return &object.Array{Elements: elements}
+	default:
+		return &object.String{Value: string([]rune(left.(*object.String).Value)[start:end])}
+	}
+}
+
+func sliceBound(bound object.Object, omitted int64, length int) (int64, *object.Error) {
+	if bound == NULL {
+		return omitted, nil
+	}
+	integer, ok := bound.(*object.Integer)
+	if !ok {
+		return 0, newError("slice index must be INTEGER, got %s", bound.Type())
+	}
+
+	idx := integer.Value
+	if idx < 0 {
+		idx += int64(length)
+	}
+	return clamp(idx, 0, int64(length)), nil
+}
+
 func evalHashIndexExpression(array, index object.Object) object.Object {
 	hashObject := array.(*object.Hash)
 	key, ok := index.(object.Hashable)
@@ -369,11 +896,11 @@ func evalHashIndexExpression(array, index object.Object) object.Object {
 	return pair.Value
 }
 
-func evalHashLiteral(node *ast.HashLiteral, env *object.Environment) object.Object {
+func (ev *evaluation) evalHashLiteral(node *ast.HashLiteral, env *object.Environment) object.Object {
 	pairs := map[object.HashKey]object.HashPair{}
 
 	for keyNode, valueNode := range node.Pairs {
-		key := Eval(keyNode, env)
+		key := ev.Eval(keyNode, env)
 		if isError(key) {
 			return key
 		}
@@ -382,7 +909,7 @@ func evalHashLiteral(node *ast.HashLiteral, env *object.Environment) object.Obje
 			return newError("unusable as hash key: %s", key.Type())
 		}
 
-		value := Eval(valueNode, env)
+		value := ev.Eval(valueNode, env)
 		if isError(value) {
 			return value
 		}
@@ -397,19 +924,114 @@ func evalHashLiteral(node *ast.HashLiteral, env *object.Environment) object.Obje
 	return &object.Hash{Pairs: pairs}
 }
 
-func evalWhileStatement(node *ast.WhileStatement, env *object.Environment) object.Object {
-	condition := Eval(node.Condition, env)
+func (ev *evaluation) evalAssignExpression(node *ast.AssignExpression, env *object.Environment) object.Object {
+	switch target := node.Target.(type) {
+	case *ast.Identifier:
+		current, ok := env.Get(target.Value)
+		if !ok {
+			current, ok = ev.lookupPrelude(target.Value)
+		}
+		if !ok {
+			return newError("identifier not found: " + target.Value)
+		}
+
+		value := ev.Eval(node.Value, env)
+		if isError(value) {
+			return value
+		}
+
+		value = applyAssignOperator(node.Operator, current, value)
+		if isError(value) {
+			return value
+		}
+
+		if _, ok := env.Assign(target.Value, value); !ok {
+			// 標準ライブラリの名前は、代入した場所のファイルのグローバル変数と同じに扱う
+			ev.topLevel(env).Set(target.Value, value)
+		}
+		return value
+	case *ast.IndexExpression:
+		left := ev.Eval(target.Left, env)
+		if isError(left) {
+			return left
+		}
+		index := ev.Eval(target.Index, env)
+		if isError(index) {
+			return index
+		}
+		value := ev.Eval(node.Value, env)
+		if isError(value) {
+			return value
+		}
+
+		if node.Operator != "=" {
+			current := evalIndexExpression(left, index)
+			if isError(current) {
+				return current
+			}
+			value = applyAssignOperator(node.Operator, current, value)
+			if isError(value) {
+				return value
+			}
+		}
+
+		return evalIndexAssignment(left, index, value)
+	default:
+		return newError("invalid assignment target: %s", node.Target.String())
+	}
+}
+
+// += なら current + value を返す。= ならvalueをそのまま返す
+func applyAssignOperator(operator string, current, value object.Object) object.Object {
+	if operator == "=" {
+		return value
+	}
+	return evalInfixExpression(strings.TrimSuffix(operator, "="), current, value)
+}
+
+func evalIndexAssignment(left, index, value object.Object) object.Object {
+	switch {
+	case left.Type() == object.ARRAY_OBJ && index.Type() == object.INTEGER_OBJ:
+		arrayObject := left.(*object.Array)
+		idx, ok := normalizeIndex(index.(*object.Integer).Value, len(arrayObject.Elements))
+		if !ok {
+			return newError("index out of range: %d", index.(*object.Integer).Value)
+		}
+		arrayObject.Elements[idx] = value
+		return value
+	case left.Type() == object.HASH_OBJ:
+		hashObject := left.(*object.Hash)
+		key, ok := index.(object.Hashable)
+		if !ok {
+			return newError("unusable as hash key: %s", index.Type())
+		}
+		hashObject.Pairs[key.HashKey()] = object.HashPair{Key: index, Value: value}
+		return value
+	default:
+		return newError("index assignment not supported: %s", left.Type())
+	}
+}
+
+func (ev *evaluation) evalWhileStatement(node *ast.WhileStatement, env *object.Environment) object.Object {
+	condition := ev.Eval(node.Condition, env)
 	if isError(condition) {
 		return condition
 	}
 
 	for isTruthy(condition) {
-		result := Eval(node.Body, env)
-		if isError(result) {
+		if err := ev.step(); err != nil {
+			return err
+		}
+
+		result := ev.Eval(node.Body, env)
+		if result == BREAK {
+			break
+		}
+		if result != nil && (result.Type() == object.RETURN_VALUE_OBJ || result.Type() == object.ERROR_OBJ) {
 			return result
 		}
 
-		condition = Eval(node.Condition, env)
+		condition = ev.Eval(node.Condition, env)
 		if isError(condition) {
 			return condition
 		}
@@ -417,3 +1039,128 @@ func evalWhileStatement(node *ast.WhileStatement, env *object.Environment) objec
 
 	return NULL
 }
+
+func (ev *evaluation) evalForStatement(node *ast.ForStatement, env *object.Environment) object.Object {
+	iterable := ev.Eval(node.Iterable, env)
+	if isError(iterable) {
+		return iterable
+	}
+
+	switch iterable := iterable.(type) {
+	case *object.Array:
+		for i, element := range iterable.Elements {
+			if result, done := ev.evalForBody(node, env, &object.Integer{Value: int64(i)}, element); done {
+				return result
+			}
+		}
+	case *object.String:
+		for i, ch := range []rune(iterable.Value) {
+			if result, done := ev.evalForBody(node, env, &object.Integer{Value: int64(i)}, &object.String{Value: string(ch)}); done {
+				return result
+			}
+		}
+	case *object.Hash:
+		for _, pair := range iterable.SortedPairs() {
+			value := pair.Value
+			if node.Key == nil {
+				// 変数が1つならキーを列挙する
+				value = pair.Key
+			}
+			if result, done := ev.evalForBody(node, env, pair.Key, value); done {
+				return result
+			}
+		}
+	case *object.Range:
+		for i := iterable.Start; i < iterable.End; i++ {
+			index := &object.Integer{Value: i - iterable.Start}
+			if result, done := ev.evalForBody(node, env, index, &object.Integer{Value: i}); done {
+				return result
+			}
+		}
+	default:
+		return newError("cannot iterate over %s", iterable.Type())
+	}
+
+	return NULL
+}
+
+// ループ本体を1回評価する。ループを抜ける場合はdoneがtrueになり、resultがforの結果になる
+func (ev *evaluation) evalForBody(node *ast.ForStatement, env *object.Environment, key, value object.Object) (result object.Object, done bool) {
+	if err := ev.step(); err != nil {
+		return err, true
+	}
+
+	// 本体で作られたクロージャがそれぞれの回の値を捕捉できるよう、毎回新しい環境で束縛する
+	iterEnv := object.NewEnclosedEnvironment(env)
+	if node.Key != nil {
+		iterEnv.Set(node.Key.Value, key)
+	}
+	iterEnv.Set(node.Value.Value, value)
+
+	evaluated := ev.Eval(node.Body, iterEnv)
+	if evaluated == BREAK {
+		return NULL, true
+	}
+	if evaluated != nil && (evaluated.Type() == object.RETURN_VALUE_OBJ || evaluated.Type() == object.ERROR_OBJ) {
+		return evaluated, true
+	}
+
+	return nil, false
+}
+
+// 以下はVMと演算の意味を共有するための関数
+
+func EvalPrefixExpression(operator string, right object.Object) object.Object {
+	return evalPrefixExpression(operator, right)
+}
+
+func EvalInfixExpression(operator string, left, right object.Object) object.Object {
+	return evalInfixExpression(operator, left, right)
+}
+
+func EvalIndexExpression(left, index object.Object) object.Object {
+	return evalIndexExpression(left, index)
+}
+
+// 省略した端は NULL で渡す
+func EvalSliceExpression(left, low, high object.Object) object.Object {
+	return evalSliceExpression(left, low, high)
+}
+
+func EvalIndexAssignment(left, index, value object.Object) object.Object {
+	return evalIndexAssignment(left, index, value)
+}
+
+func IsTruthy(obj object.Object) bool {
+	return isTruthy(obj)
+}
+
+// Goから関数を呼び出す。呼び出し位置が無いのでスタックトレースの呼び出し元は不明になる
+func ApplyFunction(fn object.Object, args []object.Object) object.Object {
+	return ApplyFunctionContext(context.Background(), fn, args, Limits{})
+}
+
+// EvalContext と同じ制限を課して関数を呼び出す
+func ApplyFunctionContext(ctx context.Context, fn object.Object, args []object.Object, limits Limits, opts ...Option) object.Object {
+	return newEvaluation(ctx, limits, opts).applyFunction(token.Position{}, fn, args)
+}
+
+// 引数の数が min 以上 max 以下か確かめる。max が負なら上限は無い。
+// 関数と組み込み関数(Goの関数から作ったものも含む)で共有し、メッセージを "got=.., want=.." の形に揃える
+func CheckArgumentCount(min, max, got int) *object.Error {
+	switch {
+	case got >= min && (max < 0 || got <= max):
+		return nil
+	case max < 0:
+		return newError("wrong number of arguments. got=%d, want>=%d", got, min)
+	case min == max:
+		return newError("wrong number of arguments. got=%d, want=%d", got, min)
+	default:
+		return newError("wrong number of arguments. got=%d, want=%d to %d", got, min, max)
+	}
+}
+
+func LookupBuiltin(name string) (*object.Builtin, bool) {
+	builtin, ok := builtins[name]
+	return builtin, ok
+}
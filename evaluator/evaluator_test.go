@@ -1,10 +1,16 @@
-package evaluator
+package evaluator_test
 
 import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"monkey/evaluator"
 	"monkey/lexer"
 	"monkey/object"
 	"monkey/parser"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestEvalIntegerExpression(t *testing.T) {
@@ -24,11 +30,33 @@ func TestEvalIntegerExpression(t *testing.T) {
 	}
 
 	for _, tt := range tests {
-		evaluated := testEval(tt.input)
+		evaluated := testEval(t, tt.input)
 		testIntegerObject(t, evaluated, tt.expected)
 	}
 }
 
+func TestEvalFloatExpression(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected float64
+	}{
+		{"3.5", 3.5},
+		{"-2.5", -2.5},
+		{".5 + .25", 0.75},
+		{"1.5 * 2", 3.0},
+		{"2 * 1.5", 3.0},
+		{"1 + 0.5", 1.5},
+		{"7 / 2.0", 3.5},
+		{"7.5 % 2", 1.5},
+		{"1e3 - 1", 999.0},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(t, tt.input)
+		testFloatObject(t, evaluated, tt.expected)
+	}
+}
+
 func TestEvalBooleanExpression(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -52,10 +80,48 @@ func TestEvalBooleanExpression(t *testing.T) {
 		{"(1 < 2) == false", false},
 		{"(1 > 2) == true", false},
 		{"(1 > 2) == false", true},
+		{"1.5 < 2", true},
+		{"2 > 1.5", true},
+		{"1.0 == 1", true},
+		{"1 != 1.0", false},
+		{"0.1 + 0.2 == 0.3", false},
+		{"2.5 > 2.5", false},
+		{"1 <= 1", true},
+		{"2 <= 1", false},
+		{"1 >= 1", true},
+		{"1 >= 2", false},
+		{"2.5 >= 2", true},
+		{"2 <= 1.5", false},
+		{`"a" == "a"`, true},
+		{`"a" != "a"`, false},
+		{`"a" == "b"`, false},
+		{`"a" < "b"`, true},
+		{`"b" > "a"`, true},
+		{`"abc" < "abd"`, true},
+		{`"ab" < "abc"`, true},
+		{`"b" <= "b"`, true},
+		{`"c" >= "d"`, false},
+		{"[1, 2, 3] == [1, 2, 3]", true},
+		{"[1, 2, 3] == [1, 2]", false},
+		{"[1, [2, 3]] == [1, [2, 3]]", true},
+		{"[1, [2, 3]] != [1, [2, 4]]", true},
+		{"[1, 2] == [1.0, 2.0]", true},
+		{`[1, "a"] == [1, "b"]`, false},
+		{`{"a": 1, "b": [2]} == {"b": [2], "a": 1}`, true},
+		{`{"a": 1} == {"a": 2}`, false},
+		{`{"a": 1} == {"b": 1}`, false},
+		{`{"a": 1} != {"a": 1, "b": 2}`, true},
+		// 自分自身を含む値
+		{"let a = [1]; a[0] = a; a == a", true},
+		{"let a = [1]; a[0] = a; let b = [1]; b[0] = b; a == b", true},
+		{"let a = [1, 2]; a[0] = a; let b = [1, 3]; b[0] = b; a == b", false},
+		{"let a = [1]; a[0] = a; a == [[1]]", false},
+		{`let h = {}; h["self"] = h; let g = {}; g["self"] = g; h == g`, true},
+		{`let a = [1]; let h = {"a": a}; a[0] = h; h == {"a": a}`, true},
 	}
 
 	for _, tt := range tests {
-		evaluated := testEval(tt.input)
+		evaluated := testEval(t, tt.input)
 		testBooleanObject(t, evaluated, tt.expected)
 	}
 }
@@ -74,11 +140,51 @@ func TestBangOperator(t *testing.T) {
 	}
 
 	for _, tt := range tests {
-		evaluated := testEval(tt.input)
+		evaluated := testEval(t, tt.input)
 		testBooleanObject(t, evaluated, tt.expected)
 	}
 }
 
+func TestLogicalOperators(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"true && true", true},
+		{"true && false", false},
+		{"false && true", false},
+		{"false || true", true},
+		{"false || false", false},
+		{"1 < 2 && 2 < 3", true},
+		{"1 > 2 || 2 < 3", true},
+		{"1 && 2", 2},
+		{"false || 3", 3},
+		{"1 || 2", 1},
+		{"false && undefinedName", false},
+		{"true || undefinedName", true},
+		{"true && undefinedName", "identifier not found: undefinedName"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(t, tt.input)
+		switch expected := tt.expected.(type) {
+		case bool:
+			testBooleanObject(t, evaluated, expected)
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case string:
+			errObj, ok := evaluated.(*object.Error)
+			if !ok {
+				t.Errorf("object is not Error. got=%T (%+v)", evaluated, evaluated)
+				continue
+			}
+			if errObj.Message != expected {
+				t.Errorf("wrong error message. expected=%q, got=%q", expected, errObj.Message)
+			}
+		}
+	}
+}
+
 func TestIfElseExpression(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -91,10 +197,15 @@ func TestIfElseExpression(t *testing.T) {
 		{"if (1 > 2) { 10 }", nil},
 		{"if (1 > 2) { 10 } else { 20 }", 20},
 		{"if (1 < 2) { 10 } else { 20 }", 10},
+		{"if (false) { 10 } else if (true) { 20 } else { 30 }", 20},
+		{"if (false) { 10 } else if (false) { 20 } else { 30 }", 30},
+		{"if (false) { 10 } else if (false) { 20 }", nil},
+		{"if (true) { 10 } else if (true) { 20 }", 10},
+		{"let x = 3; if (x == 1) { 1 } else if (x == 2) { 2 } else if (x == 3) { 3 } else { 4 }", 3},
 	}
 
 	for _, tt := range tests {
-		evaluated := testEval(tt.input)
+		evaluated := testEval(t, tt.input)
 		integer, ok := tt.expected.(int)
 		if ok {
 			testIntegerObject(t, evaluated, int64(integer))
@@ -125,7 +236,7 @@ if (10 > 1) {
 		},
 	}
 	for _, tt := range tests {
-		evaluated := testEval(tt.input)
+		evaluated := testEval(t, tt.input)
 		testIntegerObject(t, evaluated, tt.expected)
 	}
 }
@@ -185,6 +296,30 @@ if (10 > 1) {
 			"foobar",
 			"identifier not found: foobar",
 		},
+		{
+			"1.5 + true",
+			"type mismatch: FLOAT + BOOLEAN",
+		},
+		{
+			"-true + 1.5",
+			"unknown operator: -BOOLEAN",
+		},
+		{
+			`"a" - "b"`,
+			"unknown operator: STRING - STRING",
+		},
+		{
+			"[1] < [2]",
+			"unknown operator: ARRAY < ARRAY",
+		},
+		{
+			"5 / 0",
+			"division by zero: 5 / 0",
+		},
+		{
+			"5 % 0",
+			"division by zero: 5 % 0",
+		},
 		{
 			`{"name": "Monkey"}[fn(x) { x }]`,
 			"unusable as hash key: FUNCTION",
@@ -192,7 +327,7 @@ if (10 > 1) {
 	}
 
 	for _, tt := range tests {
-		evaluated := testEval(tt.input)
+		evaluated := testEval(t, tt.input)
 
 		errObj, ok := evaluated.(*object.Error)
 		if !ok {
@@ -218,7 +353,7 @@ func TestLetStatements(t *testing.T) {
 		{"let a = 5; let b = a; let c = a + b + 5; c", 15},
 	}
 	for _, tt := range tests {
-		if !testIntegerObject(t, testEval(tt.input), tt.expected) {
+		if !testIntegerObject(t, testEval(t, tt.input), tt.expected) {
 			continue
 		}
 	}
@@ -227,7 +362,7 @@ func TestLetStatements(t *testing.T) {
 func TestFunctionObject(t *testing.T) {
 	input := "fn(x) { x + 2; };"
 
-	evaluated := testEval(input)
+	evaluated := testEval(t, input)
 	fn, ok := evaluated.(*object.Function)
 	if !ok {
 		t.Fatalf("object is not Function. got=%T (%+v)", evaluated, evaluated)
@@ -250,7 +385,7 @@ func TestFunctionObject(t *testing.T) {
 func TestStringLiteral(t *testing.T) {
 	input := `"Hello, world!"`
 
-	evaluated := testEval(input)
+	evaluated := testEval(t, input)
 	str, ok := evaluated.(*object.String)
 	if !ok {
 		t.Fatalf("evaluated is not string. got=%T, (%+v)", evaluated, evaluated)
@@ -264,7 +399,7 @@ func TestStringLiteral(t *testing.T) {
 func TestStringConcatenation(t *testing.T) {
 	input := `"Hello," + " " + "world!"`
 
-	evaluated := testEval(input)
+	evaluated := testEval(t, input)
 	str, ok := evaluated.(*object.String)
 	if !ok {
 		t.Fatalf("evaluated is not string. got=%T, (%+v)", evaluated, evaluated)
@@ -289,7 +424,7 @@ func TestFunctionApplication(t *testing.T) {
 	}
 
 	for _, tt := range tests {
-		if !testIntegerObject(t, testEval(tt.input), tt.expected) {
+		if !testIntegerObject(t, testEval(t, tt.input), tt.expected) {
 			continue
 		}
 	}
@@ -305,15 +440,20 @@ let addTwo = newAdder(2);
 addTwo(3)
 	`
 
-	testIntegerObject(t, testEval(input), 5)
+	testIntegerObject(t, testEval(t, input), 5)
 }
 
-func testEval(input string) object.Object {
+func testEval(t *testing.T, input string) object.Object {
+	t.Helper()
+
 	l := lexer.New(input)
 	p := parser.New(l)
 	program := p.ParseProgram()
 
-	return Eval(program, object.NewEnvironment())
+	evaluated := evaluator.Eval(program, object.NewEnvironment())
+	testConformance(t, input, program, evaluated)
+
+	return evaluated
 }
 
 func testIntegerObject(t *testing.T, obj object.Object, expected int64) bool {
@@ -330,6 +470,20 @@ func testIntegerObject(t *testing.T, obj object.Object, expected int64) bool {
 	return true
 }
 
+func testFloatObject(t *testing.T, obj object.Object, expected float64) bool {
+	result, ok := obj.(*object.Float)
+	if !ok {
+		t.Errorf("object is not Float. got=%T (%+v)", obj, obj)
+		return false
+	}
+
+	if result.Value != expected {
+		t.Errorf("object has wrong value. got=%g, want=%g", result.Value, expected)
+		return false
+	}
+	return true
+}
+
 func testBooleanObject(t *testing.T, obj object.Object, expected bool) bool {
 	result, ok := obj.(*object.Boolean)
 	if !ok {
@@ -345,7 +499,7 @@ func testBooleanObject(t *testing.T, obj object.Object, expected bool) bool {
 }
 
 func testNullObject(t *testing.T, obj object.Object) bool {
-	if obj != NULL {
+	if obj != evaluator.NULL {
 		t.Errorf("object is not NULL. got=%T (%+v)", obj, obj)
 		return false
 	}
@@ -360,6 +514,8 @@ func TestBuiltinFunctions(t *testing.T) {
 		{`len("")`, 0},
 		{`len("four")`, 4},
 		{`len("hello world")`, 11},
+		{`len("日本語")`, 3},
+		{`let 挨拶 = "こんにちは"; len(挨拶)`, 5},
 		{`len(1)`, "argument to `len` not supported, got INTEGER"},
 		{`len("one", "two")`, "wrong number of arguments. got=2, want=1"},
 		{`len([1, 2, 3])`, 3},
@@ -367,13 +523,22 @@ func TestBuiltinFunctions(t *testing.T) {
 		{`last([1, 2, 3])`, 3},
 		{`rest([1, 2, 3])`, []int{2, 3}},
 		{`let a = [1, 2, 3]; push(a, 4);`, []int{1, 2, 3, 4}},
+		{`let a = [1, 2, 3]; push(a, 4); a`, []int{1, 2, 3}},
+		{`let a = [1]; append(a, 2); append(a, 3); a`, []int{1, 2, 3}},
+		{`let a = []; let b = append(a, 1); b[0] = 2; a`, []int{2}},
+		{`append(1, 2)`, "argument to `append` not supported, got INTEGER"},
+		{`type([1]) == "ARRAY"`, true},
+		{`type("a") == "STRING"`, true},
+		{`type(1, 2)`, "wrong number of arguments. got=2, want=1"},
 	}
 
 	for i, tt := range tests {
-		evaluated := testEval(tt.input)
+		evaluated := testEval(t, tt.input)
 		switch expected := tt.expected.(type) {
 		case int:
 			testIntegerObject(t, evaluated, int64(expected))
+		case bool:
+			testBooleanObject(t, evaluated, expected)
 		case string:
 			errObj, ok := evaluated.(*object.Error)
 			if !ok {
@@ -402,10 +567,114 @@ func TestBuiltinFunctions(t *testing.T) {
 	}
 }
 
+func TestStringBuiltins(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string // 結果の Inspect
+	}{
+		{`split("a,b,,c", ",")`, "[a, b, , c]"},
+		{`split("  a  b\tc ")`, "[a, b, c]"},
+		{`split("日本語", "")`, "[日, 本, 語]"},
+		{`join(["a", "b", "c"], ", ")`, "a, b, c"},
+		{`join(["a", "b"])`, "ab"},
+		{`join([], "-")`, ""},
+		{`trim("  hi \n")`, "hi"},
+		{`trim("xxhixx", "x")`, "hi"},
+		{`trimLeft("  hi  ")`, "hi  "},
+		{`trimRight("xxhixx", "x")`, "xxhi"},
+		{`upper("Monkey")`, "MONKEY"},
+		{`lower("ÀBC")`, "àbc"},
+		{`contains("monkey", "key")`, "true"},
+		{`contains("monkey", "ape")`, "false"},
+		{`startsWith("monkey", "mon")`, "true"},
+		{`endsWith("monkey", "mon")`, "false"},
+		{`indexOf("banana", "an")`, "1"},
+		{`indexOf("日本語です", "語")`, "2"},
+		{`indexOf("banana", "x")`, "-1"},
+		{`replace("banana", "a", "o")`, "bonono"},
+		{`replace("banana", "a", "o", 2)`, "bonona"},
+		{`repeat("ab", 3)`, "ababab"},
+		{`repeat("ab", 0)`, ""},
+		{`repeat("", 9223372036854775807)`, ""},
+		{`substr("monkey", 3)`, "key"},
+		{`substr("monkey", 1, 3)`, "onk"},
+		{`substr("monkey", -3, 2)`, "ke"},
+		{`substr("monkey", 4, 10)`, "ey"},
+		{`substr("monkey", 10)`, ""},
+		{`substr("日本語です", 1, 2)`, "本語"},
+		{`len(replace(repeat("a", 1000000), "a", repeat("b", 2000), 10))`, "1019990"},
+		{`chars("日本")`, "[日, 本]"},
+		{`chars("")`, "[]"},
+		{`format("%d-%s-%.2f-%t", 42, "x", 3.14159, true)`, "42-x-3.14-true"},
+		{`format("%05d|%-3s|%x", 7, "a", 255)`, "00007|a  |ff"},
+		{`sprintf("%v %v", [1, "a"], {"k": 1})`, "[1, a] {k: 1}"},
+		{`sprintf("%q", "hi")`, `"hi"`},
+		{`format("no verbs")`, "no verbs"},
+		{`let a = [1, 2]; a[0] = a; format("%v", [a, a])`, "[[[...], 2], [[...], 2]]"},
+		{`let h = {"k": 1}; h["k"] = [h]; format("%v", h)`, "{k: [{...}]}"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(t, tt.input)
+		if err, ok := evaluated.(*object.Error); ok {
+			t.Errorf("%s: unexpected error: %s", tt.input, err.Message)
+			continue
+		}
+		if evaluated.Inspect() != tt.expected {
+			t.Errorf("%s: wrong result. expected=%q, got=%q", tt.input, tt.expected, evaluated.Inspect())
+		}
+	}
+}
+
+func TestStringBuiltinErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`split()`, "wrong number of arguments. got=0, want=1 to 2"},
+		{`split(1, ",")`, "argument to `split` must be STRING, got INTEGER"},
+		{`join("abc")`, "argument to `join` must be ARRAY, got STRING"},
+		{`join([1, 2], ",")`, "argument to `join` must be ARRAY of STRING, got INTEGER element"},
+		{`join(["a"], 1)`, "argument to `join` must be STRING, got INTEGER"},
+		{`trim("a", "b", "c")`, "wrong number of arguments. got=3, want=1 to 2"},
+		{`upper(1)`, "argument to `upper` must be STRING, got INTEGER"},
+		{`lower()`, "wrong number of arguments. got=0, want=1"},
+		{`contains("a", 1)`, "argument to `contains` must be STRING, got INTEGER"},
+		{`indexOf([1], 1)`, "argument to `indexOf` must be STRING, got ARRAY"},
+		{`replace("a", "b")`, "wrong number of arguments. got=2, want=3 to 4"},
+		{`replace("a", "b", "c", "d")`, "argument to `replace` must be INTEGER, got STRING"},
+		{`repeat("a", "b")`, "argument to `repeat` must be INTEGER, got STRING"},
+		{`repeat("a", -1)`, "argument to `repeat` must not be negative, got -1"},
+		{`repeat("ab", 9223372036854775807)`, "string too long: `repeat` result would exceed 1073741824 bytes"},
+		{`repeat("a", 100000000000)`, "string too long: `repeat` result would exceed 1073741824 bytes"},
+		{`replace(repeat("a", 1000000), "", repeat("b", 2000))`, "string too long: `replace` result would exceed 1073741824 bytes"},
+		{`replace(repeat("a", 1000000), "a", repeat("b", 2000))`, "string too long: `replace` result would exceed 1073741824 bytes"},
+		{`join(split(repeat(",", 100000), ","), repeat("a", 20000))`, "string too long: `join` result would exceed 1073741824 bytes"},
+		{`substr("abc", 1, -1)`, "argument to `substr` must not be negative, got -1"},
+		{`chars(["a"])`, "argument to `chars` must be STRING, got ARRAY"},
+		{`format()`, "wrong number of arguments. got=0, want>=1"},
+		// 関数の引数の数の誤りと同じ形
+		{`let f = fn(a, ...rest) { a }; f()`, "wrong number of arguments. got=0, want>=1"},
+		{`sprintf(1)`, "argument to `sprintf` must be STRING, got INTEGER"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(t, tt.input)
+		errObj, ok := evaluated.(*object.Error)
+		if !ok {
+			t.Errorf("%s: no error object returned. got=%T (%+v)", tt.input, evaluated, evaluated)
+			continue
+		}
+		if errObj.Message != tt.expected {
+			t.Errorf("%s: wrong error message. expected=%q, got=%q", tt.input, tt.expected, errObj.Message)
+		}
+	}
+}
+
 func TestArrayLiteral(t *testing.T) {
 	input := "[1, 2 * 2, 3 + 3]"
 
-	evaluated := testEval(input)
+	evaluated := testEval(t, input)
 	arr, ok := evaluated.(*object.Array)
 	if !ok {
 		t.Fatalf("evaluated is not Array. got=%T, (%+v)", evaluated, evaluated)
@@ -459,12 +728,20 @@ func TestArrayIndexExpressions(t *testing.T) {
 		},
 		{
 			"[1, 2, 3][-1]",
+			3,
+		},
+		{
+			"[1, 2, 3][-3]",
+			1,
+		},
+		{
+			"[1, 2, 3][-4]",
 			nil,
 		},
 	}
 
 	for _, tt := range tests {
-		evaluated := testEval(tt.input)
+		evaluated := testEval(t, tt.input)
 		integer, ok := tt.expected.(int)
 		if ok {
 			testIntegerObject(t, evaluated, int64(integer))
@@ -474,6 +751,100 @@ func TestArrayIndexExpressions(t *testing.T) {
 	}
 }
 
+func TestStringIndexExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{`"abc"[0]`, "a"},
+		{`"abc"[2]`, "c"},
+		{`"abc"[-1]`, "c"},
+		{`"日本語"[1]`, "本"},
+		{`let s = "monkey"; s[len(s) - 1]`, "y"},
+		{`"abc"[3]`, nil},
+		{`"abc"[-4]`, nil},
+		{`""[0]`, nil},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(t, tt.input)
+		expected, ok := tt.expected.(string)
+		if !ok {
+			testNullObject(t, evaluated)
+			continue
+		}
+		str, ok := evaluated.(*object.String)
+		if !ok {
+			t.Errorf("%s: object is not String. got=%T (%+v)", tt.input, evaluated, evaluated)
+			continue
+		}
+		if str.Value != expected {
+			t.Errorf("%s: String has wrong value. expected=%q, got=%q", tt.input, expected, str.Value)
+		}
+	}
+}
+
+func TestSliceExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string // 結果の Inspect
+	}{
+		{"[1, 2, 3, 4][1:3]", "[2, 3]"},
+		{"[1, 2, 3, 4][2:]", "[3, 4]"},
+		{"[1, 2, 3, 4][:2]", "[1, 2]"},
+		{"[1, 2, 3, 4][:]", "[1, 2, 3, 4]"},
+		{"[1, 2, 3, 4][-2:]", "[3, 4]"},
+		{"[1, 2, 3, 4][:-1]", "[1, 2, 3]"},
+		{"[1, 2, 3, 4][-10:10]", "[1, 2, 3, 4]"},
+		{"[1, 2, 3, 4][3:1]", "[]"},
+		{"[1, 2, 3, 4][5:]", "[]"},
+		{"let i = 1; [1, 2, 3, 4][i:i + 2]", "[2, 3]"},
+		{`"monkey"[1:4]`, "onk"},
+		{`"monkey"[-3:]`, "key"},
+		{`"monkey"[:-3]`, "mon"},
+		{`"日本語です"[1:3]`, "本語"},
+		{`"abc"[2:1]`, ""},
+		// 切り出した配列は元の配列と要素を共有しない
+		{"let a = [1, 2, 3]; let b = a[:]; b[0] = 9; a", "[1, 2, 3]"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(t, tt.input)
+		if err, ok := evaluated.(*object.Error); ok {
+			t.Errorf("%s: unexpected error: %s", tt.input, err.Message)
+			continue
+		}
+		if evaluated.Inspect() != tt.expected {
+			t.Errorf("%s: wrong result. expected=%q, got=%q", tt.input, tt.expected, evaluated.Inspect())
+		}
+	}
+}
+
+func TestSliceErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"1[0:1]", "slice operator not supported: INTEGER"},
+		{`{"a": 1}[:]`, "slice operator not supported: HASH"},
+		{`[1, 2]["a":]`, "slice index must be INTEGER, got STRING"},
+		{`"abc"[:1.5]`, "slice index must be INTEGER, got FLOAT"},
+		{"[1][x:]", "identifier not found: x"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(t, tt.input)
+		errObj, ok := evaluated.(*object.Error)
+		if !ok {
+			t.Errorf("%s: no error object returned. got=%T (%+v)", tt.input, evaluated, evaluated)
+			continue
+		}
+		if errObj.Message != tt.expected {
+			t.Errorf("%s: wrong error message. expected=%q, got=%q", tt.input, tt.expected, errObj.Message)
+		}
+	}
+}
+
 func TestHashLiterals(t *testing.T) {
 	input := `let two = "two";
 	{
@@ -485,7 +856,7 @@ func TestHashLiterals(t *testing.T) {
 		false: 6
     }`
 
-	evaluated := testEval(input)
+	evaluated := testEval(t, input)
 	hash, ok := evaluated.(*object.Hash)
 	if !ok {
 		t.Fatalf("evaluated is not Hash. got=%T, (%+v)", evaluated, evaluated)
@@ -495,8 +866,8 @@ func TestHashLiterals(t *testing.T) {
 		(&object.String{Value: "two"}).HashKey():   2,
 		(&object.String{Value: "three"}).HashKey(): 3,
 		(&object.Integer{Value: 4}).HashKey():      4,
-		TRUE.HashKey():                             5,
-		FALSE.HashKey():                            6,
+		evaluator.TRUE.HashKey():                   5,
+		evaluator.FALSE.HashKey():                  6,
 	}
 
 	if len(hash.Pairs) != len(expected) {
@@ -545,10 +916,22 @@ func TestHashIndexExpressions(t *testing.T) {
 			`{false: 5}[false]`,
 			5,
 		},
+		{
+			`{1: 5}[1.0]`,
+			5,
+		},
+		{
+			`{0.5: 5}[0.5]`,
+			5,
+		},
+		{
+			`{0.5: 5}[0]`,
+			nil,
+		},
 	}
 
 	for _, tt := range tests {
-		evaluated := testEval(tt.input)
+		evaluated := testEval(t, tt.input)
 		integer, ok := tt.expected.(int)
 		if ok {
 			testIntegerObject(t, evaluated, int64(integer))
@@ -583,10 +966,849 @@ a
 `,
 			1,
 		},
+		{
+			`
+let a = 0
+while (true) {
+	a += 1
+	if (a == 5) { break }
+}
+a
+`,
+			5,
+		},
+		{
+			`
+let i = 0
+let sum = 0
+while (i < 10) {
+	i += 1
+	if (i % 2 == 0) { continue }
+	sum += i
+}
+sum
+`,
+			25,
+		},
+		{
+			`
+let i = 0
+let count = 0
+while (i < 3) {
+	i += 1
+	let j = 0
+	while (true) {
+		j += 1
+		if (j > i) { break }
+		count += 1
+	}
+}
+count
+`,
+			6,
+		},
+		{
+			`
+let f = fn() {
+	let i = 0
+	while (i < 5) {
+		if (i == 2) { return i * 10 }
+		i += 1
+	}
+	return 99
+}
+f()
+`,
+			20,
+		},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(t, tt.input)
+		testIntegerObject(t, evaluated, tt.expected)
+	}
+}
+
+func TestErrorStackTrace(t *testing.T) {
+	input := `let inner = fn(x) {
+  x + true
+};
+let outer = fn(y) {
+  fn() { inner(y) + 0 }() + 0
+};
+outer(1)`
+
+	evaluated := testEval(t, input)
+	errObj, ok := evaluated.(*object.Error)
+	if !ok {
+		t.Fatalf("no error object returned. got=%T (%+v)", evaluated, evaluated)
+	}
+
+	if errObj.Pos.String() != "2:3" {
+		t.Errorf("wrong error position. expected=%q, got=%q", "2:3", errObj.Pos)
+	}
+
+	expectedStack := []struct {
+		function string
+		callSite string
+	}{
+		{"inner", "5:10"},
+		{"<anonymous>", "5:3"},
+		{"outer", "7:1"},
+	}
+
+	if len(errObj.Stack) != len(expectedStack) {
+		t.Fatalf("wrong stack depth. expected=%d, got=%d (%+v)", len(expectedStack), len(errObj.Stack), errObj.Stack)
+	}
+
+	for i, expected := range expectedStack {
+		frame := errObj.Stack[i]
+		if frame.Function != expected.function {
+			t.Errorf("stack[%d] has wrong function. expected=%q, got=%q", i, expected.function, frame.Function)
+		}
+		if frame.CallSite.String() != expected.callSite {
+			t.Errorf("stack[%d] has wrong call site. expected=%q, got=%q", i, expected.callSite, frame.CallSite)
+		}
+	}
+
+	expectedTrace := `ERROR: type mismatch: INTEGER + BOOLEAN
+
+inner(...)
+	2:3
+<anonymous>(...)
+	5:10
+outer(...)
+	5:3
+<main>
+	7:1
+`
+	if errObj.StackTrace() != expectedTrace {
+		t.Errorf("wrong stack trace. expected=%q, got=%q", expectedTrace, errObj.StackTrace())
+	}
+}
+
+func TestAssignExpression(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"let a = 1; a = 2; a", 2},
+		{"let a = 1; a = 2", 2},
+		{"let a = 1; let b = 1; a = b = 5; a + b", 10},
+		{"let a = 1; a += 2; a", 3},
+		{"let a = 5; a -= 2; a", 3},
+		{"let a = 5; a *= 2; a", 10},
+		{"let a = 9; a /= 2; a", 4},
+		{"let a = 9; a %= 2; a", 1},
+		{"let a = 1; a += 0.5; a", 1.5},
+		{`let s = "a"; s += "b"; s`, "ab"},
+		{"let a = 1; let f = fn() { a = 10 }; f(); a", 10},
+		{"let a = 1; let f = fn() { let a = 2; a = 3; a }; f() + a", 4},
+		{"let counter = fn() { let n = 0; fn() { n += 1 } }; let c = counter(); c(); c(); c()", 3},
+		{"let arr = [1, 2, 3]; arr[1] = 5; arr[1]", 5},
+		{"let arr = [1, 2, 3]; arr[2] += 5; arr", []int{1, 2, 8}},
+		{`let h = {"a": 1}; h["a"] = 2; h["b"] = 3; h["a"] + h["b"]`, 5},
+		{`let h = {"a": 1}; h["a"] *= 10; h["a"]`, 10},
+		// 標準ライブラリの名前はグローバル変数と同じように代入できる
+		{"map = fn(arr, f) { 0 }; map([1], fn(x) { x })", 0},
+		{"let f = fn() { range = fn(n) { [n] } }; f(); range(7)", []int{7}},
+		{"reduce += 1", "type mismatch: FUNCTION + INTEGER"},
+		// 標準ライブラリの中からの参照は変わらない
+		{"map = 1; sortBy([3, 1, 2], fn(x) { x })", []int{1, 2, 3}},
+		{"b = 1", "identifier not found: b"},
+		{"b += 1", "identifier not found: b"},
+		{"let f = fn() { c = 1 }; f()", "identifier not found: c"},
+		{"let arr = [1]; arr[1] = 2", "index out of range: 1"},
+		{"let arr = [1, 2, 3]; arr[-1] = 9; arr", []int{1, 2, 9}},
+		{"let arr = [1]; arr[-2] = 2", "index out of range: -2"},
+		{`let s = "abc"; s[0] = "x"`, "index assignment not supported: STRING"},
+		{"let a = 1; a += true", "type mismatch: INTEGER + BOOLEAN"},
+		{`let a = 1; a[0] = 1`, "index assignment not supported: INTEGER"},
+		{`let h = {}; h[fn() {}] = 1`, "unusable as hash key: FUNCTION"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(t, tt.input)
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case float64:
+			testFloatObject(t, evaluated, expected)
+		case []int:
+			array, ok := evaluated.(*object.Array)
+			if !ok {
+				t.Errorf("obj not Array. got=%T (%+v)", evaluated, evaluated)
+				continue
+			}
+			if len(array.Elements) != len(expected) {
+				t.Errorf("wrong num of elements. want=%d, got=%d", len(expected), len(array.Elements))
+				continue
+			}
+			for i, expectedElem := range expected {
+				testIntegerObject(t, array.Elements[i], int64(expectedElem))
+			}
+		case string:
+			switch result := evaluated.(type) {
+			case *object.String:
+				if result.Value != expected {
+					t.Errorf("String has wrong value. expected=%q, got=%q", expected, result.Value)
+				}
+			case *object.Error:
+				if result.Message != expected {
+					t.Errorf("wrong error message. expected=%q, got=%q", expected, result.Message)
+				}
+			default:
+				t.Errorf("object is not String or Error. got=%T (%+v)", evaluated, evaluated)
+			}
+		}
+	}
+}
+
+func TestForStatement(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"let sum = 0; for (x in [1, 2, 3]) { sum += x }; sum", 6},
+		{"let sum = 0; for (i, x in [10, 20, 30]) { sum += i * x }; sum", 80},
+		{`let s = ""; for (ch in "abc") { s = ch + s }; s`, "cba"},
+		{`let s = ""; for (i, ch in "abc") { s += ch + ":" }; s`, "a:b:c:"},
+		{`let s = ""; for (k in {"b": 2, "a": 1}) { s += k }; s`, "ab"},
+		{`let sum = 0; for (k, v in {"b": 2, "a": 1}) { sum += v }; sum`, 3},
+		{"let sum = 0; for (i in 0..5) { sum += i }; sum", 10},
+		{"let sum = 0; for (i in 5..5) { sum += 1 }; sum", 0},
+		{"let sum = 0; for (i in 0..10) { if (i == 3) { break } sum += i }; sum", 3},
+		{"let sum = 0; for (i in 0..10) { if (i % 2 == 0) { continue } sum += i }; sum", 25},
+		{"let f = fn() { for (x in [1, 2, 3]) { if (x == 2) { return x * 100 } } 0 }; f()", 200},
+		{"let fns = []; for (i in 0..3) { fns = push(fns, fn() { i }) }; fns[0]() + fns[1]() * 10 + fns[2]() * 100", 210},
+		{"for (x in [1]) { let inner = 1 }; inner", "identifier not found: inner"},
+		{"for (x in 1) { x }", "cannot iterate over INTEGER"},
+		{"for (x in 1.5..2) { x }", "unknown operator: FLOAT .. INTEGER"},
+		{"for (x in [1, 2]) { x + true }", "type mismatch: INTEGER + BOOLEAN"},
+		{"for (x in [1, 2]) { x }", nil},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(t, tt.input)
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case string:
+			switch result := evaluated.(type) {
+			case *object.String:
+				if result.Value != expected {
+					t.Errorf("String has wrong value. expected=%q, got=%q", expected, result.Value)
+				}
+			case *object.Error:
+				if result.Message != expected {
+					t.Errorf("wrong error message. expected=%q, got=%q", expected, result.Message)
+				}
+			default:
+				t.Errorf("object is not String or Error. got=%T (%+v)", evaluated, evaluated)
+			}
+		default:
+			testNullObject(t, evaluated)
+		}
+	}
+}
+
+func TestEvalContext(t *testing.T) {
+	expired, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		input    string
+		ctx      context.Context
+		limits   evaluator.Limits
+		expected error
+	}{
+		{"while (true) {}", expired, evaluator.Limits{}, evaluator.ErrTimeout},
+		{"while (true) {}", cancelled, evaluator.Limits{}, evaluator.ErrCancelled},
+		{"let f = fn() { f() }; f()", cancelled, evaluator.Limits{}, evaluator.ErrCancelled},
+		{"for (i in 0..100) {}", context.Background(), evaluator.Limits{MaxSteps: 50}, evaluator.ErrBudgetExceeded},
+		{"let f = fn(n) { f(n + 1) }; f(0)", context.Background(), evaluator.Limits{MaxSteps: 100}, evaluator.ErrBudgetExceeded},
+		{"let i = 0; while (i < 10) { i += 1 }", context.Background(), evaluator.Limits{MaxSteps: 10}, nil},
+		{"for (i in 0..10) { fn() {}() }", context.Background(), evaluator.Limits{MaxSteps: 20}, nil},
+		{"1 + 1", cancelled, evaluator.Limits{MaxSteps: 1}, nil},
+		// 組み込み関数の呼び出しも1ステップ、返した文字列は StringStepBytes ごとに1ステップ
+		{`for (i in 0..10) { len("") }`, context.Background(), evaluator.Limits{MaxSteps: 20}, nil},
+		{`for (i in 0..10) { len("") }`, context.Background(), evaluator.Limits{MaxSteps: 15}, evaluator.ErrBudgetExceeded},
+		{`len(repeat("a", 50000))`, context.Background(), evaluator.Limits{MaxSteps: 100}, nil},
+		{`repeat("a", 1000000)`, context.Background(), evaluator.Limits{MaxSteps: 100}, evaluator.ErrBudgetExceeded},
+		{`try { join(map(range(200), fn(i) { repeat("a", 1024) })) } catch (e) { 1 }`, context.Background(), evaluator.Limits{MaxSteps: 500}, evaluator.ErrBudgetExceeded},
+		// 打ち切りは捕捉できない
+		{"try { while (true) {} } catch (e) { 1 }", cancelled, evaluator.Limits{}, evaluator.ErrCancelled},
+		{"try { for (i in 0..100) {} } finally { 1 }", context.Background(), evaluator.Limits{MaxSteps: 50}, evaluator.ErrBudgetExceeded},
+	}
+
+	for _, tt := range tests {
+		program := parser.New(lexer.New(tt.input)).ParseProgram()
+		evaluated := evaluator.EvalContext(tt.ctx, program, object.NewEnvironment(), tt.limits)
+
+		err, isErr := evaluated.(*object.Error)
+		if tt.expected == nil {
+			if isErr {
+				t.Errorf("%q: unexpected error: %s", tt.input, err.Message)
+			}
+			continue
+		}
+		if !isErr {
+			t.Errorf("%q: no error object returned. got=%T (%+v)", tt.input, evaluated, evaluated)
+			continue
+		}
+		if !errors.Is(err, tt.expected) {
+			t.Errorf("%q: wrong cause. want=%v, got=%v", tt.input, tt.expected, err.Cause)
+		}
+		if err.Message != tt.expected.Error() {
+			t.Errorf("%q: wrong error message. want=%q, got=%q", tt.input, tt.expected.Error(), err.Message)
+		}
+	}
+}
+
+func TestApplyFunctionContext(t *testing.T) {
+	env := object.NewEnvironment()
+	evaluator.Eval(parser.New(lexer.New("let loop = fn() { while (true) {} };")).ParseProgram(), env)
+	loop, _ := env.Get("loop")
+
+	evaluated := evaluator.ApplyFunctionContext(context.Background(), loop, nil, evaluator.Limits{MaxSteps: 1000})
+	if err, ok := evaluated.(*object.Error); !ok || !errors.Is(err, evaluator.ErrBudgetExceeded) {
+		t.Errorf("expected budget exceeded error. got=%T (%+v)", evaluated, evaluated)
+	}
+}
+
+func TestRecursionDepth(t *testing.T) {
+	tests := []struct {
+		input    string
+		limits   evaluator.Limits
+		expected interface{}
+	}{
+		{"let f = fn(n) { if (n == 0) { 0 } else { 1 + f(n - 1) } }; f(9000)", evaluator.Limits{}, 9000},
+		{"let f = fn(n) { 1 + f(n + 1) };\nf(0)", evaluator.Limits{}, "1:21"},
+		{"let f = fn(n) { if (n == 0) { 0 } else { 1 + f(n - 1) } }; f(9)", evaluator.Limits{MaxDepth: 10}, 9},
+		{"let f = fn(n) { if (n == 0) { 0 } else { 1 + f(n - 1) } }; f(10)", evaluator.Limits{MaxDepth: 10}, "1:46"},
+		// 関数から戻ると深さも戻る
+		{"let g = fn() { 1 }; let s = 0; for (i in 0..20) { s += g() }; s", evaluator.Limits{MaxDepth: 1}, 20},
+	}
+
+	for _, tt := range tests {
+		program := parser.New(lexer.New(tt.input)).ParseProgram()
+		evaluated := evaluator.EvalContext(context.Background(), program, object.NewEnvironment(), tt.limits)
+
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case string:
+			err, ok := evaluated.(*object.Error)
+			if !ok {
+				t.Errorf("no error object returned. got=%T (%+v)", evaluated, evaluated)
+				continue
+			}
+			if err.Message != "maximum recursion depth exceeded" {
+				t.Errorf("wrong error message. got=%q", err.Message)
+			}
+			if err.Pos.String() != expected {
+				t.Errorf("wrong error position. want=%s, got=%s", expected, err.Pos)
+			}
+		}
+	}
+}
+
+func TestTailCalls(t *testing.T) {
+	// 100万要素の配列を末尾再帰の reduce で畳み込む。呼び出しの深さの上限より
+	// はるかに深いが、末尾呼び出しはGoのスタックも深さも増やさない
+	elements := make([]object.Object, 1000000)
+	for i := range elements {
+		elements[i] = &object.Integer{Value: int64(i)}
+	}
+	env := object.NewEnvironment()
+	env.Set("data", &object.Array{Elements: elements})
+
+	input := `
+let reduce = fn(arr, initial, f) {
+  let iter = fn(i, acc) {
+    if (i == len(arr)) {
+      return acc
+    }
+    iter(i + 1, f(acc, arr[i]))
+  };
+  iter(0, initial)
+};
+reduce(data, 0, fn(acc, x) { acc + x })`
+
+	if !testing.Short() {
+		program := parser.New(lexer.New(input)).ParseProgram()
+		evaluated := evaluator.Eval(program, env)
+		testIntegerObject(t, evaluated, 499999500000)
+	}
+
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{`let even = fn(n) { if (n == 0) { true } else { odd(n - 1) } };
+		  let odd = fn(n) { if (n == 0) { false } else { even(n - 1) } };
+		  even(100001)`, false},
+		{"let count = fn(n) { while (true) { if (n == 0) { return 0 }; return count(n - 1) } }; count(100000)", 0},
+		{"let count = fn(n) { for (x in [1]) { if (n == 0) { break }; return count(n - 1) }; n }; count(100000)", 0},
+		{"let f = fn(a) { push(a, 1) }; len(f([7]))", 2},
+		{"let add = fn(a, b) { a + b }; let f = fn(x) { add(x, 1) }; f(1) + f(2)", 5},
+		{"let f = fn() { 1() }; f()", "not a function: INTEGER"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(t, tt.input)
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case bool:
+			testBooleanObject(t, evaluated, expected)
+		case string:
+			err, ok := evaluated.(*object.Error)
+			if !ok {
+				t.Errorf("no error object returned. got=%T (%+v)", evaluated, evaluated)
+			} else if err.Message != expected {
+				t.Errorf("wrong error message. expected=%q, got=%q", expected, err.Message)
+			}
+		}
+	}
+}
+
+func TestTailCallStackTrace(t *testing.T) {
+	// 末尾呼び出しした関数のフレームは残らない
+	input := `let inner = fn(x) {
+  x + true
+};
+let outer = fn(y) {
+  inner(y)
+};
+outer(1)`
+
+	evaluated := testEval(t, input)
+	errObj, ok := evaluated.(*object.Error)
+	if !ok {
+		t.Fatalf("no error object returned. got=%T (%+v)", evaluated, evaluated)
+	}
+
+	expectedTrace := `ERROR: type mismatch: INTEGER + BOOLEAN
+
+inner(...)
+	2:3
+<main>
+	7:1
+`
+	if errObj.StackTrace() != expectedTrace {
+		t.Errorf("wrong stack trace. expected=%q, got=%q", expectedTrace, errObj.StackTrace())
+	}
+
+	evaluated = testEval(t, "let f = fn() {\n  1()\n};\nf()")
+	errObj, ok = evaluated.(*object.Error)
+	if !ok {
+		t.Fatalf("no error object returned. got=%T (%+v)", evaluated, evaluated)
+	}
+
+	expectedTrace = `ERROR: not a function: INTEGER
+
+f(...)
+	2:3
+<main>
+	4:1
+`
+	if errObj.StackTrace() != expectedTrace {
+		t.Errorf("wrong stack trace. expected=%q, got=%q", expectedTrace, errObj.StackTrace())
+	}
+}
+
+func TestFunctionArguments(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"let f = fn(a, b) { a + b }; f(1)", "wrong number of arguments. got=1, want=2"},
+		{"let f = fn(a, b) { a + b }; f(1, 2, 3)", "wrong number of arguments. got=3, want=2"},
+		{"let f = fn() { 1 }; f(1)", "wrong number of arguments. got=1, want=0"},
+		{"let f = fn(a, b = 2) { a + b }; f(1)", 3},
+		{"let f = fn(a, b = 2) { a + b }; f(1, 5)", 6},
+		{"let f = fn(a, b = 2) { a + b }; f()", "wrong number of arguments. got=0, want=1 to 2"},
+		{"let f = fn(a, b = 2) { a + b }; f(1, 2, 3)", "wrong number of arguments. got=3, want=1 to 2"},
+		// 既定値は呼び出しのたびに評価され、前の引数を参照できる
+		{"let f = fn(a, b = a * 2) { a + b }; f(3)", 9},
+		{"let f = fn(a = [], b = push(a, 1)) { len(b) }; f() + f()", 2},
+		{"let f = fn(a = 1, b = 2) { a * 10 + b }; f(5)", 52},
+		// まだ束縛されていない引数の名前は外側で解決される
+		{"let b = 100; let f = fn(a = b, b = 1) { a + b }; f()", 101},
+		{"let f = fn(a = c) { a }; f(1)", 1},
+		{"let f = fn(a = c) { a }; f()", "identifier not found: c"},
+		{"let f = fn(...rest) { len(rest) }; f()", 0},
+		{"let f = fn(...rest) { len(rest) }; f(1, 2, 3)", 3},
+		{"let f = fn(a, ...rest) { a + rest[0] + rest[1] }; f(1, 2, 3)", 6},
+		{"let f = fn(a, ...rest) { a }; f()", "wrong number of arguments. got=0, want>=1"},
+		{"let f = fn(a, b = 10, ...rest) { a + b + len(rest) }; f(1)", 11},
+		{"let f = fn(a, b = 10, ...rest) { a + b + len(rest) }; f(1, 2, 3, 4)", 5},
+		// 既定値と残りの引数を捕捉するクロージャ
+		{"let f = fn(a = 1, g = fn() { a }) { g() }; f(7)", 7},
+		{"let f = fn(...rest) { fn() { rest[0] } }; f(4)()", 4},
+		// 末尾呼び出しでも確認する
+		{"let g = fn(a) { a }; let f = fn() { g() }; f()", "wrong number of arguments. got=0, want=1"},
+		{"let g = fn(a, ...r) { a + len(r) }; let f = fn() { g(1, 2) }; f()", 2},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(t, tt.input)
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case string:
+			err, ok := evaluated.(*object.Error)
+			if !ok {
+				t.Errorf("%q: no error object returned. got=%T (%+v)", tt.input, evaluated, evaluated)
+			} else if err.Message != expected {
+				t.Errorf("%q: wrong error message. expected=%q, got=%q", tt.input, expected, err.Message)
+			}
+		}
+	}
+}
+
+// 同じ名前の引数は評価器とVMで束縛が食い違うので、どちらで実行する前にも構文エラーにする
+func TestDuplicateParameters(t *testing.T) {
+	for _, input := range []string{
+		"fn(a, a) { a }(1, 2)",
+		"fn(a, ...a) { a }(1, 2)",
+		"let f = fn(x, y = 1, x) { x }",
+	} {
+		p := parser.New(lexer.New(input))
+		p.ParseProgram()
+		if len(p.Errors()) == 0 {
+			t.Errorf("%q: parser has no errors", input)
+		}
+	}
+
+	testIntegerObject(t, testEval(t, "fn(a, b) { a }(1, 2)"), 1)
+	testIntegerObject(t, testEval(t, "fn(a, ...b) { a + len(b) }(1, 2)"), 2)
+}
+
+func TestArgumentErrorStackTrace(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{
+			"let f = fn(a) { a };\n1 + f()",
+			"ERROR: wrong number of arguments. got=0, want=1\n\n<main>\n\t2:5\n",
+		},
+		{
+			// 既定値の評価は呼び出された関数の中で行う
+			"let f = fn(a = 1 + true) { a };\n1 + f()",
+			"ERROR: type mismatch: INTEGER + BOOLEAN\n\nf(...)\n\t1:16\n<main>\n\t2:5\n",
+		},
 	}
 
 	for _, tt := range tests {
-		evaluated := testEval(tt.input)
+		evaluated := testEval(t, tt.input)
+		err, ok := evaluated.(*object.Error)
+		if !ok {
+			t.Errorf("%q: no error object returned. got=%T (%+v)", tt.input, evaluated, evaluated)
+			continue
+		}
+		if err.StackTrace() != tt.expected {
+			t.Errorf("%q: wrong stack trace. expected=%q, got=%q", tt.input, tt.expected, err.StackTrace())
+		}
+	}
+}
+
+func TestTryExpression(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"try { 1 } catch (e) { 2 }", 1},
+		{"try { 1 + true } catch (e) { 2 }", 2},
+		{"try { 1 + true; 3 } catch (e) { 2 }", 2},
+		{"try { let x = 1 } catch (e) { 2 }", nil},
+		{"try { 1 + true } catch (e) { e[\"message\"] }", "type mismatch: INTEGER + BOOLEAN"},
+		{"try { 1 + true } catch (e) { e[\"value\"] }", nil},
+		// 実行時エラーの種類
+		{"try { 1 + true } catch (e) { e[\"kind\"] }", "TypeError"},
+		{"try { x } catch (e) { e[\"kind\"] }", "NameError"},
+		{"try { 1 / 0 } catch (e) { e[\"kind\"] }", "ZeroDivisionError"},
+		{"try { fn(a) { a }() } catch (e) { e[\"kind\"] }", "ArgumentError"},
+		{"try { len(1) } catch (e) { e[\"kind\"] }", "TypeError"},
+		{"let a = [1]; try { a[5] = 1 } catch (e) { e[\"kind\"] }", "IndexError"},
+		{"try { 1[0:1] } catch (e) { e[\"kind\"] }", "TypeError"},
+		{"try { repeat(\"a\", 100000000000) } catch (e) { e[\"kind\"] }", "ArgumentError"},
+		// throw した値
+		{"try { throw \"bad\" } catch (e) { e[\"message\"] + e[\"kind\"] }", "badError"},
+		{"try { throw 42 } catch (e) { e[\"value\"] + 1 }", 43},
+		{"try { throw 42 } catch (e) { e[\"message\"] }", "42"},
+		{"try { throw {\"message\": \"bad\", \"kind\": \"ValueError\"} } catch (e) { e[\"kind\"] + \": \" + e[\"message\"] }", "ValueError: bad"},
+		{"try { try { throw \"a\" } catch (e) { throw e } } catch (e) { e[\"message\"] }", "a"},
+		{"let f = fn() { try { throw \"in\" } catch (e) { \"f:\" + e[\"message\"] } }; try { f() } catch (e) { \"outer\" }", "f:in"},
+		// finally
+		{"try { 1 } finally { 2 }", 1},
+		{"try { throw \"a\" } catch (e) { 3 } finally { 4 }", 3},
+		{"let x = 0; try { x = 1 } finally { x = x + 10 }; x", 11},
+		{"let x = 0; try { try { 1 + true } finally { x = 5 } } catch (e) { x }", 5},
+		{"let x = 0; let m = try { try { throw \"a\" } catch (e) { throw \"b\" } finally { x = 1 } } catch (e) { e[\"message\"] }; if (x == 1) { m }", "b"},
+		{"let log = []; let f = fn() { try { return 1 } finally { log = push(log, 1) } }; f() + len(log)", 2},
+		{"let f = fn() { try { return 1 } catch (e) { 2 } }; f()", 1},
+		{"let n = 0; let i = 0; while (true) { try { i += 1; if (i == 3) { break } } finally { n += 1 } }; n", 3},
+		{"let n = 0; for (i in 0..5) { try { if (i % 2 == 0) { continue } } finally { n += 1 } }; n", 5},
+		{"let n = 0; for (i in 0..5) { try { throw i } catch (e) { if (e[\"value\"] == 2) { break } } finally { n += 1 } }; n", 3},
+		{"let n = 0; let f = fn() { for (i in 0..5) { try { try { return i } finally { n += 1 } } finally { n += 10 } } }; f() + n", 11},
+		// 入力の一部が不正でも処理を続けられる
+		{"let sum = 0; for (r in [1, \"x\", 3]) { sum += try { r * 2 } catch (e) { 0 } }; sum", 8},
+		{"let f = fn(x) { try { x + 1 } catch (e) { 0 } }; f(1) + f(true)", 2},
+		// catch の変数はその中だけで見える
+		{"let e = 1; try { throw \"a\" } catch (e) { e }; e", 1},
+		{"let fs = []; for (i in 0..2) { try { throw i } catch (e) { fs = push(fs, fn() { e[\"value\"] }) } }; fs[0]() + fs[1]() * 10", 10},
+		{"let f = fn(n) { 1 + f(n + 1) }; try { f(0) } catch (e) { e[\"kind\"] }", "RecursionError"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(t, tt.input)
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case string:
+			str, ok := evaluated.(*object.String)
+			if !ok {
+				t.Errorf("%q: object is not String. got=%T (%+v)", tt.input, evaluated, evaluated)
+			} else if str.Value != expected {
+				t.Errorf("%q: wrong value. expected=%q, got=%q", tt.input, expected, str.Value)
+			}
+		case nil:
+			testNullObject(t, evaluated)
+		}
+	}
+}
+
+func TestThrowStackTrace(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{
+			"throw \"bad\"",
+			"ERROR: bad\n\n<main>\n\t1:1\n",
+		},
+		{
+			"let f = fn() { throw {\"message\": \"bad\"} };\nf() + 0",
+			"ERROR: bad\n\nf(...)\n\t1:16\n<main>\n\t2:1\n",
+		},
+		{
+			// finally を通ってもエラーの位置は変わらない
+			"let f = fn() { try { 1 + true } finally { 2 } };\nf() + 0",
+			"ERROR: type mismatch: INTEGER + BOOLEAN\n\nf(...)\n\t1:22\n<main>\n\t2:1\n",
+		},
+		{
+			"try { throw \"a\" } catch (e) {\n  throw e[\"message\"] + \"b\"\n}",
+			"ERROR: ab\n\n<main>\n\t2:3\n",
+		},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(t, tt.input)
+		err, ok := evaluated.(*object.Error)
+		if !ok {
+			t.Errorf("%q: no error object returned. got=%T (%+v)", tt.input, evaluated, evaluated)
+			continue
+		}
+		if err.StackTrace() != tt.expected {
+			t.Errorf("%q: wrong stack trace. expected=%q, got=%q", tt.input, tt.expected, err.StackTrace())
+		}
+	}
+}
+
+func TestCaughtErrorStack(t *testing.T) {
+	input := `let f = fn() { throw "x" };
+let g = fn() { f() + 0 };
+let h = fn() { try { g() + 0 } catch (e) { e["stack"] } };
+h()`
+
+	evaluated := testEval(t, input)
+	arr, ok := evaluated.(*object.Array)
+	if !ok {
+		t.Fatalf("object is not Array. got=%T (%+v)", evaluated, evaluated)
+	}
+
+	// 捕捉した関数より外側のフレームも含む
+	expected := []string{"f at 1:16", "g at 2:16", "h at 3:22", "<main> at 4:1"}
+	if arr.Inspect() != "["+strings.Join(expected, ", ")+"]" {
+		t.Errorf("wrong stack. expected=%q, got=%s", expected, arr.Inspect())
+	}
+}
+
+// testdata/modules/main.monkey として評価する
+func testEvalModule(t *testing.T, input string, modules *evaluator.Modules) object.Object {
+	t.Helper()
+
+	l := lexer.NewWithFilename("testdata/modules/main.monkey", input)
+	p := parser.New(l)
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		t.Fatalf("parser has %d errors: %v", len(p.Errors()), p.Errors())
+	}
+
+	return evaluator.EvalContext(context.Background(), program, object.NewEnvironment(), evaluator.Limits{}, evaluator.WithModules(modules))
+}
+
+func TestImportExpression(t *testing.T) {
+	tests := []struct {
+		input      string
+		searchPath []string
+		expected   interface{}
+	}{
+		{`let m = import "math.monkey"; m["square"](3)`, nil, 9},
+		{`(import "math.monkey")["pi"]`, nil, 3},
+		// パスは import したファイルからの相対パス
+		{`let c = import "lib/circle.monkey"; c["area"](2)`, nil, 12},
+		// 同じファイルは一度だけ評価する
+		{`let a = import "math.monkey"; let b = import "./math.monkey"; a["bump"](); b["bump"]()`, nil, 2},
+		{`let c = import "lib/circle.monkey"; let m = import "math.monkey"; c["math"] == m`, nil, true},
+		{`let u = import "util.monkey"; u["twice"](4)`, []string{"testdata/modules/path"}, 8},
+		{`import "util.monkey"`, nil, "module not found: util.monkey"},
+		{`import "missing.monkey"`, []string{"testdata/modules/path"}, "module not found: missing.monkey"},
+		{`(import "math.monkey")["_secret"]`, nil, "module has no exported member: _secret"},
+		{`(import "math.monkey")["cube"]`, nil, "module has no exported member: cube"},
+		{`(import "math.monkey")[0]`, nil, "module member name must be STRING, got INTEGER"},
+		{`(import "math.monkey")["square"] = 1`, nil, "index assignment not supported: MODULE"},
+		{`import "cycle_a.monkey"`, nil, "import cycle: testdata/modules/cycle_a.monkey -> testdata/modules/cycle_b.monkey -> testdata/modules/cycle_a.monkey"},
+		{`import "broken.monkey"`, nil, "cannot import broken.monkey: testdata/modules/broken.monkey:1:11: expected next token to be ), got ; instead"},
+		{`try { import "cycle_a.monkey" } catch (e) { e["kind"] }`, nil, "ImportError"},
+		// モジュールの関数が標準ライブラリの名前に代入すると、そのモジュールのグローバル変数になる
+		{`let m = import "prelude_names.monkey"; m["setMap"](); m["mapped"]()`, nil, "hijacked"},
+		{`let m = import "prelude_names.monkey"; m["setMap"](); map([1], fn(x) { x })[0]`, nil, 1},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEvalModule(t, tt.input, evaluator.NewModules(nil, tt.searchPath))
+
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case bool:
+			testBooleanObject(t, evaluated, expected)
+		case string:
+			if str, ok := evaluated.(*object.String); ok {
+				if str.Value != expected {
+					t.Errorf("wrong value for %q. expected=%q, got=%q", tt.input, expected, str.Value)
+				}
+				continue
+			}
+			errObj, ok := evaluated.(*object.Error)
+			if !ok {
+				t.Errorf("no error object returned for %q. got=%T (%+v)", tt.input, evaluated, evaluated)
+				continue
+			}
+			if errObj.Message != expected {
+				t.Errorf("wrong error message for %q. expected=%q, got=%q", tt.input, expected, errObj.Message)
+			}
+		}
+	}
+}
+
+func TestModulesCache(t *testing.T) {
+	modules := evaluator.NewModules(nil, nil)
+
+	// 評価をまたいでも同じ Modules なら評価済みのモジュールを使う
+	for i := int64(1); i <= 3; i++ {
+		evaluated := testEvalModule(t, `(import "math.monkey")["bump"]()`, modules)
+		testIntegerObject(t, evaluated, i)
+	}
+
+	// 評価中にエラーになったモジュールはキャッシュしない
+	for i := 0; i < 2; i++ {
+		evaluated := testEvalModule(t, `import "fails.monkey"`, modules)
+		if _, ok := evaluated.(*object.Error); !ok {
+			t.Fatalf("no error object returned. got=%T (%+v)", evaluated, evaluated)
+		}
+	}
+}
+
+func TestImportStackTrace(t *testing.T) {
+	evaluated := testEvalModule(t, "let x = 1;\nimport \"fails.monkey\"", evaluator.NewModules(nil, nil))
+	errObj, ok := evaluated.(*object.Error)
+	if !ok {
+		t.Fatalf("no error object returned. got=%T (%+v)", evaluated, evaluated)
+	}
+
+	expected := `ERROR: type mismatch: INTEGER + BOOLEAN
+
+check(...)
+	testdata/modules/fails.monkey:1:21
+<module testdata/modules/fails.monkey>(...)
+	testdata/modules/fails.monkey:2:14
+<main>
+	testdata/modules/main.monkey:2:1
+`
+	if errObj.StackTrace() != expected {
+		t.Errorf("wrong stack trace.\nexpected=\n%s\ngot=\n%s", expected, errObj.StackTrace())
+	}
+}
+
+// 標準ライブラリのテストはMonkeyで書いてある
+func TestPrelude(t *testing.T) {
+	input, err := ioutil.ReadFile("testdata/prelude_test.monkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	evaluated := testEval(t, string(input))
+	if err, ok := evaluated.(*object.Error); ok {
+		value := "null"
+		if err.Value != nil {
+			value = err.Value.Inspect()
+		}
+		t.Fatalf("%s\n%s", err.StackTrace(), value)
+	}
+	if str, ok := evaluated.(*object.String); !ok || str.Value != "ok" {
+		t.Errorf("prelude tests did not finish. got=%T (%+v)", evaluated, evaluated)
+	}
+}
+
+// 結果を伸ばすたびに配列全体を複製すると、この大きさでは終わらない
+func TestPreludeLargeInputs(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping in short mode")
+	}
+
+	tests := []struct {
+		input    string
+		expected int64
+	}{
+		{"len(range(100000))", 100000},
+		{"len(map(range(100000), fn(x) { x }))", 100000},
+		{"len(filter(range(100000), fn(x) { x % 2 == 0 }))", 50000},
+		{"let xs = range(100000); len(zip(xs, xs))", 100000},
+		{"let xs = range(100000); len(flatten(zip(xs, xs)))", 200000},
+		{"len(uniq(map(range(100000), fn(x) { x % 1000 })))", 1000},
+		{"sortBy(range(100000), fn(x) { -x })[0]", 99999},
+	}
+
+	for _, tt := range tests {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		program := parser.New(lexer.New(tt.input)).ParseProgram()
+		evaluated := evaluator.EvalContext(ctx, program, object.NewEnvironment(), evaluator.Limits{})
+		cancel()
+
+		if err, ok := evaluated.(*object.Error); ok {
+			t.Errorf("%s: %s", tt.input, err.Message)
+			continue
+		}
 		testIntegerObject(t, evaluated, tt.expected)
 	}
 }
+
+func TestWithoutPrelude(t *testing.T) {
+	program := parser.New(lexer.New(`map([1], fn(x) { x })`)).ParseProgram()
+
+	evaluated := evaluator.EvalContext(context.Background(), program, object.NewEnvironment(), evaluator.Limits{}, evaluator.WithoutPrelude())
+	errObj, ok := evaluated.(*object.Error)
+	if !ok {
+		t.Fatalf("no error object returned. got=%T (%+v)", evaluated, evaluated)
+	}
+	if errObj.Message != "identifier not found: map" {
+		t.Errorf("wrong error message. got=%q", errObj.Message)
+	}
+}
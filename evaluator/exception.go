@@ -0,0 +1,156 @@
+package evaluator
+
+import (
+	"monkey/ast"
+	"monkey/object"
+	"strings"
+)
+
+// 実行時エラーの種類。メッセージの先頭で判別する
+var errorKinds = []struct {
+	prefix string
+	kind   string
+}{
+	{"type mismatch", "TypeError"},
+	{"unknown operator", "TypeError"},
+	{"not a function", "TypeError"},
+	{"unusable as hash key", "TypeError"},
+	{"index operator not supported", "TypeError"},
+	{"index assignment not supported", "TypeError"},
+	{"slice operator not supported", "TypeError"},
+	{"slice index must be", "TypeError"},
+	{"cannot iterate over", "TypeError"},
+	{"argument to", "TypeError"},
+	{"module member name must be", "TypeError"},
+	{"identifier not found", "NameError"},
+	{"module has no exported member", "NameError"},
+	{"module not found", "ImportError"},
+	{"import cycle", "ImportError"},
+	{"cannot import", "ImportError"},
+	{"wrong number of arguments", "ArgumentError"},
+	{"string too long", "ArgumentError"},
+	{"division by zero", "ZeroDivisionError"},
+	{"index out of range", "IndexError"},
+	{"maximum recursion depth exceeded", "RecursionError"},
+	{"stack overflow", "RecursionError"},
+}
+
+// throw で種類を指定しなかったエラーの種類
+const defaultErrorKind = "Error"
+
+// エラーの種類。throw で指定されていればそれを、実行時エラーならメッセージから決めた種類を返す
+func ErrorKind(err *object.Error) string {
+	if err.Kind != "" {
+		return err.Kind
+	}
+	for _, k := range errorKinds {
+		if strings.HasPrefix(err.Message, k.prefix) {
+			return k.kind
+		}
+	}
+	return defaultErrorKind
+}
+
+// throw された値からエラーを作る。文字列はそのままメッセージになり、
+// 文字列の message (と kind) を持つハッシュはその値を使う。捕捉したエラーを投げ直す場合もこれにあたる
+func newThrownError(value object.Object) *object.Error {
+	err := &object.Error{Message: value.Inspect(), Kind: defaultErrorKind, Value: value}
+
+	switch value := value.(type) {
+	case *object.String:
+		err.Message = value.Value
+	case *object.Hash:
+		if message, ok := hashString(value, "message"); ok {
+			err.Message = message
+			if kind, ok := hashString(value, "kind"); ok {
+				err.Kind = kind
+			}
+		}
+	}
+
+	return err
+}
+
+func hashString(hash *object.Hash, key string) (string, bool) {
+	pair, ok := hash.Pairs[(&object.String{Value: key}).HashKey()]
+	if !ok {
+		return "", false
+	}
+	str, ok := pair.Value.(*object.String)
+	if !ok {
+		return "", false
+	}
+	return str.Value, true
+}
+
+// 捕捉したエラーをスクリプトから扱える値にする。次のキーを持つハッシュになる
+//
+//	message: エラーメッセージ
+//	kind:    エラーの種類 (TypeError など。throw したものは既定で Error)
+//	stack:   内側の関数から順に "関数名 at 位置" を並べた配列。最後は <main>
+//	value:   throw された値。実行時エラーではnull
+//
+// err.Stack は <main> まで揃っている必要がある
+func ErrorValue(err *object.Error) object.Object {
+	stack := []object.Object{}
+	pos := err.Pos
+	for _, frame := range err.Stack {
+		stack = append(stack, &object.String{Value: frame.Function + " at " + pos.String()})
+		pos = frame.CallSite
+	}
+	stack = append(stack, &object.String{Value: "<main> at " + pos.String()})
+
+	var value object.Object = NULL
+	if err.Value != nil {
+		value = err.Value
+	}
+
+	pairs := map[object.HashKey]object.HashPair{}
+	set := func(key string, value object.Object) {
+		k := &object.String{Value: key}
+		pairs[k.HashKey()] = object.HashPair{Key: k, Value: value}
+	}
+	set("message", &object.String{Value: err.Message})
+	set("kind", &object.String{Value: ErrorKind(err)})
+	set("stack", &object.Array{Elements: stack})
+	set("value", value)
+
+	return &object.Hash{Pairs: pairs}
+}
+
+// VMと共有する
+func NewThrownError(value object.Object) *object.Error {
+	return newThrownError(value)
+}
+
+// catch は評価の打ち切り以外のエラーを捕捉する。finally はエラーや return/break/continue で
+// 抜ける場合も実行するが、評価を打ち切った場合は実行しない。
+// finally でエラーが起きればそれが結果になり、それ以外の finally の値は捨てる
+func (ev *evaluation) evalTryExpression(node *ast.TryExpression, env *object.Environment) object.Object {
+	result := ev.Eval(node.Block, env)
+
+	if err, ok := result.(*object.Error); ok && err.Cause == nil && node.Catch != nil {
+		// 捕捉した位置より外側のフレームを補う
+		for i := len(ev.calls) - 1; i >= 0; i-- {
+			err.PushFrame(ev.calls[i].Function, ev.calls[i].CallSite)
+		}
+
+		catchEnv := object.NewEnclosedEnvironment(env)
+		catchEnv.Set(node.Param.Value, ErrorValue(err))
+		result = ev.Eval(node.Catch, catchEnv)
+	}
+
+	if node.Finally != nil {
+		if err, ok := result.(*object.Error); ok && err.Cause != nil {
+			return result
+		}
+		if finally := ev.Eval(node.Finally, env); isError(finally) {
+			return finally
+		}
+	}
+
+	if result == nil {
+		return NULL
+	}
+	return result
+}
@@ -0,0 +1,163 @@
+package evaluator
+
+import (
+	"io/ioutil"
+	"monkey/ast"
+	"monkey/lexer"
+	"monkey/object"
+	"monkey/parser"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// import で読み込んだモジュールを管理する。同じファイルは一度だけ評価し、その環境を使い回す。
+// 1つの Modules を複数のgoroutineから同時に使ってはいけない
+type Modules struct {
+	builtins   *object.Environment
+	searchPath []string
+	cache      map[string]*object.Module // 絶対パスごとの評価済みのモジュール
+	loading    []loadingModule           // 評価中のモジュール。import の順に並ぶ
+	prelude    *object.Module            // builtins を使って評価した標準ライブラリ
+}
+
+type loadingModule struct {
+	path string // 絶対パス
+	name string // エラーメッセージに使う名前
+}
+
+// builtins はモジュールと標準ライブラリのトップレベルの環境の外側になる。nilなら既定の組み込み関数を使う。
+// import のパスは、import したファイルのディレクトリ(ファイル名が無ければカレントディレクトリ)、
+// searchPath のディレクトリの順に探す
+func NewModules(builtins *object.Environment, searchPath []string) *Modules {
+	return &Modules{
+		builtins:   builtins,
+		searchPath: searchPath,
+		cache:      map[string]*object.Module{},
+	}
+}
+
+// EvalContext と ApplyFunctionContext の追加の設定
+type Option func(*evaluation)
+
+// import で使うモジュールの管理。指定しなければ評価ごとに新しく作るので、
+// 評価をまたいでモジュールを使い回すには同じ Modules を渡す
+func WithModules(m *Modules) Option {
+	return func(ev *evaluation) { ev.modules = m }
+}
+
+// 関数を定義したプログラムのトップレベルの環境。ApplyFunctionContext で EvalContext の env と同じものを渡す
+func WithGlobals(env *object.Environment) Option {
+	return func(ev *evaluation) { ev.globals = env }
+}
+
+// パスを解決し、表示用の名前と絶対パスを返す
+func (m *Modules) resolve(path, importer string) (string, string, bool) {
+	var candidates []string
+	if filepath.IsAbs(path) {
+		candidates = []string{path}
+	} else {
+		dir := "."
+		if importer != "" {
+			dir = filepath.Dir(importer)
+		}
+		candidates = append(candidates, filepath.Join(dir, path))
+		for _, dir := range m.searchPath {
+			candidates = append(candidates, filepath.Join(dir, path))
+		}
+	}
+
+	for _, name := range candidates {
+		info, err := os.Stat(name)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		abs, err := filepath.Abs(name)
+		if err != nil {
+			continue
+		}
+		return name, abs, true
+	}
+	return "", "", false
+}
+
+func (m *Modules) cycle(path string) ([]string, bool) {
+	for i, loading := range m.loading {
+		if loading.path != path {
+			continue
+		}
+		var names []string
+		for _, l := range m.loading[i:] {
+			names = append(names, l.name)
+		}
+		return append(names, loading.name), true
+	}
+	return nil, false
+}
+
+// モジュールはそれぞれ独立したトップレベルの環境で評価する。
+// 評価中のエラーは import した位置をスタックトレースに加えて返し、キャッシュしない
+func (ev *evaluation) evalImportExpression(node *ast.ImportExpression) object.Object {
+	if ev.modules == nil {
+		ev.modules = NewModules(nil, nil)
+	}
+	m := ev.modules
+
+	name, path, ok := m.resolve(node.Path.Value, node.Pos().Filename)
+	if !ok {
+		return newError("module not found: %s", node.Path.Value)
+	}
+	if module, ok := m.cache[path]; ok {
+		return module
+	}
+	if cycle, ok := m.cycle(path); ok {
+		return newError("import cycle: %s", strings.Join(cycle, " -> "))
+	}
+
+	source, err := ioutil.ReadFile(path)
+	if err != nil {
+		return newError("cannot import %s: %s", node.Path.Value, err)
+	}
+	p := parser.New(lexer.NewWithFilename(name, string(source)))
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		return newError("cannot import %s: %s", node.Path.Value, strings.Join(p.Errors(), "; "))
+	}
+
+	env := object.NewEnvironment()
+	if m.builtins != nil {
+		env = object.NewEnclosedEnvironment(m.builtins)
+	}
+
+	frame := "<module " + name + ">"
+	globals := ev.globals
+	m.loading = append(m.loading, loadingModule{path: path, name: name})
+	ev.calls = append(ev.calls, object.StackFrame{Function: frame, CallSite: node.Pos()})
+	ev.globals = env
+	result := ev.evalProgram(program.Statements, env)
+	ev.globals = globals
+	ev.calls = ev.calls[:len(ev.calls)-1]
+	m.loading = m.loading[:len(m.loading)-1]
+
+	if err, ok := result.(*object.Error); ok {
+		err.PushFrame(frame, node.Pos())
+		return err
+	}
+
+	module := &object.Module{Path: path, Env: env}
+	m.cache[path] = module
+	return module
+}
+
+func evalModuleIndexExpression(module, index object.Object) object.Object {
+	name, ok := index.(*object.String)
+	if !ok {
+		return newError("module member name must be STRING, got %s", index.Type())
+	}
+
+	value, ok := module.(*object.Module).Member(name.Value)
+	if !ok {
+		return newError("module has no exported member: %s", name.Value)
+	}
+	return value
+}
@@ -0,0 +1,108 @@
+package evaluator
+
+import (
+	"context"
+	_ "embed"
+	"monkey/ast"
+	"monkey/lexer"
+	"monkey/object"
+	"monkey/parser"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Monkeyで書いた標準ライブラリ(map, filter, reduce など)
+//
+//go:embed prelude.monkey
+var PreludeSource string
+
+// 標準ライブラリのファイル名。エラーの位置に使う
+const PreludeFilename = "prelude.monkey"
+
+var (
+	preludeOnce    sync.Once
+	preludeProgram *ast.Program
+
+	defaultPreludeOnce sync.Once
+	defaultPrelude     *object.Module
+)
+
+func parsePrelude() *ast.Program {
+	preludeOnce.Do(func() {
+		p := parser.New(lexer.NewWithFilename(PreludeFilename, PreludeSource))
+		preludeProgram = p.ParseProgram()
+		if len(p.Errors()) != 0 {
+			panic("prelude: " + strings.Join(p.Errors(), "; "))
+		}
+	})
+	return preludeProgram
+}
+
+// 標準ライブラリを評価する。標準ライブラリの中で使う組み込み関数は builtins から探すので、
+// インタプリタごとに登録した組み込み関数や出力先が使われる。builtins が nil なら既定の組み込み関数を使う
+func evalPrelude(builtins *object.Environment) *object.Module {
+	env := object.NewEnvironment()
+	if builtins != nil {
+		env = object.NewEnclosedEnvironment(builtins)
+	}
+
+	ev := newEvaluation(context.Background(), Limits{}, []Option{WithoutPrelude()})
+	if err, ok := ev.Eval(parsePrelude(), env).(*object.Error); ok {
+		panic("prelude: " + err.Message)
+	}
+	return &object.Module{Path: PreludeFilename, Env: env}
+}
+
+// 既定の組み込み関数を使う標準ライブラリ。最初に使うときに一度だけ評価し、共有する
+func loadDefaultPrelude() *object.Module {
+	defaultPreludeOnce.Do(func() {
+		defaultPrelude = evalPrelude(nil)
+	})
+	return defaultPrelude
+}
+
+// モジュールと同じ組み込み関数を使う標準ライブラリ。最初に使うときに評価する
+func (m *Modules) loadPrelude() *object.Module {
+	if m.prelude == nil {
+		if m.builtins == nil {
+			m.prelude = loadDefaultPrelude()
+		} else {
+			m.prelude = evalPrelude(m.builtins)
+		}
+	}
+	return m.prelude
+}
+
+// 標準ライブラリを使わずに評価する
+func WithoutPrelude() Option {
+	return func(ev *evaluation) { ev.noPrelude = true }
+}
+
+// 標準ライブラリで公開している名前。ソート済み
+func PreludeNames() []string {
+	prelude := loadDefaultPrelude()
+
+	var names []string
+	for _, stmt := range parsePrelude().Statements {
+		let, ok := stmt.(*ast.LetStatement)
+		if !ok {
+			continue
+		}
+		if _, ok := prelude.Member(let.Name.Value); ok {
+			names = append(names, let.Name.Value)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (ev *evaluation) lookupPrelude(name string) (object.Object, bool) {
+	if ev.noPrelude {
+		return nil, false
+	}
+	if ev.modules == nil {
+		return loadDefaultPrelude().Member(name)
+	}
+	return ev.modules.loadPrelude().Member(name)
+}
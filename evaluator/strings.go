@@ -0,0 +1,347 @@
+package evaluator
+
+import (
+	"fmt"
+	"monkey/object"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// 文字列を扱う組み込み関数。位置と長さはバイトではなく文字(コードポイント)で数える
+var stringBuiltins = map[string]object.BuiltinFunction{
+	"split":      builtinSplit,
+	"join":       builtinJoin,
+	"trim":       newBuiltinTrim("trim", strings.TrimSpace, strings.Trim),
+	"trimLeft":   newBuiltinTrim("trimLeft", trimLeftSpace, strings.TrimLeft),
+	"trimRight":  newBuiltinTrim("trimRight", trimRightSpace, strings.TrimRight),
+	"upper":      newBuiltinStringMap("upper", strings.ToUpper),
+	"lower":      newBuiltinStringMap("lower", strings.ToLower),
+	"contains":   newBuiltinStringTest("contains", strings.Contains),
+	"startsWith": newBuiltinStringTest("startsWith", strings.HasPrefix),
+	"endsWith":   newBuiltinStringTest("endsWith", strings.HasSuffix),
+	"indexOf":    builtinIndexOf,
+	"replace":    builtinReplace,
+	"repeat":     builtinRepeat,
+	"substr":     builtinSubstr,
+	"chars":      builtinChars,
+	"format":     newBuiltinFormat("format"),
+	"sprintf":    newBuiltinFormat("sprintf"),
+}
+
+// repeat, replace, join が作る文字列の長さ(バイト数)の上限。入力より長い文字列を作れるこれらの関数は、
+// 超えるとGoのパニックやメモリ不足でプロセスごと止まるので、作る前に長さを見積もってエラーにする。
+// format の幅指定などは対象外
+const MaxStringLen = 1 << 30
+
+func stringTooLong(name string) *object.Error {
+	return newError("string too long: `%s` result would exceed %d bytes", name, MaxStringLen)
+}
+
+func stringArg(name string, arg object.Object) (string, *object.Error) {
+	str, ok := arg.(*object.String)
+	if !ok {
+		return "", newError("argument to `%s` must be STRING, got %s", name, arg.Type())
+	}
+	return str.Value, nil
+}
+
+func integerArg(name string, arg object.Object) (int64, *object.Error) {
+	integer, ok := arg.(*object.Integer)
+	if !ok {
+		return 0, newError("argument to `%s` must be INTEGER, got %s", name, arg.Type())
+	}
+	return integer.Value, nil
+}
+
+// 引数をすべて文字列として受け取る
+func stringArgs(name string, args []object.Object) ([]string, *object.Error) {
+	strs := make([]string, len(args))
+	for i, arg := range args {
+		str, err := stringArg(name, arg)
+		if err != nil {
+			return nil, err
+		}
+		strs[i] = str
+	}
+	return strs, nil
+}
+
+func stringArray(strs []string) *object.Array {
+	elements := make([]object.Object, len(strs))
+	for i, s := range strs {
+		elements[i] = &object.String{Value: s}
+	}
+	return &object.Array{Elements: elements}
+}
+
+// split(s) は空白で、split(s, sep) は sep で区切る。sep が空文字列なら1文字ずつに分ける
+func builtinSplit(args ...object.Object) object.Object {
+	if err := CheckArgumentCount(1, 2, len(args)); err != nil {
+		return err
+	}
+	strs, err := stringArgs("split", args)
+	if err != nil {
+		return err
+	}
+
+	if len(strs) == 1 {
+		return stringArray(strings.Fields(strs[0]))
+	}
+	return stringArray(strings.Split(strs[0], strs[1]))
+}
+
+// join(arr) は要素をそのまま、join(arr, sep) は sep を挟んでつなげる
+func builtinJoin(args ...object.Object) object.Object {
+	if err := CheckArgumentCount(1, 2, len(args)); err != nil {
+		return err
+	}
+
+	arr, ok := args[0].(*object.Array)
+	if !ok {
+		return newError("argument to `join` must be ARRAY, got %s", args[0].Type())
+	}
+	sep := ""
+	if len(args) == 2 {
+		var err *object.Error
+		if sep, err = stringArg("join", args[1]); err != nil {
+			return err
+		}
+	}
+
+	elements := make([]string, len(arr.Elements))
+	var size int64
+	for i, e := range arr.Elements {
+		str, ok := e.(*object.String)
+		if !ok {
+			return newError("argument to `join` must be ARRAY of STRING, got %s element", e.Type())
+		}
+		elements[i] = str.Value
+
+		size += int64(len(str.Value))
+		if i > 0 {
+			size += int64(len(sep))
+		}
+		if size > MaxStringLen {
+			return stringTooLong("join")
+		}
+	}
+
+	return &object.String{Value: strings.Join(elements, sep)}
+}
+
+func trimLeftSpace(s string) string  { return strings.TrimLeftFunc(s, unicode.IsSpace) }
+func trimRightSpace(s string) string { return strings.TrimRightFunc(s, unicode.IsSpace) }
+
+// 引数が1つなら空白を、2つなら2つ目の文字列に含まれる文字を取り除く
+func newBuiltinTrim(name string, space func(string) string, cutset func(string, string) string) object.BuiltinFunction {
+	return func(args ...object.Object) object.Object {
+		if err := CheckArgumentCount(1, 2, len(args)); err != nil {
+			return err
+		}
+		strs, err := stringArgs(name, args)
+		if err != nil {
+			return err
+		}
+
+		if len(strs) == 1 {
+			return &object.String{Value: space(strs[0])}
+		}
+		return &object.String{Value: cutset(strs[0], strs[1])}
+	}
+}
+
+func newBuiltinStringMap(name string, f func(string) string) object.BuiltinFunction {
+	return func(args ...object.Object) object.Object {
+		if err := CheckArgumentCount(1, 1, len(args)); err != nil {
+			return err
+		}
+		s, err := stringArg(name, args[0])
+		if err != nil {
+			return err
+		}
+		return &object.String{Value: f(s)}
+	}
+}
+
+func newBuiltinStringTest(name string, f func(string, string) bool) object.BuiltinFunction {
+	return func(args ...object.Object) object.Object {
+		if err := CheckArgumentCount(2, 2, len(args)); err != nil {
+			return err
+		}
+		strs, err := stringArgs(name, args)
+		if err != nil {
+			return err
+		}
+		return nativeBoolToBooleanObject(f(strs[0], strs[1]))
+	}
+}
+
+// 最初に現れる位置(文字単位)。無ければ -1
+func builtinIndexOf(args ...object.Object) object.Object {
+	if err := CheckArgumentCount(2, 2, len(args)); err != nil {
+		return err
+	}
+	strs, err := stringArgs("indexOf", args)
+	if err != nil {
+		return err
+	}
+
+	i := strings.Index(strs[0], strs[1])
+	if i < 0 {
+		return &object.Integer{Value: -1}
+	}
+	return &object.Integer{Value: int64(utf8.RuneCountInString(strs[0][:i]))}
+}
+
+// replace(s, old, new) はすべて、replace(s, old, new, n) は先頭から n 個置き換える
+func builtinReplace(args ...object.Object) object.Object {
+	if err := CheckArgumentCount(3, 4, len(args)); err != nil {
+		return err
+	}
+	strs, err := stringArgs("replace", args[:3])
+	if err != nil {
+		return err
+	}
+
+	n := int64(-1)
+	if len(args) == 4 {
+		if n, err = integerArg("replace", args[3]); err != nil {
+			return err
+		}
+	}
+
+	// 置き換える数から長さを見積もる。old が空文字列なら文字の間すべてに挿入する
+	if grow := int64(len(strs[2]) - len(strs[1])); grow > 0 {
+		count := int64(strings.Count(strs[0], strs[1]))
+		if n >= 0 && n < count {
+			count = n
+		}
+		if count > (MaxStringLen-int64(len(strs[0])))/grow {
+			return stringTooLong("replace")
+		}
+	}
+
+	return &object.String{Value: strings.Replace(strs[0], strs[1], strs[2], int(n))}
+}
+
+func builtinRepeat(args ...object.Object) object.Object {
+	if err := CheckArgumentCount(2, 2, len(args)); err != nil {
+		return err
+	}
+	s, err := stringArg("repeat", args[0])
+	if err != nil {
+		return err
+	}
+	count, err := integerArg("repeat", args[1])
+	if err != nil {
+		return err
+	}
+	if count < 0 {
+		return newError("argument to `repeat` must not be negative, got %d", count)
+	}
+	if count > 0 && int64(len(s)) > MaxStringLen/count {
+		return stringTooLong("repeat")
+	}
+
+	return &object.String{Value: strings.Repeat(s, int(count))}
+}
+
+// substr(s, start) は start から最後まで、substr(s, start, length) は length 文字を返す。
+// start が負なら末尾から数える。範囲からはみ出した部分は切り詰める
+func builtinSubstr(args ...object.Object) object.Object {
+	if err := CheckArgumentCount(2, 3, len(args)); err != nil {
+		return err
+	}
+	s, err := stringArg("substr", args[0])
+	if err != nil {
+		return err
+	}
+	start, err := integerArg("substr", args[1])
+	if err != nil {
+		return err
+	}
+
+	runes := []rune(s)
+	size := int64(len(runes))
+	if start < 0 {
+		start += size
+	}
+	start = clamp(start, 0, size)
+
+	end := size
+	if len(args) == 3 {
+		length, err := integerArg("substr", args[2])
+		if err != nil {
+			return err
+		}
+		if length < 0 {
+			return newError("argument to `substr` must not be negative, got %d", length)
+		}
+		end = clamp(start+length, start, size)
+	}
+
+	return &object.String{Value: string(runes[start:end])}
+}
+
+func clamp(n, min, max int64) int64 {
+	if n < min {
+		return min
+	}
+	if n > max {
+		return max
+	}
+	return n
+}
+
+// 1文字ずつの文字列の配列
+func builtinChars(args ...object.Object) object.Object {
+	if err := CheckArgumentCount(1, 1, len(args)); err != nil {
+		return err
+	}
+	s, err := stringArg("chars", args[0])
+	if err != nil {
+		return err
+	}
+
+	var chars []string
+	for _, r := range s {
+		chars = append(chars, string(r))
+	}
+	return stringArray(chars)
+}
+
+// Goの fmt.Sprintf と同じ書式で文字列を作る。整数・浮動小数点数・文字列・真偽値は
+// Goの値として渡し、それ以外の値は表示用の文字列 (Inspect) として渡す
+func newBuiltinFormat(name string) object.BuiltinFunction {
+	return func(args ...object.Object) object.Object {
+		if err := CheckArgumentCount(1, -1, len(args)); err != nil {
+			return err
+		}
+		format, err := stringArg(name, args[0])
+		if err != nil {
+			return err
+		}
+
+		values := make([]interface{}, len(args)-1)
+		for i, arg := range args[1:] {
+			values[i] = formatValue(arg)
+		}
+		return &object.String{Value: fmt.Sprintf(format, values...)}
+	}
+}
+
+func formatValue(obj object.Object) interface{} {
+	switch obj := obj.(type) {
+	case *object.Integer:
+		return obj.Value
+	case *object.Float:
+		return obj.Value
+	case *object.String:
+		return obj.Value
+	case *object.Boolean:
+		return obj.Value
+	default:
+		return obj.Inspect()
+	}
+}
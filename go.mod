@@ -1,3 +1,3 @@
 module monkey
 
-go 1.14
+go 1.16
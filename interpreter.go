@@ -0,0 +1,164 @@
+// Package monkey はGoのプログラムにMonkeyのインタプリタを組み込むためのAPIを提供する。
+//
+//	interp := monkey.New(monkey.WithStdout(&buf))
+//	interp.SetGlobal("name", &object.String{Value: "monkey"})
+//	result, err := interp.Run(ctx, `puts("hello " + name)`)
+//
+// Interpreter はそれぞれ独立したグローバル変数と組み込み関数を持つので、
+// 複数のインタプリタを並べて使える。1つの Interpreter を複数のgoroutineから同時に使ってはいけない
+package monkey
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"monkey/evaluator"
+	"monkey/lexer"
+	"monkey/object"
+	"monkey/parser"
+	"os"
+	"strings"
+)
+
+type Interpreter struct {
+	builtins *object.Environment // 組み込み関数。グローバル変数の外側の環境
+	globals  *object.Environment
+
+	stdout io.Writer
+	stdin  io.Reader
+	limits evaluator.Limits
+
+	searchPath []string
+	modules    *evaluator.Modules // import したモジュール。Run をまたいで使い回す
+	noPrelude  bool
+}
+
+type Option func(*Interpreter)
+
+// puts の出力先
+func WithStdout(w io.Writer) Option {
+	return func(i *Interpreter) { i.stdout = w }
+}
+
+// gets の入力元
+func WithStdin(r io.Reader) Option {
+	return func(i *Interpreter) { i.stdin = r }
+}
+
+// Run や Call で実行できるステップ数の上限。ループの1回と関数呼び出し1回(組み込み関数も含む)が1ステップ。
+// 組み込み関数が返した文字列は evaluator.StringStepBytes バイトごとにさらに1ステップと数える
+func WithMaxSteps(n int64) Option {
+	return func(i *Interpreter) { i.limits.MaxSteps = n }
+}
+
+// 関数呼び出しの深さの上限。指定しなければ evaluator.DefaultMaxDepth
+func WithMaxDepth(n int) Option {
+	return func(i *Interpreter) { i.limits.MaxDepth = n }
+}
+
+// import するファイルを探すディレクトリ。Run で評価するソースにはファイル名が無いので、
+// まずカレントディレクトリから探し、無ければ dirs から順に探す
+func WithSearchPath(dirs ...string) Option {
+	return func(i *Interpreter) { i.searchPath = append(i.searchPath, dirs...) }
+}
+
+// 標準ライブラリ(map, filter など)を使わない
+func WithoutPrelude() Option {
+	return func(i *Interpreter) { i.noPrelude = true }
+}
+
+func New(opts ...Option) *Interpreter {
+	i := &Interpreter{
+		stdout: os.Stdout,
+		stdin:  os.Stdin,
+	}
+	for _, opt := range opts {
+		opt(i)
+	}
+
+	i.builtins = object.NewEnvironment()
+	for name, builtin := range evaluator.NewBuiltins(i.stdout, i.stdin) {
+		i.builtins.Set(name, builtin)
+	}
+	i.globals = object.NewEnclosedEnvironment(i.builtins)
+	i.modules = evaluator.NewModules(i.builtins, i.searchPath)
+
+	return i
+}
+
+// 構文エラー
+type ParseError struct {
+	Errors []string
+}
+
+func (e *ParseError) Error() string {
+	return "parse error: " + strings.Join(e.Errors, "; ")
+}
+
+// src を評価して最後の文の値を返す。値の無い文(letなど)で終わればnilを返す。
+// 構文エラーは *ParseError、実行時エラーは *object.Error として返す。
+// ctx が終了するかステップ数が上限を超えると評価を打ち切る。その場合のエラーは
+// errors.Is で evaluator.ErrTimeout などと判別できる。組み込み関数の実行中は打ち切れないので、
+// RegisterBuiltin で登録する関数では長くかかる処理を避ける
+func (i *Interpreter) Run(ctx context.Context, src string) (object.Object, error) {
+	if err := evaluator.CheckContext(ctx); err != nil {
+		return nil, err
+	}
+
+	l := lexer.New(src)
+	p := parser.New(l)
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		return nil, &ParseError{Errors: p.Errors()}
+	}
+
+	return result(evaluator.EvalContext(ctx, program, i.globals, i.limits, i.evalOptions()...))
+}
+
+// グローバル変数に束縛された関数を呼び出す
+func (i *Interpreter) Call(fnName string, args ...object.Object) (object.Object, error) {
+	return i.CallContext(context.Background(), fnName, args...)
+}
+
+func (i *Interpreter) CallContext(ctx context.Context, fnName string, args ...object.Object) (object.Object, error) {
+	fn, ok := i.globals.Get(fnName)
+	if !ok {
+		return nil, fmt.Errorf("function not found: %s", fnName)
+	}
+
+	switch fn.(type) {
+	case *object.Function, *object.Builtin:
+		opts := append(i.evalOptions(), evaluator.WithGlobals(i.globals))
+		return result(evaluator.ApplyFunctionContext(ctx, fn, args, i.limits, opts...))
+	default:
+		return nil, fmt.Errorf("not a function: %s is %s", fnName, fn.Type())
+	}
+}
+
+func (i *Interpreter) SetGlobal(name string, value object.Object) {
+	i.globals.Set(name, value)
+}
+
+func (i *Interpreter) GetGlobal(name string) (object.Object, bool) {
+	return i.globals.Get(name)
+}
+
+// このインタプリタだけで使える組み込み関数を登録する。同じ名前の組み込み関数は置き換える
+func (i *Interpreter) RegisterBuiltin(name string, fn object.BuiltinFunction) {
+	i.builtins.Set(name, &object.Builtin{Name: name, Fn: fn})
+}
+
+func (i *Interpreter) evalOptions() []evaluator.Option {
+	opts := []evaluator.Option{evaluator.WithModules(i.modules)}
+	if i.noPrelude {
+		opts = append(opts, evaluator.WithoutPrelude())
+	}
+	return opts
+}
+
+func result(obj object.Object) (object.Object, error) {
+	if err, ok := obj.(*object.Error); ok {
+		return nil, err
+	}
+	return obj, nil
+}
@@ -0,0 +1,334 @@
+package monkey
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"monkey/evaluator"
+	"monkey/object"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRun(t *testing.T) {
+	interp := New()
+
+	result, err := interp.Run(context.Background(), "let a = 2; a * 3")
+	if err != nil {
+		t.Fatalf("Run failed: %s", err)
+	}
+	testInteger(t, result, 6)
+
+	// グローバル変数は次の Run に引き継がれる
+	result, err = interp.Run(context.Background(), "a + 1")
+	if err != nil {
+		t.Fatalf("Run failed: %s", err)
+	}
+	testInteger(t, result, 3)
+
+	result, err = interp.Run(context.Background(), "let b = 1;")
+	if err != nil || result != nil {
+		t.Errorf("let should have no value. got=%v, err=%v", result, err)
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	interp := New()
+
+	_, err := interp.Run(context.Background(), "let = 1")
+	if _, ok := err.(*ParseError); !ok {
+		t.Errorf("error is not *ParseError. got=%T (%v)", err, err)
+	}
+
+	_, err = interp.Run(context.Background(), "1 + true")
+	rtErr, ok := err.(*object.Error)
+	if !ok {
+		t.Fatalf("error is not *object.Error. got=%T (%v)", err, err)
+	}
+	if rtErr.Message != "type mismatch: INTEGER + BOOLEAN" {
+		t.Errorf("wrong error message. got=%q", rtErr.Message)
+	}
+
+	// throw された値とその種類もGoから参照できる
+	_, err = interp.Run(context.Background(), `throw {"message": "bad record", "kind": "ValueError", "id": 3}`)
+	rtErr, ok = err.(*object.Error)
+	if !ok {
+		t.Fatalf("error is not *object.Error. got=%T (%v)", err, err)
+	}
+	if rtErr.Message != "bad record" || rtErr.Kind != "ValueError" {
+		t.Errorf("wrong error. got=%q (%s)", rtErr.Message, rtErr.Kind)
+	}
+	if _, ok := rtErr.Value.(*object.Hash); !ok {
+		t.Errorf("error value is not *object.Hash. got=%T", rtErr.Value)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := interp.Run(ctx, "1"); !errors.Is(err, evaluator.ErrCancelled) {
+		t.Errorf("expected cancelled. got=%v", err)
+	}
+}
+
+func TestCall(t *testing.T) {
+	interp := New()
+	if _, err := interp.Run(context.Background(), "let add = fn(a, b) { a + b }; let one = 1;"); err != nil {
+		t.Fatalf("Run failed: %s", err)
+	}
+
+	result, err := interp.Call("add", &object.Integer{Value: 1}, &object.Integer{Value: 2})
+	if err != nil {
+		t.Fatalf("Call failed: %s", err)
+	}
+	testInteger(t, result, 3)
+
+	if _, err := interp.Call("add", &object.Integer{Value: 1}, &object.String{Value: "x"}); err == nil {
+		t.Errorf("expected runtime error")
+	}
+	if _, err := interp.Call("missing"); err == nil || err.Error() != "function not found: missing" {
+		t.Errorf("wrong error. got=%v", err)
+	}
+	if _, err := interp.Call("one"); err == nil || err.Error() != "not a function: one is INTEGER" {
+		t.Errorf("wrong error. got=%v", err)
+	}
+}
+
+func TestGlobals(t *testing.T) {
+	interp := New()
+	interp.SetGlobal("x", &object.Integer{Value: 40})
+
+	if _, err := interp.Run(context.Background(), "let y = x + 2;"); err != nil {
+		t.Fatalf("Run failed: %s", err)
+	}
+
+	y, ok := interp.GetGlobal("y")
+	if !ok {
+		t.Fatalf("y is not defined")
+	}
+	testInteger(t, y, 42)
+
+	if _, ok := interp.GetGlobal("z"); ok {
+		t.Errorf("z should not be defined")
+	}
+}
+
+func TestIsolation(t *testing.T) {
+	first := New()
+	second := New()
+
+	first.RegisterBuiltin("answer", func(args ...object.Object) object.Object {
+		return &object.Integer{Value: 42}
+	})
+	first.Run(context.Background(), "let a = 1;")
+
+	result, err := first.Run(context.Background(), "answer() + a")
+	if err != nil {
+		t.Fatalf("Run failed: %s", err)
+	}
+	testInteger(t, result, 43)
+
+	if _, err := second.Run(context.Background(), "answer()"); err == nil {
+		t.Errorf("builtin leaked to another interpreter")
+	}
+	if _, err := second.Run(context.Background(), "a"); err == nil {
+		t.Errorf("global leaked to another interpreter")
+	}
+}
+
+func TestStdio(t *testing.T) {
+	var out bytes.Buffer
+	interp := New(WithStdout(&out), WithStdin(strings.NewReader("alice\nbob\n")))
+
+	_, err := interp.Run(context.Background(), `puts("hello " + gets()); puts("hello " + gets()); puts(gets())`)
+	if err != nil {
+		t.Fatalf("Run failed: %s", err)
+	}
+
+	expected := "hello alice\nhello bob\nnull\n"
+	if out.String() != expected {
+		t.Errorf("wrong output. want=%q, got=%q", expected, out.String())
+	}
+}
+
+func TestInterrupt(t *testing.T) {
+	interp := New(WithMaxSteps(1000))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := interp.Run(ctx, "let spin = fn() { while (true) {} }; spin()"); !errors.Is(err, evaluator.ErrBudgetExceeded) {
+		t.Errorf("expected budget exceeded. got=%v", err)
+	}
+
+	// 上限は Run ごとに数え直す
+	if _, err := interp.Run(context.Background(), "for (i in 0..500) {}"); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if _, err := interp.Run(context.Background(), "for (i in 0..500) {}"); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	if _, err := interp.CallContext(context.Background(), "spin"); !errors.Is(err, evaluator.ErrBudgetExceeded) {
+		t.Errorf("expected budget exceeded. got=%v", err)
+	}
+
+	unlimited := New()
+	if _, err := unlimited.Run(ctx, "while (true) {}"); !errors.Is(err, evaluator.ErrTimeout) {
+		t.Errorf("expected timeout. got=%v", err)
+	}
+
+	// 始める前に期限が過ぎていても同じエラーを返す
+	if _, err := unlimited.Run(ctx, "1"); !errors.Is(err, evaluator.ErrTimeout) {
+		t.Errorf("expected timeout. got=%v", err)
+	}
+	if _, err := unlimited.CallContext(ctx, "len", &object.String{}); !errors.Is(err, evaluator.ErrTimeout) {
+		t.Errorf("expected timeout. got=%v", err)
+	}
+
+	// スクリプトの try では捕捉できない
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := unlimited.Run(ctx, "try { while (true) {} } catch (e) { 1 }"); !errors.Is(err, evaluator.ErrTimeout) {
+		t.Errorf("expected timeout. got=%v", err)
+	}
+}
+
+func TestMaxDepth(t *testing.T) {
+	interp := New(WithMaxDepth(50))
+
+	_, err := interp.Run(context.Background(), "let f = fn(n) { if (n == 0) { 0 } else { 1 + f(n - 1) } }; f(100)")
+	rtErr, ok := err.(*object.Error)
+	if !ok || rtErr.Message != "maximum recursion depth exceeded" {
+		t.Fatalf("expected recursion error. got=%v", err)
+	}
+
+	result, err := interp.Run(context.Background(), "f(40)")
+	if err != nil {
+		t.Fatalf("Run failed: %s", err)
+	}
+	testInteger(t, result, 40)
+}
+
+func testInteger(t *testing.T, obj object.Object, expected int64) {
+	t.Helper()
+
+	integer, ok := obj.(*object.Integer)
+	if !ok {
+		t.Fatalf("object is not Integer. got=%T (%+v)", obj, obj)
+	}
+	if integer.Value != expected {
+		t.Errorf("wrong value. want=%d, got=%d", expected, integer.Value)
+	}
+}
+
+func TestImport(t *testing.T) {
+	interp := New(WithSearchPath("testdata"))
+	interp.RegisterBuiltin("double", func(args ...object.Object) object.Object {
+		return &object.Integer{Value: args[0].(*object.Integer).Value * 2}
+	})
+
+	// モジュールからもインタプリタの組み込み関数を使える
+	result, err := interp.Run(context.Background(), `let lib = import "quadruple.monkey"; lib["quadruple"](3)`)
+	if err != nil {
+		t.Fatalf("Run failed: %s", err)
+	}
+	testInteger(t, result, 12)
+
+	// 同じモジュールは Run をまたいで使い回す
+	result, err = interp.Run(context.Background(), `lib == import "quadruple.monkey"`)
+	if err != nil {
+		t.Fatalf("Run failed: %s", err)
+	}
+	if result != evaluator.TRUE {
+		t.Errorf("module was loaded twice")
+	}
+
+	if _, err := New().Run(context.Background(), `import "quadruple.monkey"`); err == nil {
+		t.Errorf("expected module not found without search path")
+	}
+}
+
+func TestPrelude(t *testing.T) {
+	result, err := New().Run(context.Background(), `reduce(map([1, 2, 3], fn(x) { x * x }), fn(a, b) { a + b })`)
+	if err != nil {
+		t.Fatalf("Run failed: %s", err)
+	}
+	testInteger(t, result, 14)
+
+	if _, err := New(WithoutPrelude()).Run(context.Background(), `map([1], fn(x) { x })`); err == nil {
+		t.Errorf("prelude should not be loaded")
+	}
+}
+
+// 標準ライブラリの中の組み込み関数もインタプリタごとの表から探す
+func TestPreludeUsesInterpreterBuiltins(t *testing.T) {
+	interp := New()
+	calls := 0
+	interp.RegisterBuiltin("append", func(args ...object.Object) object.Object {
+		calls++
+		arr := args[0].(*object.Array)
+		arr.Elements = append(arr.Elements, args[1])
+		return arr
+	})
+
+	result, err := interp.Run(context.Background(), `len(map([1, 2, 3], fn(x) { x }))`)
+	if err != nil {
+		t.Fatalf("Run failed: %s", err)
+	}
+	testInteger(t, result, 3)
+	if calls != 3 {
+		t.Errorf("registered append was called %d times, want 3", calls)
+	}
+
+	// 他のインタプリタには影響しない
+	if _, err := New().Run(context.Background(), `map([1], fn(x) { x })`); err != nil {
+		t.Fatalf("Run failed: %s", err)
+	}
+	if calls != 3 {
+		t.Errorf("registered append was called from another interpreter")
+	}
+}
+
+func TestAssignPreludeName(t *testing.T) {
+	interp := New()
+
+	result, err := interp.Run(context.Background(), `map = fn(arr, f) { 0 }; map([1], fn(x) { x })`)
+	if err != nil {
+		t.Fatalf("Run failed: %s", err)
+	}
+	testInteger(t, result, 0)
+
+	// 代入はこのインタプリタのグローバル変数になる
+	if _, ok := interp.GetGlobal("map"); !ok {
+		t.Errorf("map is not a global")
+	}
+	result, err = New().Run(context.Background(), `len(map([1], fn(x) { x }))`)
+	if err != nil {
+		t.Fatalf("Run failed: %s", err)
+	}
+	testInteger(t, result, 1)
+
+	// Call から呼んでも Run と同じく関数を定義したプログラムのグローバル変数になる
+	for _, call := range []func(interp *Interpreter) error{
+		func(interp *Interpreter) error {
+			_, err := interp.Run(context.Background(), `f()`)
+			return err
+		},
+		func(interp *Interpreter) error {
+			_, err := interp.Call("f")
+			return err
+		},
+	} {
+		interp := New()
+		if _, err := interp.Run(context.Background(), `let f = fn() { filter = fn(arr, f) { 0 } }`); err != nil {
+			t.Fatalf("Run failed: %s", err)
+		}
+		if err := call(interp); err != nil {
+			t.Fatalf("call failed: %s", err)
+		}
+		result, err := interp.Run(context.Background(), `filter([1], fn(x) { true })`)
+		if err != nil {
+			t.Fatalf("Run failed: %s", err)
+		}
+		testInteger(t, result, 0)
+	}
+}
@@ -4,18 +4,32 @@ import (
 	"bytes"
 	"fmt"
 	"monkey/token"
+	"unicode"
+	"unicode/utf8"
 )
 
 type Lexer struct {
 	input        string
-	position     int  // 入力における現在の位置(現在の文字)
+	filename     string
+	position     int  // 入力における現在の位置(現在の文字の先頭のバイト)
 	readPosition int  // これから読み込む位置(現在の文字の次)
-	ch           byte // 現在検査中の文字
+	ch           rune // 現在検査中の文字。入力の終わりでは0
+	line         int  // 現在の文字の行番号
+	column       int  // 現在の文字の列番号
+	emitComments bool // コメントをCOMMENTトークンとして返すか
+	errors       []string
 }
 
 func New(input string) *Lexer {
+	return NewWithFilename("", input)
+}
+
+// エラーメッセージ等で使うファイル名付きでLexerを作る
+func NewWithFilename(filename, input string) *Lexer {
 	l := &Lexer{
-		input: input,
+		input:    input,
+		filename: filename,
+		line:     1,
 	}
 	l.readChar()
 	return l
@@ -28,17 +42,69 @@ readPosition: %d
 ch: %q`, l.input, l.position, l.readPosition, string(l.ch))
 }
 
+// trueにするとコメントを読み飛ばさずCOMMENTトークンとして返す(フォーマッタ用)
+func (l *Lexer) SetEmitComments(emit bool) {
+	l.emitComments = emit
+}
+
+func (l *Lexer) Errors() []string {
+	return l.errors
+}
+
+func (l *Lexer) addError(pos token.Position, msg string) {
+	l.errors = append(l.errors, fmt.Sprintf("%s: %s", pos, msg))
+}
+
+// 現在の文字がUTF-8として不正なバイトか
+func (l *Lexer) invalidChar() bool {
+	return l.ch == utf8.RuneError && l.readPosition-l.position == 1
+}
+
 func (l *Lexer) NextToken() *token.Token {
-	var tok *token.Token
+	for {
+		l.skipWhitespace()
+
+		pos := l.currentPosition()
+		tok := l.readToken()
+		tok.Pos = pos
+		tok.End = l.currentPosition()
+		if tok.Type == token.EOF {
+			// EOFは幅を持たない
+			tok.End = pos
+		}
 
-	l.skipWhitespace()
+		if tok.Type == token.COMMENT && !l.emitComments {
+			continue
+		}
+
+		return tok
+	}
+}
+
+// 現在の文字の位置
+func (l *Lexer) currentPosition() token.Position {
+	return token.Position{
+		Filename: l.filename,
+		Offset:   l.position,
+		Line:     l.line,
+		Column:   l.column,
+	}
+}
+
+func (l *Lexer) readToken() *token.Token {
+	var tok *token.Token
 
 	switch l.ch {
 	case '"':
+		// 不正なバイトを含む文字列はエラーにする
+		errors := len(l.errors)
 		tok = &token.Token{
 			Type:    token.STRING,
 			Literal: l.readString(),
 		}
+		if len(l.errors) > errors {
+			tok.Type = token.ILLEGAL
+		}
 	case '=':
 		if l.peekChar() == '=' {
 			ch := l.ch
@@ -55,6 +121,28 @@ func (l *Lexer) NextToken() *token.Token {
 		tok = newToken(token.SEMICOLON, l.ch)
 	case ':':
 		tok = newToken(token.COLON, l.ch)
+	case '.':
+		if l.peekChar() == '.' && l.peekCharAt(2) == '.' {
+			l.readChar()
+			l.readChar()
+			tok = &token.Token{
+				Type:    token.ELLIPSIS,
+				Literal: "...",
+			}
+		} else if l.peekChar() == '.' {
+			ch := l.ch
+			l.readChar()
+			literal := string(ch) + string(l.ch)
+			tok = &token.Token{
+				Type:    token.DOTDOT,
+				Literal: literal,
+			}
+		} else if isDigit(l.peekChar()) {
+			return newNumberToken(l.readNumber())
+		} else {
+			l.addError(l.currentPosition(), fmt.Sprintf("illegal character %q", l.ch))
+			tok = newToken(token.ILLEGAL, l.ch)
+		}
 	case '(':
 		tok = newToken(token.LPAREN, l.ch)
 	case ')':
@@ -66,15 +154,25 @@ func (l *Lexer) NextToken() *token.Token {
 	case ',':
 		tok = newToken(token.COMMA, l.ch)
 	case '+':
-		tok = newToken(token.PLUS, l.ch)
+		tok = l.newOperatorToken(token.PLUS, token.PLUS_ASSIGN)
 	case '-':
-		tok = newToken(token.MINUS, l.ch)
+		tok = l.newOperatorToken(token.MINUS, token.MINUS_ASSIGN)
 	case '/':
-		tok = newToken(token.SLASH, l.ch)
+		switch l.peekChar() {
+		case '/':
+			return &token.Token{
+				Type:    token.COMMENT,
+				Literal: l.readLineComment(),
+			}
+		case '*':
+			return l.readBlockComment()
+		default:
+			tok = l.newOperatorToken(token.SLASH, token.SLASH_ASSIGN)
+		}
 	case '*':
-		tok = newToken(token.ASTERISK, l.ch)
+		tok = l.newOperatorToken(token.ASTERISK, token.ASTERISK_ASSIGN)
 	case '%':
-		tok = newToken(token.PERSENT, l.ch)
+		tok = l.newOperatorToken(token.PERSENT, token.PERSENT_ASSIGN)
 	case '!':
 		if l.peekChar() == '=' {
 			ch := l.ch
@@ -87,10 +185,56 @@ func (l *Lexer) NextToken() *token.Token {
 		} else {
 			tok = newToken(token.BANG, l.ch)
 		}
+	case '&':
+		if l.peekChar() == '&' {
+			ch := l.ch
+			l.readChar()
+			literal := string(ch) + string(l.ch)
+			tok = &token.Token{
+				Type:    token.AND,
+				Literal: literal,
+			}
+		} else {
+			l.addError(l.currentPosition(), fmt.Sprintf("illegal character %q", l.ch))
+			tok = newToken(token.ILLEGAL, l.ch)
+		}
+	case '|':
+		if l.peekChar() == '|' {
+			ch := l.ch
+			l.readChar()
+			literal := string(ch) + string(l.ch)
+			tok = &token.Token{
+				Type:    token.OR,
+				Literal: literal,
+			}
+		} else {
+			l.addError(l.currentPosition(), fmt.Sprintf("illegal character %q", l.ch))
+			tok = newToken(token.ILLEGAL, l.ch)
+		}
 	case '<':
-		tok = newToken(token.LT, l.ch)
+		if l.peekChar() == '=' {
+			ch := l.ch
+			l.readChar()
+			literal := string(ch) + string(l.ch)
+			tok = &token.Token{
+				Type:    token.LT_EQ,
+				Literal: literal,
+			}
+		} else {
+			tok = newToken(token.LT, l.ch)
+		}
 	case '>':
-		tok = newToken(token.GT, l.ch)
+		if l.peekChar() == '=' {
+			ch := l.ch
+			l.readChar()
+			literal := string(ch) + string(l.ch)
+			tok = &token.Token{
+				Type:    token.GT_EQ,
+				Literal: literal,
+			}
+		} else {
+			tok = newToken(token.GT, l.ch)
+		}
 	case '{':
 		tok = newToken(token.LBRACE, l.ch)
 	case '}':
@@ -101,8 +245,15 @@ func (l *Lexer) NextToken() *token.Token {
 		if isLetter(l.ch) {
 			return newIdentiferToken(l.readIdentifier())
 		} else if isDigit(l.ch) {
-			return newIntToken(l.readNumber())
+			return newNumberToken(l.readNumber())
+		} else if l.invalidChar() {
+			// エラーは readChar で記録済み
+			tok = &token.Token{
+				Type:    token.ILLEGAL,
+				Literal: l.input[l.position:l.readPosition],
+			}
 		} else {
+			l.addError(l.currentPosition(), fmt.Sprintf("illegal character %q", l.ch))
 			tok = newToken(token.ILLEGAL, l.ch)
 		}
 	}
@@ -110,45 +261,86 @@ func (l *Lexer) NextToken() *token.Token {
 	return tok
 }
 
+// 全角スペースなどUnicodeの空白も読み飛ばす
 func (l *Lexer) skipWhitespace() {
-	for l.ch == ' ' || l.ch == '\t' || l.ch == '\n' || l.ch == '\r' {
+	for unicode.IsSpace(l.ch) {
 		l.readChar()
 	}
 }
 
 func (l *Lexer) readIdentifier() string {
 	position := l.position
-	for isLetter(l.ch) || isDigit(l.ch) {
+	for isLetter(l.ch) || unicode.IsDigit(l.ch) {
 		l.readChar()
 	}
 
 	return l.input[position:l.position]
 }
 
-func (l *Lexer) readNumber() string {
+// 整数(123)と浮動小数点数(3.14, .5, 1e-9)を読む
+func (l *Lexer) readNumber() (token.TokenType, string) {
 	position := l.position
-	for isDigit(l.ch) {
+	var tokenType token.TokenType = token.INT
+
+	l.readDigits()
+
+	if l.ch == '.' && isDigit(l.peekChar()) {
+		tokenType = token.FLOAT
 		l.readChar()
+		l.readDigits()
 	}
 
-	return l.input[position:l.position]
+	if l.ch == 'e' || l.ch == 'E' {
+		next := l.peekChar()
+		if isDigit(next) || ((next == '+' || next == '-') && isDigit(l.peekCharAt(2))) {
+			tokenType = token.FLOAT
+			l.readChar()
+			if l.ch == '+' || l.ch == '-' {
+				l.readChar()
+			}
+			l.readDigits()
+		}
+	}
+
+	return tokenType, l.input[position:l.position]
+}
+
+func (l *Lexer) readDigits() {
+	for isDigit(l.ch) {
+		l.readChar()
+	}
 }
 
-func isDigit(ch byte) bool {
+// 数値リテラルにはASCIIの数字だけを使う
+func isDigit(ch rune) bool {
 	return '0' <= ch && ch <= '9'
 }
 
-func isLetter(ch byte) bool {
-	return 'a' <= ch && ch <= 'z' || 'A' <= ch && ch <= 'Z' || ch == '_'
+// 識別子はUnicodeの文字か _ で始まり、文字、数字、_ が続く
+func isLetter(ch rune) bool {
+	return unicode.IsLetter(ch) || ch == '_'
 }
 
-func newToken(tokenType token.TokenType, ch byte) *token.Token {
+func newToken(tokenType token.TokenType, ch rune) *token.Token {
 	return &token.Token{
 		Type:    tokenType,
 		Literal: string(ch),
 	}
 }
 
+// 直後に = が続けば複合代入演算子(+= など)、そうでなければ単独の演算子
+func (l *Lexer) newOperatorToken(operator, assign token.TokenType) *token.Token {
+	if l.peekChar() == '=' {
+		ch := l.ch
+		l.readChar()
+		return &token.Token{
+			Type:    assign,
+			Literal: string(ch) + string(l.ch),
+		}
+	}
+	return newToken(operator, l.ch)
+}
+
 func newEofToken() *token.Token {
 	return &token.Token{
 		Type:    token.EOF,
@@ -156,9 +348,9 @@ func newEofToken() *token.Token {
 	}
 }
 
-func newIntToken(digits string) *token.Token {
+func newNumberToken(tokenType token.TokenType, digits string) *token.Token {
 	return &token.Token{
-		Type:    token.INT,
+		Type:    tokenType,
 		Literal: digits,
 	}
 }
@@ -171,21 +363,86 @@ func newIdentiferToken(literal string) *token.Token {
 }
 
 func (l *Lexer) readChar() {
+	if l.ch == '\n' {
+		l.line++
+		l.column = 1
+	} else {
+		l.column++
+	}
+
+	l.position = l.readPosition
 	if l.readPosition >= len(l.input) {
 		// end of input
 		l.ch = 0
-	} else {
-		l.ch = l.input[l.readPosition]
+		l.readPosition++
+		return
+	}
+
+	ch, width := utf8.DecodeRuneInString(l.input[l.readPosition:])
+	l.ch = ch
+	l.readPosition += width
+	if l.invalidChar() {
+		l.addError(l.currentPosition(), fmt.Sprintf("invalid UTF-8 encoding %q", l.input[l.position:l.readPosition]))
 	}
-	l.position = l.readPosition
-	l.readPosition++
 }
 
-func (l *Lexer) peekChar() byte {
-	if l.readPosition > len(l.input) {
-		return 0
-	} else {
-		return l.input[l.readPosition]
+func (l *Lexer) peekChar() rune {
+	return l.peekCharAt(1)
+}
+
+// 現在の文字からn文字先の文字
+func (l *Lexer) peekCharAt(n int) rune {
+	var ch rune
+	position := l.readPosition
+	for i := 0; i < n; i++ {
+		if position >= len(l.input) {
+			return 0
+		}
+		var width int
+		ch, width = utf8.DecodeRuneInString(l.input[position:])
+		position += width
+	}
+	return ch
+}
+
+// // から行末まで(改行は含まない)
+func (l *Lexer) readLineComment() string {
+	position := l.position
+	for l.ch != '\n' && l.ch != 0 {
+		l.readChar()
+	}
+
+	return l.input[position:l.position]
+}
+
+// /* から対応する */ まで。入れ子になった /* */ も扱う
+func (l *Lexer) readBlockComment() *token.Token {
+	pos := l.currentPosition()
+	position := l.position
+	depth := 0
+
+	for l.ch != 0 {
+		if l.ch == '/' && l.peekChar() == '*' {
+			depth++
+			l.readChar()
+		} else if l.ch == '*' && l.peekChar() == '/' {
+			depth--
+			l.readChar()
+			if depth == 0 {
+				l.readChar()
+				return &token.Token{
+					Type:    token.COMMENT,
+					Literal: l.input[position:l.position],
+				}
+			}
+		}
+		l.readChar()
+	}
+
+	l.addError(pos, "unterminated block comment")
+	return &token.Token{
+		Type:    token.ILLEGAL,
+		Literal: l.input[position:l.position],
 	}
 }
 
@@ -216,7 +473,7 @@ func (l *Lexer) readEscapeChar(position int, buffer *bytes.Buffer) int {
 		// それ以外はバックスラッシュ無視してその文字自体にする
 		buffer.WriteString(fmt.Sprintf("%s%s", l.input[position:l.position-1], string(l.ch)))
 	}
-	return l.position + 1
+	return l.readPosition
 }
 
 func (l *Lexer) readString() string {
@@ -14,7 +14,7 @@ let add = fn(x, y) {
 };
 
 let result = add(five, ten);
-!-/*5;
+!-/ *5;
 5 < 10 > 5;
 
 if (5 < 10) {
@@ -43,6 +43,13 @@ if (5 < 10) {
 while (false) { let a = a + 1 }
 3 % 2;
 c1
+a && b || c
+1 <= 2 >= 3
+a += 1; a -= 1; a *= 2; a /= 2; a %= 2
+for (k, v in 0..10) {}
+fn(...rest) {}
+try { throw x } catch (e) {} finally {}
+import "lib.monkey"
 `
 
 	tests := []struct {
@@ -164,6 +171,305 @@ c1
 		{token.INT, "2"},
 		{token.SEMICOLON, ";"},
 		{token.IDENT, "c1"},
+		{token.IDENT, "a"},
+		{token.AND, "&&"},
+		{token.IDENT, "b"},
+		{token.OR, "||"},
+		{token.IDENT, "c"},
+		{token.INT, "1"},
+		{token.LT_EQ, "<="},
+		{token.INT, "2"},
+		{token.GT_EQ, ">="},
+		{token.INT, "3"},
+		{token.IDENT, "a"},
+		{token.PLUS_ASSIGN, "+="},
+		{token.INT, "1"},
+		{token.SEMICOLON, ";"},
+		{token.IDENT, "a"},
+		{token.MINUS_ASSIGN, "-="},
+		{token.INT, "1"},
+		{token.SEMICOLON, ";"},
+		{token.IDENT, "a"},
+		{token.ASTERISK_ASSIGN, "*="},
+		{token.INT, "2"},
+		{token.SEMICOLON, ";"},
+		{token.IDENT, "a"},
+		{token.SLASH_ASSIGN, "/="},
+		{token.INT, "2"},
+		{token.SEMICOLON, ";"},
+		{token.IDENT, "a"},
+		{token.PERSENT_ASSIGN, "%="},
+		{token.INT, "2"},
+		{token.FOR, "for"},
+		{token.LPAREN, "("},
+		{token.IDENT, "k"},
+		{token.COMMA, ","},
+		{token.IDENT, "v"},
+		{token.IN, "in"},
+		{token.INT, "0"},
+		{token.DOTDOT, ".."},
+		{token.INT, "10"},
+		{token.RPAREN, ")"},
+		{token.LBRACE, "{"},
+		{token.RBRACE, "}"},
+		{token.FUNCTION, "fn"},
+		{token.LPAREN, "("},
+		{token.ELLIPSIS, "..."},
+		{token.IDENT, "rest"},
+		{token.RPAREN, ")"},
+		{token.LBRACE, "{"},
+		{token.RBRACE, "}"},
+		{token.TRY, "try"},
+		{token.LBRACE, "{"},
+		{token.THROW, "throw"},
+		{token.IDENT, "x"},
+		{token.RBRACE, "}"},
+		{token.CATCH, "catch"},
+		{token.LPAREN, "("},
+		{token.IDENT, "e"},
+		{token.RPAREN, ")"},
+		{token.LBRACE, "{"},
+		{token.RBRACE, "}"},
+		{token.FINALLY, "finally"},
+		{token.LBRACE, "{"},
+		{token.RBRACE, "}"},
+		{token.IMPORT, "import"},
+		{token.STRING, "lib.monkey"},
+		{token.EOF, ""},
+	}
+
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong. expected=%q, got=%q",
+				i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - literal wrong. expected=%q, got=%q",
+				i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
+func TestNextTokenPosition(t *testing.T) {
+	input := `let x = 5;
+  x + "ab";
+`
+
+	tests := []struct {
+		expectedType   token.TokenType
+		expectedPos    token.Position
+		expectedEndPos token.Position
+	}{
+		{token.LET, token.Position{Filename: "test.monkey", Offset: 0, Line: 1, Column: 1}, token.Position{Filename: "test.monkey", Offset: 3, Line: 1, Column: 4}},
+		{token.IDENT, token.Position{Filename: "test.monkey", Offset: 4, Line: 1, Column: 5}, token.Position{Filename: "test.monkey", Offset: 5, Line: 1, Column: 6}},
+		{token.ASSIGN, token.Position{Filename: "test.monkey", Offset: 6, Line: 1, Column: 7}, token.Position{Filename: "test.monkey", Offset: 7, Line: 1, Column: 8}},
+		{token.INT, token.Position{Filename: "test.monkey", Offset: 8, Line: 1, Column: 9}, token.Position{Filename: "test.monkey", Offset: 9, Line: 1, Column: 10}},
+		{token.SEMICOLON, token.Position{Filename: "test.monkey", Offset: 9, Line: 1, Column: 10}, token.Position{Filename: "test.monkey", Offset: 10, Line: 1, Column: 11}},
+		{token.IDENT, token.Position{Filename: "test.monkey", Offset: 13, Line: 2, Column: 3}, token.Position{Filename: "test.monkey", Offset: 14, Line: 2, Column: 4}},
+		{token.PLUS, token.Position{Filename: "test.monkey", Offset: 15, Line: 2, Column: 5}, token.Position{Filename: "test.monkey", Offset: 16, Line: 2, Column: 6}},
+		{token.STRING, token.Position{Filename: "test.monkey", Offset: 17, Line: 2, Column: 7}, token.Position{Filename: "test.monkey", Offset: 21, Line: 2, Column: 11}},
+		{token.SEMICOLON, token.Position{Filename: "test.monkey", Offset: 21, Line: 2, Column: 11}, token.Position{Filename: "test.monkey", Offset: 22, Line: 2, Column: 12}},
+		{token.EOF, token.Position{Filename: "test.monkey", Offset: 23, Line: 3, Column: 1}, token.Position{Filename: "test.monkey", Offset: 23, Line: 3, Column: 1}},
+	}
+
+	l := NewWithFilename("test.monkey", input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong. expected=%q, got=%q",
+				i, tt.expectedType, tok.Type)
+		}
+		if tok.Pos != tt.expectedPos {
+			t.Fatalf("tests[%d] - pos wrong. expected=%+v, got=%+v",
+				i, tt.expectedPos, tok.Pos)
+		}
+		if tok.End != tt.expectedEndPos {
+			t.Fatalf("tests[%d] - end wrong. expected=%+v, got=%+v",
+				i, tt.expectedEndPos, tok.End)
+		}
+	}
+}
+
+func TestComments(t *testing.T) {
+	input := `// line comment
+let a = 1; // trailing
+/* block
+   comment */ a / 2
+/* outer /* nested */ still comment */ a
+`
+
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{token.LET, "let"},
+		{token.IDENT, "a"},
+		{token.ASSIGN, "="},
+		{token.INT, "1"},
+		{token.SEMICOLON, ";"},
+		{token.IDENT, "a"},
+		{token.SLASH, "/"},
+		{token.INT, "2"},
+		{token.IDENT, "a"},
+		{token.EOF, ""},
+	}
+
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong. expected=%q, got=%q",
+				i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - literal wrong. expected=%q, got=%q",
+				i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+
+	if len(l.Errors()) != 0 {
+		t.Errorf("lexer has errors: %q", l.Errors())
+	}
+}
+
+func TestEmitComments(t *testing.T) {
+	input := `// line
+a /* block */`
+
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{token.COMMENT, "// line"},
+		{token.IDENT, "a"},
+		{token.COMMENT, "/* block */"},
+		{token.EOF, ""},
+	}
+
+	l := New(input)
+	l.SetEmitComments(true)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong. expected=%q, got=%q",
+				i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - literal wrong. expected=%q, got=%q",
+				i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
+func TestUnterminatedBlockComment(t *testing.T) {
+	input := `a
+  /* never /* closed */`
+
+	l := New(input)
+	l.NextToken()
+
+	tok := l.NextToken()
+	if tok.Type != token.ILLEGAL {
+		t.Fatalf("tokentype wrong. expected=%q, got=%q", token.ILLEGAL, tok.Type)
+	}
+
+	expected := []string{"2:3: unterminated block comment"}
+	if len(l.Errors()) != len(expected) || l.Errors()[0] != expected[0] {
+		t.Errorf("wrong errors. expected=%q, got=%q", expected, l.Errors())
+	}
+}
+
+func TestNumbers(t *testing.T) {
+	input := `3.14 1e-9 .5 2E+3 10 1.5e2 7.foo`
+
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{token.FLOAT, "3.14"},
+		{token.FLOAT, "1e-9"},
+		{token.FLOAT, ".5"},
+		{token.FLOAT, "2E+3"},
+		{token.INT, "10"},
+		{token.FLOAT, "1.5e2"},
+		{token.INT, "7"},
+		{token.ILLEGAL, "."},
+		{token.IDENT, "foo"},
+		{token.EOF, ""},
+	}
+
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong. expected=%q, got=%q",
+				i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - literal wrong. expected=%q, got=%q",
+				i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
+func TestUnicode(t *testing.T) {
+	input := "let 名前 = \"日本語\";\u3000café_2 + x１ ...\"\\語\""
+
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+		expectedColumn  int
+	}{
+		{token.LET, "let", 1},
+		{token.IDENT, "名前", 5},
+		{token.ASSIGN, "=", 8},
+		{token.STRING, "日本語", 10},
+		{token.SEMICOLON, ";", 15},
+		// 全角スペースも空白として読み飛ばす
+		{token.IDENT, "café_2", 17},
+		{token.PLUS, "+", 24},
+		{token.IDENT, "x１", 26},
+		{token.ELLIPSIS, "...", 29},
+		{token.STRING, "語", 32},
+		{token.EOF, "", 36},
+	}
+
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong. expected=%q, got=%q",
+				i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - literal wrong. expected=%q, got=%q",
+				i, tt.expectedLiteral, tok.Literal)
+		}
+		if tok.Pos.Column != tt.expectedColumn {
+			t.Fatalf("tests[%d] - column wrong. expected=%d, got=%d",
+				i, tt.expectedColumn, tok.Pos.Column)
+		}
+	}
+
+	if len(l.Errors()) != 0 {
+		t.Errorf("unexpected errors: %q", l.Errors())
+	}
+}
+
+func TestInvalidUTF8(t *testing.T) {
+	input := "a \xff b \"x\xfey\" c"
+
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{token.IDENT, "a"},
+		{token.ILLEGAL, "\xff"},
+		{token.IDENT, "b"},
+		{token.ILLEGAL, "x\xfey"},
+		{token.IDENT, "c"},
 		{token.EOF, ""},
 	}
 
@@ -179,4 +485,9 @@ c1
 				i, tt.expectedLiteral, tok.Literal)
 		}
 	}
+
+	expected := []string{`1:3: invalid UTF-8 encoding "\xff"`, `1:9: invalid UTF-8 encoding "\xfe"`}
+	if len(l.Errors()) != len(expected) || l.Errors()[0] != expected[0] || l.Errors()[1] != expected[1] {
+		t.Errorf("wrong errors. expected=%q, got=%q", expected, l.Errors())
+	}
 }
@@ -25,7 +25,30 @@ func (e *Environment) Get(name string) (Object, bool) {
 	return obj, ok
 }
 
+// 外側の環境はたどらずに探す
+func (e *Environment) GetLocal(name string) (Object, bool) {
+	obj, ok := e.store[name]
+	return obj, ok
+}
+
+// すぐ外側の環境。一番外側ならnil
+func (e *Environment) Outer() *Environment {
+	return e.outer
+}
+
 func (e *Environment) Set(name string, obj Object) Object {
 	e.store[name] = obj
 	return obj
 }
+
+// 外側に向かって探し、最も近い既存の束縛を書き換える。見つからなければfalse
+func (e *Environment) Assign(name string, obj Object) (Object, bool) {
+	if _, ok := e.store[name]; ok {
+		e.store[name] = obj
+		return obj, true
+	}
+	if e.outer != nil {
+		return e.outer.Assign(name, obj)
+	}
+	return nil, false
+}
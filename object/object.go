@@ -4,7 +4,12 @@ import (
 	"bytes"
 	"fmt"
 	"hash/fnv"
+	"math"
 	"monkey/ast"
+	"monkey/code"
+	"monkey/token"
+	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -21,15 +26,23 @@ type Hashable interface {
 
 const (
 	INTEGER_OBJ      = "INTEGER"
+	FLOAT_OBJ        = "FLOAT"
 	BOOLEAN_OBJ      = "BOOLEAN"
 	NULL_OBJ         = "NULL"
 	RETURN_VALUE_OBJ = "RETURN_VALUE"
+	BREAK_OBJ        = "BREAK"
+	CONTINUE_OBJ     = "CONTINUE"
+	TAIL_CALL_OBJ    = "TAIL_CALL"
 	ERROR_OBJ        = "ERROR"
 	FUNCTION_OBJ     = "FUNCTION"
 	STRING_OBJ       = "STRING"
 	BUILTIN_OBJ      = "BUILTIN"
 	ARRAY_OBJ        = "ARRAY"
 	HASH_OBJ         = "HASH"
+	RANGE_OBJ        = "RANGE"
+	MODULE_OBJ       = "MODULE"
+
+	COMPILED_FUNCTION_OBJ = "COMPILED_FUNCTION"
 )
 
 type Object interface {
@@ -56,6 +69,35 @@ func (i *Integer) HashKey() HashKey {
 	}
 }
 
+type Float struct {
+	Value float64
+}
+
+func (f *Float) Type() ObjectType {
+	return FLOAT_OBJ
+}
+
+// 整数と区別できるよう整数値でも 3.0 のように小数点を付ける
+func (f *Float) Inspect() string {
+	s := strconv.FormatFloat(f.Value, 'g', -1, 64)
+	if strings.ContainsAny(s, ".eIN") {
+		return s
+	}
+	return s + ".0"
+}
+
+// 1.0 == 1 なので整数値のFloatは同じ値のIntegerと同じキーになる
+func (f *Float) HashKey() HashKey {
+	if f.Value == math.Trunc(f.Value) && math.Abs(f.Value) < 1<<63 {
+		return (&Integer{Value: int64(f.Value)}).HashKey()
+	}
+
+	return HashKey{
+		Type:  f.Type(),
+		Value: math.Float64bits(f.Value),
+	}
+}
+
 type Boolean struct {
 	Value bool
 }
@@ -102,8 +144,40 @@ func (n *ReturnValue) Inspect() string {
 	return n.Value.Inspect()
 }
 
+// スタックトレースの1フレーム
+type StackFrame struct {
+	Function string         // 呼び出された関数名(無名関数なら<anonymous>)
+	CallSite token.Position // 呼び出し元の位置
+}
+
+// break/continueでループまで巻き戻すための内部オブジェクト
+type Break struct{}
+
+func (b *Break) Type() ObjectType { return BREAK_OBJ }
+func (b *Break) Inspect() string  { return "break" }
+
+type Continue struct{}
+
+func (c *Continue) Type() ObjectType { return CONTINUE_OBJ }
+func (c *Continue) Inspect() string  { return "continue" }
+
+// 末尾呼び出しを呼び出し元の関数まで戻してから実行するための内部オブジェクト
+type TailCall struct {
+	Fn       Object
+	Args     []Object
+	CallSite token.Position
+}
+
+func (t *TailCall) Type() ObjectType { return TAIL_CALL_OBJ }
+func (t *TailCall) Inspect() string  { return "tail call" }
+
 type Error struct {
 	Message string
+	Pos     token.Position // エラーが発生した位置
+	Stack   []StackFrame   // 内側の呼び出しから順に積まれる
+	Cause   error          // 評価を打ち切った場合の原因。通常の実行時エラーではnil
+	Kind    string         // throw で指定されたエラーの種類。実行時エラーでは空
+	Value   Object         // throw された値。実行時エラーではnil
 }
 
 func (e *Error) Type() ObjectType {
@@ -114,8 +188,50 @@ func (e *Error) Inspect() string {
 	return "ERROR: " + e.Message
 }
 
+// VMからGoのerrorとして返せるようにする
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Cause
+}
+
+// 関数呼び出しから抜ける際にフレームを積む
+func (e *Error) PushFrame(function string, callSite token.Position) {
+	e.Stack = append(e.Stack, StackFrame{Function: function, CallSite: callSite})
+}
+
+// Goのpanicのような形式でスタックトレースを返す
+//
+//	ERROR: type mismatch: INTEGER + BOOLEAN
+//
+//	inner(...)
+//		sample.monkey:2:3
+//	<main>
+//		sample.monkey:5:1
+func (e *Error) StackTrace() string {
+	var out bytes.Buffer
+
+	out.WriteString(e.Inspect())
+	out.WriteString("\n\n")
+
+	// 各フレームの位置はその関数の中で実行していた位置
+	pos := e.Pos
+	for _, frame := range e.Stack {
+		out.WriteString(fmt.Sprintf("%s(...)\n\t%s\n", frame.Function, pos))
+		pos = frame.CallSite
+	}
+	out.WriteString(fmt.Sprintf("<main>\n\t%s\n", pos))
+
+	return out.String()
+}
+
 type Function struct {
+	Name       string // let で束縛された名前(無名関数なら空)
 	Parameters []*ast.Identifier
+	Defaults   []ast.Expression // Parameters と同じ長さで、既定値の無い引数はnil
+	Rest       *ast.Identifier  // 残りの引数を配列で受け取る引数。無ければnil
 	Body       *ast.BlockStatement
 	Env        *Environment
 }
@@ -124,12 +240,27 @@ func (f *Function) Type() ObjectType {
 	return FUNCTION_OBJ
 }
 
+// スタックトレースに表示する名前
+func (f *Function) DisplayName() string {
+	if f.Name == "" {
+		return "<anonymous>"
+	}
+	return f.Name
+}
+
 func (f *Function) Inspect() string {
 	var out bytes.Buffer
 
 	params := []string{}
-	for _, p := range f.Parameters {
-		params = append(params, p.String())
+	for i, p := range f.Parameters {
+		if i < len(f.Defaults) && f.Defaults[i] != nil {
+			params = append(params, p.String()+" = "+f.Defaults[i].String())
+		} else {
+			params = append(params, p.String())
+		}
+	}
+	if f.Rest != nil {
+		params = append(params, "..."+f.Rest.String())
 	}
 	out.WriteString("fn(")
 	out.WriteString(strings.Join(params, ", "))
@@ -158,7 +289,8 @@ func (s *String) HashKey() HashKey {
 
 type BuiltinFunction func(args ...Object) Object
 type Builtin struct {
-	Fn BuiltinFunction
+	Name string
+	Fn   BuiltinFunction
 }
 
 func (s *Builtin) Type() ObjectType { return BUILTIN_OBJ }
@@ -169,18 +301,51 @@ type Array struct {
 }
 
 func (a *Array) Type() ObjectType { return ARRAY_OBJ }
-func (a *Array) Inspect() string {
-	var out bytes.Buffer
-
-	elems := []string{}
-	for _, p := range a.Elements {
-		elems = append(elems, p.Inspect())
+func (a *Array) Inspect() string  { return inspect(a, map[Object]bool{}) }
+
+// 配列とハッシュを中身まで表示する。表示中の値を指す要素(循環)は [...] や {...} と書く
+func inspect(obj Object, visiting map[Object]bool) string {
+	switch obj := obj.(type) {
+	case *Array:
+		if visiting[obj] {
+			return "[...]"
+		}
+		visiting[obj] = true
+		defer delete(visiting, obj)
+
+		var out bytes.Buffer
+
+		elems := []string{}
+		for _, p := range obj.Elements {
+			elems = append(elems, inspect(p, visiting))
+		}
+		out.WriteString("[")
+		out.WriteString(strings.Join(elems, ", "))
+		out.WriteString("]")
+
+		return out.String()
+	case *Hash:
+		if visiting[obj] {
+			return "{...}"
+		}
+		visiting[obj] = true
+		defer delete(visiting, obj)
+
+		var out bytes.Buffer
+
+		pairs := []string{}
+		for _, pair := range obj.Pairs {
+			pairs = append(pairs, fmt.Sprintf("%s: %s", pair.Key.Inspect(), inspect(pair.Value, visiting)))
+		}
+
+		out.WriteString("{")
+		out.WriteString(strings.Join(pairs, ","))
+		out.WriteString("}")
+
+		return out.String()
+	default:
+		return obj.Inspect()
 	}
-	out.WriteString("[")
-	out.WriteString(strings.Join(elems, ", "))
-	out.WriteString("]")
-
-	return out.String()
 }
 
 type HashPair struct {
@@ -193,17 +358,136 @@ type Hash struct {
 }
 
 func (h *Hash) Type() ObjectType { return HASH_OBJ }
-func (h *Hash) Inspect() string {
-	var out bytes.Buffer
+func (h *Hash) Inspect() string  { return inspect(h, map[Object]bool{}) }
 
-	pairs := []string{}
+// キーの順に並べたペア。forでの列挙順を決めるのに使う
+// (整数と浮動小数点数は数値順、文字列は辞書順、false < true)
+func (h *Hash) SortedPairs() []HashPair {
+	pairs := make([]HashPair, 0, len(h.Pairs))
 	for _, pair := range h.Pairs {
-		pairs = append(pairs, fmt.Sprintf("%s: %s", pair.Key.Inspect(), pair.Value.Inspect()))
+		pairs = append(pairs, pair)
 	}
 
-	out.WriteString("{")
-	out.WriteString(strings.Join(pairs, ","))
-	out.WriteString("}")
+	sort.Slice(pairs, func(i, j int) bool {
+		return lessKey(pairs[i].Key, pairs[j].Key)
+	})
 
-	return out.String()
+	return pairs
+}
+
+func lessKey(a, b Object) bool {
+	if ai, ok := a.(*Integer); ok {
+		if bi, ok := b.(*Integer); ok {
+			return ai.Value < bi.Value
+		}
+	}
+
+	an, aIsNumber := numberValue(a)
+	bn, bIsNumber := numberValue(b)
+	if aIsNumber && bIsNumber {
+		return an < bn
+	}
+
+	if a.Type() != b.Type() {
+		return a.Type() < b.Type()
+	}
+
+	switch a := a.(type) {
+	case *String:
+		return a.Value < b.(*String).Value
+	case *Boolean:
+		return !a.Value && b.(*Boolean).Value
+	default:
+		return false
+	}
+}
+
+func numberValue(obj Object) (float64, bool) {
+	switch obj := obj.(type) {
+	case *Integer:
+		return float64(obj.Value), true
+	case *Float:
+		return obj.Value, true
+	default:
+		return 0, false
+	}
+}
+
+// start..end (endは含まない)
+type Range struct {
+	Start int64
+	End   int64
+}
+
+func (r *Range) Type() ObjectType { return RANGE_OBJ }
+func (r *Range) Inspect() string  { return fmt.Sprintf("%d..%d", r.Start, r.End) }
+
+// import で読み込んだモジュール。トップレベルで束縛した名前のうち _ で始まらないものを公開する
+type Module struct {
+	Path string       // 読み込んだファイルの絶対パス
+	Env  *Environment // モジュールのトップレベルの環境
+}
+
+func (m *Module) Type() ObjectType { return MODULE_OBJ }
+func (m *Module) Inspect() string  { return "<module " + m.Path + ">" }
+
+// 公開されている名前の値
+func (m *Module) Member(name string) (Object, bool) {
+	if strings.HasPrefix(name, "_") {
+		return nil, false
+	}
+	return m.Env.GetLocal(name)
+}
+
+// 命令のオフセットとソース上の位置の対応
+type SourcePosition struct {
+	Offset int
+	Pos    token.Position
+}
+
+type CompiledFunction struct {
+	Instructions    code.Instructions
+	NumLocals       int
+	NumParameters   int
+	NumRequired     int              // 省略できない引数の数。残りの引数は既定値を持つ
+	Variadic        bool             // 余分な引数を配列にまとめて NumParameters 番目のローカル変数に入れる
+	Name            string           // let で束縛された名前(無名関数なら空)
+	LocalNames      []string         // ローカル変数のスロットごとの名前
+	FreeNames       []string         // 自由変数の名前
+	SourcePositions []SourcePosition // Offsetの昇順
+}
+
+func (cf *CompiledFunction) Type() ObjectType { return COMPILED_FUNCTION_OBJ }
+func (cf *CompiledFunction) Inspect() string {
+	return fmt.Sprintf("CompiledFunction[%p]", cf)
+}
+
+// スタックトレースに表示する名前
+func (cf *CompiledFunction) DisplayName() string {
+	if cf.Name == "" {
+		return "<anonymous>"
+	}
+	return cf.Name
+}
+
+// 命令のオフセットに対応するソース上の位置を返す
+func (cf *CompiledFunction) PositionAt(offset int) token.Position {
+	i := sort.Search(len(cf.SourcePositions), func(i int) bool {
+		return cf.SourcePositions[i].Offset > offset
+	})
+	if i == 0 {
+		return token.Position{}
+	}
+	return cf.SourcePositions[i-1].Pos
+}
+
+// VMの関数値。評価器の関数と同じくFUNCTIONとして振る舞う
+type Closure struct {
+	Fn   *CompiledFunction
+	Free []Object
+}
+
+func (c *Closure) Type() ObjectType { return FUNCTION_OBJ }
+func (c *Closure) Inspect() string {
+	return fmt.Sprintf("Closure[%p]", c)
 }
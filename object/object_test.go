@@ -20,3 +20,95 @@ func TestStringHashKey(t *testing.T) {
 		t.Errorf("strings with different content have same hash keys")
 	}
 }
+
+func TestFloatHashKey(t *testing.T) {
+	half1 := &Float{Value: 0.5}
+	half2 := &Float{Value: 0.5}
+	quarter := &Float{Value: 0.25}
+
+	if half1.HashKey() != half2.HashKey() {
+		t.Errorf("floats with same content have different hash keys")
+	}
+
+	if half1.HashKey() == quarter.HashKey() {
+		t.Errorf("floats with different content have same hash keys")
+	}
+
+	if (&Float{Value: 2.0}).HashKey() != (&Integer{Value: 2}).HashKey() {
+		t.Errorf("integral float has different hash key from integer with same value")
+	}
+
+	if (&Float{Value: 2.5}).HashKey() == (&Integer{Value: 2}).HashKey() {
+		t.Errorf("non integral float has same hash key as integer")
+	}
+}
+
+func TestFloatInspect(t *testing.T) {
+	tests := []struct {
+		value    float64
+		expected string
+	}{
+		{3.0, "3.0"},
+		{3.14, "3.14"},
+		{-0.5, "-0.5"},
+		{1e-9, "1e-09"},
+	}
+
+	for _, tt := range tests {
+		f := &Float{Value: tt.value}
+		if f.Inspect() != tt.expected {
+			t.Errorf("wrong inspect. expected=%q, got=%q", tt.expected, f.Inspect())
+		}
+	}
+}
+
+func TestInspectCycle(t *testing.T) {
+	a := &Array{Elements: []Object{&Integer{Value: 1}}}
+	a.Elements = append(a.Elements, a)
+	if a.Inspect() != "[1, [...]]" {
+		t.Errorf("wrong inspect. got=%q", a.Inspect())
+	}
+
+	key := &String{Value: "self"}
+	h := &Hash{Pairs: map[HashKey]HashPair{}}
+	h.Pairs[key.HashKey()] = HashPair{Key: key, Value: &Array{Elements: []Object{h}}}
+	if h.Inspect() != "{self: [{...}]}" {
+		t.Errorf("wrong inspect. got=%q", h.Inspect())
+	}
+
+	// 循環していない共有は省略しない
+	shared := &Array{Elements: []Object{&Integer{Value: 1}}}
+	b := &Array{Elements: []Object{shared, shared}}
+	if b.Inspect() != "[[1], [1]]" {
+		t.Errorf("wrong inspect. got=%q", b.Inspect())
+	}
+}
+
+func TestHashSortedPairs(t *testing.T) {
+	keys := []Object{
+		&String{Value: "b"},
+		&Integer{Value: 10},
+		&Boolean{Value: true},
+		&Float{Value: 2.5},
+		&String{Value: "a"},
+		&Integer{Value: 2},
+		&Boolean{Value: false},
+	}
+
+	hash := &Hash{Pairs: map[HashKey]HashPair{}}
+	for _, key := range keys {
+		hash.Pairs[key.(Hashable).HashKey()] = HashPair{Key: key, Value: key}
+	}
+
+	expected := []string{"false", "true", "2", "2.5", "10", "a", "b"}
+
+	pairs := hash.SortedPairs()
+	if len(pairs) != len(expected) {
+		t.Fatalf("wrong number of pairs. expected=%d, got=%d", len(expected), len(pairs))
+	}
+	for i, pair := range pairs {
+		if pair.Key.Inspect() != expected[i] {
+			t.Errorf("pairs[%d] has wrong key. expected=%q, got=%q", i, expected[i], pair.Key.Inspect())
+		}
+	}
+}
@@ -10,8 +10,12 @@ import (
 
 const (
 	LOWEST      = iota
+	ASSIGNMENT  // =, += etc
+	LOGICAL_OR  // ||
+	LOGICAL_AND // &&
 	EQUALS      // ==
-	LESSGREATER // < or >
+	LESSGREATER // <, >, <= or >=
+	RANGE       // ..
 	SUM         // +
 	PRODUCT     // *
 	MOD         // %
@@ -21,10 +25,22 @@ const (
 )
 
 var precedencese = map[token.TokenType]int{
+	token.ASSIGN:          ASSIGNMENT,
+	token.PLUS_ASSIGN:     ASSIGNMENT,
+	token.MINUS_ASSIGN:    ASSIGNMENT,
+	token.ASTERISK_ASSIGN: ASSIGNMENT,
+	token.SLASH_ASSIGN:    ASSIGNMENT,
+	token.PERSENT_ASSIGN:  ASSIGNMENT,
+
+	token.OR:       LOGICAL_OR,
+	token.AND:      LOGICAL_AND,
 	token.EQ:       EQUALS,
 	token.NOT_EQ:   EQUALS,
 	token.LT:       LESSGREATER,
 	token.GT:       LESSGREATER,
+	token.LT_EQ:    LESSGREATER,
+	token.GT_EQ:    LESSGREATER,
+	token.DOTDOT:   RANGE,
 	token.PLUS:     SUM,
 	token.MINUS:    SUM,
 	token.SLASH:    PRODUCT,
@@ -47,6 +63,11 @@ type Parser struct {
 	peekToken *token.Token
 	errors    []string
 
+	// 解析中のループの深さ(break/continueがループ内にあるかの検査用)
+	loopDepth int
+	// finally の中か。finally から return/break/continue で抜けることはできない
+	inFinally bool
+
 	prefixParseFns map[token.TokenType]prefixParseFn
 	infixParseFns  map[token.TokenType]infixParseFn
 }
@@ -61,6 +82,7 @@ func New(l *lexer.Lexer) *Parser {
 
 	p.registerPrefix(token.IDENT, p.parseIdentifier)
 	p.registerPrefix(token.INT, p.parseIntegerLiteral)
+	p.registerPrefix(token.FLOAT, p.parseFloatLiteral)
 	p.registerPrefix(token.BANG, p.parsePrefixExpression)
 	p.registerPrefix(token.MINUS, p.parsePrefixExpression)
 	p.registerPrefix(token.TRUE, p.parseBoolean)
@@ -71,6 +93,9 @@ func New(l *lexer.Lexer) *Parser {
 	p.registerPrefix(token.STRING, p.parseStringLiteral)
 	p.registerPrefix(token.LBRACKET, p.parseArrayLiteral)
 	p.registerPrefix(token.LBRACE, p.parseHashLiteral)
+	p.registerPrefix(token.TRY, p.parseTryExpression)
+	p.registerPrefix(token.IMPORT, p.parseImportExpression)
+	p.registerPrefix(token.ILLEGAL, p.parseIllegal)
 
 	p.registerInfix(token.PLUS, p.parseInfixExpression)
 	p.registerInfix(token.MINUS, p.parseInfixExpression)
@@ -80,9 +105,20 @@ func New(l *lexer.Lexer) *Parser {
 	p.registerInfix(token.NOT_EQ, p.parseInfixExpression)
 	p.registerInfix(token.LT, p.parseInfixExpression)
 	p.registerInfix(token.GT, p.parseInfixExpression)
+	p.registerInfix(token.LT_EQ, p.parseInfixExpression)
+	p.registerInfix(token.GT_EQ, p.parseInfixExpression)
 	p.registerInfix(token.LPAREN, p.parseCallExpression)
 	p.registerInfix(token.LBRACKET, p.parseIndexExpression)
 	p.registerInfix(token.PERSENT, p.parseInfixExpression)
+	p.registerInfix(token.AND, p.parseInfixExpression)
+	p.registerInfix(token.OR, p.parseInfixExpression)
+	p.registerInfix(token.DOTDOT, p.parseInfixExpression)
+	p.registerInfix(token.ASSIGN, p.parseAssignExpression)
+	p.registerInfix(token.PLUS_ASSIGN, p.parseAssignExpression)
+	p.registerInfix(token.MINUS_ASSIGN, p.parseAssignExpression)
+	p.registerInfix(token.ASTERISK_ASSIGN, p.parseAssignExpression)
+	p.registerInfix(token.SLASH_ASSIGN, p.parseAssignExpression)
+	p.registerInfix(token.PERSENT_ASSIGN, p.parseAssignExpression)
 
 	p.nextToken()
 	p.nextToken()
@@ -90,14 +126,22 @@ func New(l *lexer.Lexer) *Parser {
 	return p
 }
 
+// 字句解析のエラーも含めて返す
 func (p *Parser) Errors() []string {
-	return p.errors
+	errors := make([]string, 0, len(p.l.Errors())+len(p.errors))
+	errors = append(errors, p.l.Errors()...)
+	return append(errors, p.errors...)
 }
 
 func (p *Parser) addError(msg string) {
 	p.errors = append(p.errors, msg)
 }
 
+// file:line:col: msg の形式でエラーを追加する
+func (p *Parser) addErrorAt(pos token.Position, msg string) {
+	p.addError(fmt.Sprintf("%s: %s", pos, msg))
+}
+
 func (p *Parser) registerPrefix(tokenType token.TokenType, fn prefixParseFn) {
 	p.prefixParseFns[tokenType] = fn
 }
@@ -123,7 +167,7 @@ func (p *Parser) curPrecedence() int {
 }
 
 func (p *Parser) peekError(t token.TokenType) {
-	p.addError(fmt.Sprintf("expected next token to be %s, got %s instead", t, p.peekToken.Type))
+	p.addErrorAt(p.peekToken.Pos, fmt.Sprintf("expected next token to be %s, got %s instead", t, p.peekToken.Type))
 }
 
 func (p *Parser) nextToken() {
@@ -155,6 +199,14 @@ func (p *Parser) parseStatement() ast.Statement {
 		return p.parseReturnStatement()
 	case token.WHILE:
 		return p.parseWhileStatement()
+	case token.FOR:
+		return p.parseForStatement()
+	case token.BREAK:
+		return p.parseBreakStatement()
+	case token.CONTINUE:
+		return p.parseContinueStatement()
+	case token.THROW:
+		return p.parseThrowStatement()
 	default:
 		return p.parseExpressionStatement()
 	}
@@ -162,6 +214,9 @@ func (p *Parser) parseStatement() ast.Statement {
 
 func (p *Parser) parseReturnStatement() ast.Statement {
 	stmt := &ast.ReturnStatement{Token: p.curToken}
+	if p.inFinally {
+		p.addErrorAt(p.curToken.Pos, "cannot return from finally block")
+	}
 
 	p.nextToken()
 
@@ -174,6 +229,57 @@ func (p *Parser) parseReturnStatement() ast.Statement {
 	return stmt
 }
 
+func (p *Parser) parseBreakStatement() ast.Statement {
+	stmt := &ast.BreakStatement{Token: p.curToken}
+	if p.loopDepth == 0 {
+		p.addErrorAt(p.curToken.Pos, p.loopError("break"))
+	}
+
+	if p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+
+	return stmt
+}
+
+func (p *Parser) parseContinueStatement() ast.Statement {
+	stmt := &ast.ContinueStatement{Token: p.curToken}
+	if p.loopDepth == 0 {
+		p.addErrorAt(p.curToken.Pos, p.loopError("continue"))
+	}
+
+	if p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+
+	return stmt
+}
+
+// ループの外の break/continue のエラーメッセージ
+func (p *Parser) loopError(keyword string) string {
+	if p.inFinally {
+		return fmt.Sprintf("cannot %s out of finally block", keyword)
+	}
+	return keyword + " is not in a loop"
+}
+
+func (p *Parser) parseThrowStatement() ast.Statement {
+	stmt := &ast.ThrowStatement{Token: p.curToken}
+
+	p.nextToken()
+
+	stmt.Value = p.parseExpression(LOWEST)
+	if stmt.Value == nil {
+		return nil
+	}
+
+	if p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+
+	return stmt
+}
+
 func (p *Parser) parseLetStatement() ast.Statement {
 	stmt := &ast.LetStatement{
 		Token: p.curToken,
@@ -195,6 +301,10 @@ func (p *Parser) parseLetStatement() ast.Statement {
 	p.nextToken()
 	stmt.Value = p.parseExpression(LOWEST)
 
+	if fl, ok := stmt.Value.(*ast.FunctionLiteral); ok {
+		fl.Name = stmt.Name.Value
+	}
+
 	if p.peekTokenIs(token.SEMICOLON) {
 		p.nextToken()
 	}
@@ -237,11 +347,15 @@ func (p *Parser) parseExpressionStatement() ast.Statement {
 func (p *Parser) parseExpression(precedence int) ast.Expression {
 	prefix := p.prefixParseFns[p.curToken.Type]
 	if prefix == nil {
-		p.noPrefixParseFnError(p.curToken.Type)
+		p.noPrefixParseFnError(p.curToken)
 		return nil
 	}
 
 	leftExp := prefix()
+	// 不正なトークンなどで式を作れなければ、続く演算子は読まない
+	if leftExp == nil {
+		return nil
+	}
 
 	for !p.peekTokenIs(token.SEMICOLON) && precedence < p.peekPrecedence() {
 		infix := p.infixParseFns[p.peekToken.Type]
@@ -257,8 +371,13 @@ func (p *Parser) parseExpression(precedence int) ast.Expression {
 	return leftExp
 }
 
-func (p *Parser) noPrefixParseFnError(t token.TokenType) {
-	p.addError(fmt.Sprintf("no prefix parse function for %s found.", t))
+func (p *Parser) noPrefixParseFnError(t *token.Token) {
+	p.addErrorAt(t.Pos, fmt.Sprintf("no prefix parse function for %s found.", t.Type))
+}
+
+// 不正なトークンはLexerがエラーを報告済みなので読み飛ばすだけ
+func (p *Parser) parseIllegal() ast.Expression {
+	return nil
 }
 
 func (p *Parser) parseIdentifier() ast.Expression {
@@ -271,7 +390,7 @@ func (p *Parser) parseIdentifier() ast.Expression {
 func (p *Parser) parseIntegerLiteral() ast.Expression {
 	value, err := strconv.ParseInt(p.curToken.Literal, 0, 64)
 	if err != nil {
-		p.addError(fmt.Sprintf("could not parse %q as integer", p.curToken.Literal))
+		p.addErrorAt(p.curToken.Pos, fmt.Sprintf("could not parse %q as integer", p.curToken.Literal))
 	}
 
 	return &ast.IntegerLiteral{
@@ -280,6 +399,18 @@ func (p *Parser) parseIntegerLiteral() ast.Expression {
 	}
 }
 
+func (p *Parser) parseFloatLiteral() ast.Expression {
+	value, err := strconv.ParseFloat(p.curToken.Literal, 64)
+	if err != nil {
+		p.addErrorAt(p.curToken.Pos, fmt.Sprintf("could not parse %q as float", p.curToken.Literal))
+	}
+
+	return &ast.FloatLiteral{
+		Token: p.curToken,
+		Value: value,
+	}
+}
+
 func (p *Parser) parsePrefixExpression() ast.Expression {
 	expression := &ast.PrefixExpression{
 		Token:    p.curToken,
@@ -305,6 +436,27 @@ func (p *Parser) parseInfixExpression(left ast.Expression) ast.Expression {
 	return expression
 }
 
+// 代入は右結合 (a = b = 1 は a = (b = 1))
+func (p *Parser) parseAssignExpression(target ast.Expression) ast.Expression {
+	switch target.(type) {
+	case *ast.Identifier, *ast.IndexExpression:
+	default:
+		p.addErrorAt(target.Pos(), fmt.Sprintf("invalid assignment target: %s", target.String()))
+		return nil
+	}
+
+	expression := &ast.AssignExpression{
+		Token:    p.curToken,
+		Target:   target,
+		Operator: p.curToken.Literal,
+	}
+
+	p.nextToken()
+	expression.Value = p.parseExpression(LOWEST)
+
+	return expression
+}
+
 func (p *Parser) parseBoolean() ast.Expression {
 	return &ast.Boolean{
 		Token: p.curToken,
@@ -327,33 +479,58 @@ func (p *Parser) parseIfExpression() ast.Expression {
 	exp := &ast.IfExpression{
 		Token: p.curToken,
 	}
-	if !p.expectPeek(token.LPAREN) {
-		return nil
-	}
-	p.nextToken()
-	exp.Condition = p.parseExpression(LOWEST)
 
-	if !p.expectPeek(token.RPAREN) {
+	var ok bool
+	exp.Condition, exp.Consequence, ok = p.parseConditionalBlock()
+	if !ok {
 		return nil
 	}
 
-	if !p.expectPeek(token.LBRACE) {
-		return nil
-	}
+	for p.peekTokenIs(token.ELSE) {
+		p.nextToken()
 
-	exp.Consequence = p.parseBlockStatement()
+		if p.peekTokenIs(token.IF) {
+			p.nextToken()
+			branch := &ast.ElseIfBranch{
+				Token: p.curToken,
+			}
+			branch.Condition, branch.Consequence, ok = p.parseConditionalBlock()
+			if !ok {
+				return nil
+			}
+			exp.ElseIfs = append(exp.ElseIfs, branch)
+			continue
+		}
 
-	if p.peekTokenIs(token.ELSE) {
-		p.nextToken()
 		if !p.expectPeek(token.LBRACE) {
 			return nil
 		}
 		exp.Alternative = p.parseBlockStatement()
+		break
 	}
 
 	return exp
 }
 
+// if の後ろの (condition) { consequence } の部分
+func (p *Parser) parseConditionalBlock() (ast.Expression, *ast.BlockStatement, bool) {
+	if !p.expectPeek(token.LPAREN) {
+		return nil, nil, false
+	}
+	p.nextToken()
+	condition := p.parseExpression(LOWEST)
+
+	if !p.expectPeek(token.RPAREN) {
+		return nil, nil, false
+	}
+
+	if !p.expectPeek(token.LBRACE) {
+		return nil, nil, false
+	}
+
+	return condition, p.parseBlockStatement(), true
+}
+
 func (p *Parser) parseBlockStatement() *ast.BlockStatement {
 	block := &ast.BlockStatement{
 		Token: p.curToken,
@@ -369,9 +546,65 @@ func (p *Parser) parseBlockStatement() *ast.BlockStatement {
 		p.nextToken()
 	}
 
+	if p.curTokenIs(token.RBRACE) {
+		block.Rbrace = p.curToken
+	}
+
 	return block
 }
 
+func (p *Parser) parseTryExpression() ast.Expression {
+	exp := &ast.TryExpression{
+		Token: p.curToken,
+	}
+
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+	exp.Block = p.parseBlockStatement()
+
+	if p.peekTokenIs(token.CATCH) {
+		p.nextToken()
+		if !p.expectPeek(token.LPAREN) {
+			return nil
+		}
+		if !p.expectPeek(token.IDENT) {
+			return nil
+		}
+		exp.Param = &ast.Identifier{
+			Token: p.curToken,
+			Value: p.curToken.Literal,
+		}
+		if !p.expectPeek(token.RPAREN) {
+			return nil
+		}
+		if !p.expectPeek(token.LBRACE) {
+			return nil
+		}
+		exp.Catch = p.parseBlockStatement()
+	}
+
+	if p.peekTokenIs(token.FINALLY) {
+		p.nextToken()
+		if !p.expectPeek(token.LBRACE) {
+			return nil
+		}
+
+		// finally の中のループはその中でだけ break できる
+		outerLoopDepth, outerInFinally := p.loopDepth, p.inFinally
+		p.loopDepth, p.inFinally = 0, true
+		exp.Finally = p.parseBlockStatement()
+		p.loopDepth, p.inFinally = outerLoopDepth, outerInFinally
+	}
+
+	if exp.Catch == nil && exp.Finally == nil {
+		p.addErrorAt(p.peekToken.Pos, "expected catch or finally after try block")
+		return nil
+	}
+
+	return exp
+}
+
 func (p *Parser) parseFunctionLiteral() ast.Expression {
 	exp := &ast.FunctionLiteral{
 		Token: p.curToken,
@@ -381,48 +614,95 @@ func (p *Parser) parseFunctionLiteral() ast.Expression {
 		return nil
 	}
 
-	exp.Parameters = p.parseFunctionParameters()
+	if !p.parseFunctionParameters(exp) {
+		return nil
+	}
 
 	if !p.expectPeek(token.LBRACE) {
 		return nil
 	}
 
+	// 関数本体から外側のループをbreakすることはできない
+	outerLoopDepth, outerInFinally := p.loopDepth, p.inFinally
+	p.loopDepth, p.inFinally = 0, false
 	exp.Body = p.parseBlockStatement()
+	p.loopDepth, p.inFinally = outerLoopDepth, outerInFinally
+
+	markTailCalls(exp.Body)
 
 	return exp
 }
 
-func (p *Parser) parseFunctionParameters() []*ast.Identifier {
-	params := []*ast.Identifier{}
+// fn(a, b = 1, ...rest) の引数を読む。既定値を持つ引数の後には既定値の無い引数を置けず、
+// ...rest は最後に1つだけ置ける
+func (p *Parser) parseFunctionParameters(fl *ast.FunctionLiteral) bool {
+	fl.Parameters = []*ast.Identifier{}
 	if p.peekTokenIs(token.RPAREN) {
 		p.nextToken()
-		return params
+		return true
 	}
 
-	p.nextToken()
-
-	ident := &ast.Identifier{
-		Token: p.curToken,
-		Value: p.curToken.Literal,
+	// 同じ名前の引数は評価器とVMで束縛が食い違うので認めない
+	seen := map[string]bool{}
+	declare := func(ident *ast.Identifier) bool {
+		if seen[ident.Value] {
+			p.addErrorAt(ident.Pos(), fmt.Sprintf("duplicate parameter %s", ident.Value))
+			return false
+		}
+		seen[ident.Value] = true
+		return true
 	}
-	params = append(params, ident)
 
-	for p.peekTokenIs(token.COMMA) {
-		p.nextToken()
+	hasDefault := false
+	for {
 		p.nextToken()
 
+		if p.curTokenIs(token.ELLIPSIS) {
+			if !p.expectPeek(token.IDENT) {
+				return false
+			}
+			fl.Rest = &ast.Identifier{
+				Token: p.curToken,
+				Value: p.curToken.Literal,
+			}
+			if !declare(fl.Rest) {
+				return false
+			}
+			if !p.peekTokenIs(token.RPAREN) {
+				p.addErrorAt(p.peekToken.Pos, "rest parameter must be last")
+				return false
+			}
+			break
+		}
+
 		ident := &ast.Identifier{
 			Token: p.curToken,
 			Value: p.curToken.Literal,
 		}
-		params = append(params, ident)
-	}
+		if !declare(ident) {
+			return false
+		}
+		fl.Parameters = append(fl.Parameters, ident)
+
+		var defaultValue ast.Expression
+		if p.peekTokenIs(token.ASSIGN) {
+			p.nextToken()
+			p.nextToken()
+			defaultValue = p.parseExpression(ASSIGNMENT)
+			hasDefault = true
+		} else if hasDefault {
+			p.addErrorAt(ident.Pos(), fmt.Sprintf("parameter %s without default value follows parameter with default value", ident.Value))
+			return false
+		}
+		fl.Defaults = append(fl.Defaults, defaultValue)
 
-	if !p.expectPeek(token.RPAREN) {
-		return nil
+		if !p.peekTokenIs(token.COMMA) {
+			break
+		}
+		p.nextToken()
 	}
 
-	return params
+	return p.expectPeek(token.RPAREN)
 }
 
 func (p *Parser) parseCallExpression(function ast.Expression) ast.Expression {
@@ -432,24 +712,66 @@ func (p *Parser) parseCallExpression(function ast.Expression) ast.Expression {
 	}
 
 	ce.Arguments = p.parseExpressionList(token.RPAREN)
+	if ce.Arguments == nil {
+		return nil
+	}
+	ce.Rparen = p.curToken
 
 	return ce
 }
 
+// a[i] か a[low:high]。スライスの両端は省略できる
 func (p *Parser) parseIndexExpression(left ast.Expression) ast.Expression {
-	ie := &ast.IndexExpression{
-		Token: p.curToken,
+	lbracket := p.curToken
+
+	var index ast.Expression
+	if !p.peekTokenIs(token.COLON) {
+		p.nextToken()
+		index = p.parseExpression(LOWEST)
+		if index == nil {
+			return nil
+		}
+	}
+
+	if p.peekTokenIs(token.COLON) {
+		p.nextToken()
+		return p.parseSliceExpression(lbracket, left, index)
+	}
+
+	if !p.expectPeek(token.RBRACKET) {
+		return nil
+	}
+
+	return &ast.IndexExpression{
+		Token:    lbracket,
+		Left:     left,
+		Index:    index,
+		Rbracket: p.curToken,
+	}
+}
+
+// 現在のトークンは :
+func (p *Parser) parseSliceExpression(lbracket *token.Token, left, low ast.Expression) ast.Expression {
+	se := &ast.SliceExpression{
+		Token: lbracket,
 		Left:  left,
+		Low:   low,
 	}
 
-	p.nextToken()
-	ie.Index = p.parseExpression(LOWEST)
+	if !p.peekTokenIs(token.RBRACKET) {
+		p.nextToken()
+		se.High = p.parseExpression(LOWEST)
+		if se.High == nil {
+			return nil
+		}
+	}
 
 	if !p.expectPeek(token.RBRACKET) {
 		return nil
 	}
+	se.Rbracket = p.curToken
 
-	return ie
+	return se
 }
 func (p *Parser) parseExpressionList(end token.TokenType) []ast.Expression {
 	args := []ast.Expression{}
@@ -475,6 +797,22 @@ func (p *Parser) parseExpressionList(end token.TokenType) []ast.Expression {
 	return args
 }
 
+func (p *Parser) parseImportExpression() ast.Expression {
+	exp := &ast.ImportExpression{
+		Token: p.curToken,
+	}
+
+	if !p.expectPeek(token.STRING) {
+		return nil
+	}
+	exp.Path = &ast.StringLiteral{
+		Token: p.curToken,
+		Value: p.curToken.Literal,
+	}
+
+	return exp
+}
+
 func (p *Parser) parseStringLiteral() ast.Expression {
 	return &ast.StringLiteral{
 		Token: p.curToken,
@@ -483,10 +821,17 @@ func (p *Parser) parseStringLiteral() ast.Expression {
 }
 
 func (p *Parser) parseArrayLiteral() ast.Expression {
-	return &ast.ArrayLiteral{
-		Token:    p.curToken,
-		Elements: p.parseExpressionList(token.RBRACKET),
+	array := &ast.ArrayLiteral{
+		Token: p.curToken,
+	}
+
+	array.Elements = p.parseExpressionList(token.RBRACKET)
+	if array.Elements == nil {
+		return nil
 	}
+	array.Rbracket = p.curToken
+
+	return array
 }
 
 func (p *Parser) parseHashLiteral() ast.Expression {
@@ -516,6 +861,7 @@ func (p *Parser) parseHashLiteral() ast.Expression {
 	if !p.expectPeek(token.RBRACE) {
 		return nil
 	}
+	hash.Rbrace = p.curToken
 
 	return hash
 }
@@ -538,7 +884,57 @@ func (p *Parser) parseWhileStatement() ast.Statement {
 		return nil
 	}
 
+	p.loopDepth++
+	stmt.Body = p.parseBlockStatement()
+	p.loopDepth--
+
+	return stmt
+}
+
+func (p *Parser) parseForStatement() ast.Statement {
+	stmt := &ast.ForStatement{
+		Token: p.curToken,
+	}
+	if !p.expectPeek(token.LPAREN) {
+		return nil
+	}
+	if !p.expectPeek(token.IDENT) {
+		return nil
+	}
+	stmt.Value = &ast.Identifier{
+		Token: p.curToken,
+		Value: p.curToken.Literal,
+	}
+
+	if p.peekTokenIs(token.COMMA) {
+		p.nextToken()
+		if !p.expectPeek(token.IDENT) {
+			return nil
+		}
+		stmt.Key = stmt.Value
+		stmt.Value = &ast.Identifier{
+			Token: p.curToken,
+			Value: p.curToken.Literal,
+		}
+	}
+
+	if !p.expectPeek(token.IN) {
+		return nil
+	}
+	p.nextToken()
+	stmt.Iterable = p.parseExpression(LOWEST)
+
+	if !p.expectPeek(token.RPAREN) {
+		return nil
+	}
+
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+
+	p.loopDepth++
 	stmt.Body = p.parseBlockStatement()
+	p.loopDepth--
 
 	return stmt
 }
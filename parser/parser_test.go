@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"monkey/ast"
 	"monkey/lexer"
+	"strings"
 	"testing"
 )
 
@@ -280,6 +281,44 @@ func TestIntegerLiteralExpression(t *testing.T) {
 	}
 }
 
+func TestFloatLiteralExpression(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected float64
+	}{
+		{"3.14;", 3.14},
+		{".5;", 0.5},
+		{"1e-9;", 1e-9},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+
+		program := p.ParseProgram()
+		checkParseError(t, p)
+
+		lenStatements := 1
+		if len(program.Statements) != lenStatements {
+			t.Fatalf("program.Statements does not contain %d statements. got=%d", lenStatements, len(program.Statements))
+		}
+
+		stmt, ok := program.Statements[0].(*ast.ExpressionStatement)
+		if !ok {
+			t.Fatalf("program.Statements[0] is not ast.ExpressionStatement. got=%T", program.Statements[0])
+		}
+
+		literal, ok := stmt.Expression.(*ast.FloatLiteral)
+		if !ok {
+			t.Fatalf("exp not *ast.FloatLiteral. got=%T", stmt.Expression)
+		}
+
+		if literal.Value != tt.expected {
+			t.Errorf("literal.Value not %g. got=%g", tt.expected, literal.Value)
+		}
+	}
+}
+
 func TestParsingPrefixExpression(t *testing.T) {
 	prefixTests := []struct {
 		input        string
@@ -334,6 +373,10 @@ func TestParsingInfixExpression(t *testing.T) {
 		{"true != false", true, "!=", false},
 		{"false != false", false, "!=", false},
 		{"3 % 2", 3, "%", 2},
+		{"true && false", true, "&&", false},
+		{"a || b", "a", "||", "b"},
+		{"5 <= 5", 5, "<=", 5},
+		{"5 >= 5", 5, ">=", 5},
 	}
 
 	for _, tt := range prefixTests {
@@ -468,10 +511,50 @@ func TestOperatorPrecedenceParsing(t *testing.T) {
 			"add(a * b[2], b[1], 2 * [1, 2][1])",
 			"add((a * (b[2])), (b[1]), (2 * ([1, 2][1])))",
 		},
+		{
+			"a[1:b + 1] + s[:-1][0]",
+			"((a[1:(b + 1)]) + ((s[:(-1)])[0]))",
+		},
 		{
 			"1 + 2 % 3",
 			"(1 + (2 % 3))",
 		},
+		{
+			"a + 1 <= b == c >= d * 2",
+			"(((a + 1) <= b) == (c >= (d * 2)))",
+		},
+		{
+			"a = b = 1 + 2",
+			"(a = (b = (1 + 2)))",
+		},
+		{
+			"a += b || c",
+			"(a += (b || c))",
+		},
+		{
+			"arr[i + 1] *= 2",
+			"((arr[(i + 1)]) *= 2)",
+		},
+		{
+			"0..n - 1",
+			"(0 .. (n - 1))",
+		},
+		{
+			"a < 0..10",
+			"(a < (0 .. 10))",
+		},
+		{
+			"a || b && c",
+			"(a || (b && c))",
+		},
+		{
+			"a && b || c && d",
+			"((a && b) || (c && d))",
+		},
+		{
+			"a == b && c < d || !e",
+			"(((a == b) && (c < d)) || (!e))",
+		},
 	}
 
 	for _, tt := range prefixTests {
@@ -623,6 +706,77 @@ func TestIfElseExpression(t *testing.T) {
 	}
 }
 
+func TestIfElseIfExpression(t *testing.T) {
+	input := `if (x < y) { x } else if (x > y) { y } else if (z) { z } else { 0 }`
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParseError(t, p)
+
+	if len(program.Statements) != 1 {
+		t.Fatalf("program has not enough statements. got=%d",
+			len(program.Statements))
+	}
+
+	stmt, ok := program.Statements[0].(*ast.ExpressionStatement)
+	if !ok {
+		t.Fatalf("program.Statements[0] is not ast.ExpressionStatement. got=%T",
+			program.Statements[0])
+	}
+
+	exp, ok := stmt.Expression.(*ast.IfExpression)
+	if !ok {
+		t.Fatalf("exp not *ast.IfExpression. got=%T", stmt.Expression)
+	}
+
+	if !testInfixExpression(t, exp.Condition, "x", "<", "y") {
+		return
+	}
+
+	if len(exp.ElseIfs) != 2 {
+		t.Fatalf("exp.ElseIfs does not contain 2 branches. got=%d", len(exp.ElseIfs))
+	}
+
+	if !testInfixExpression(t, exp.ElseIfs[0].Condition, "x", ">", "y") {
+		return
+	}
+	if !testIdentifier(t, exp.ElseIfs[0].Consequence.Statements[0].(*ast.ExpressionStatement).Expression, "y") {
+		return
+	}
+	if !testIdentifier(t, exp.ElseIfs[1].Condition, "z") {
+		return
+	}
+
+	alternative, ok := exp.Alternative.Statements[0].(*ast.ExpressionStatement)
+	if !ok {
+		t.Fatalf("exp.Alternative.Statement[0] is  not *ast.ExpressionStatement. got=%T", exp.Alternative.Statements[0])
+	}
+	if !testIntegerLiteral(t, alternative.Expression, 0) {
+		return
+	}
+}
+
+func TestIfExpressionStringRoundTrip(t *testing.T) {
+	tests := []string{
+		"if (x) { 1 }",
+		"if (x) { 1 } else { 2 }",
+		"if ((a < b)) { a } else if ((a > b)) { b } else if (c) { c }",
+		"if ((a < b)) { a } else if ((a > b)) { b } else { 0 }",
+	}
+
+	for _, input := range tests {
+		l := lexer.New(input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParseError(t, p)
+
+		if program.String() != input {
+			t.Errorf("String() does not round trip. expected=%q, got=%q", input, program.String())
+		}
+	}
+}
+
 func TestFunctionLiteralParsing(t *testing.T) {
 	input := `fn(x, y) {x + y; }`
 
@@ -722,6 +876,62 @@ func TestFunctionParameterParsing(t *testing.T) {
 	}
 }
 
+func TestDefaultAndRestParameterParsing(t *testing.T) {
+	tests := []struct {
+		input            string
+		expectedParams   []string
+		expectedDefaults []string // 既定値の無い引数は空文字列
+		expectedRest     string
+		expectedString   string
+	}{
+		{"fn(a, b = 2) {}", []string{"a", "b"}, []string{"", "2"}, "", "fn(a, b = 2)"},
+		{"fn(a = 1, b = a + 1) {}", []string{"a", "b"}, []string{"1", "(a + 1)"}, "", "fn(a = 1, b = (a + 1))"},
+		{"fn(...rest) {}", []string{}, nil, "rest", "fn(...rest)"},
+		{"fn(a, b = [1], ...rest) {}", []string{"a", "b"}, []string{"", "[1]"}, "rest", "fn(a, b = [1], ...rest)"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParseError(t, p)
+
+		exp, ok := program.Statements[0].(*ast.ExpressionStatement).Expression.(*ast.FunctionLiteral)
+		if !ok {
+			t.Fatalf("exp not *ast.FunctionLiteral. got=%T", program.Statements[0])
+		}
+
+		if len(exp.Parameters) != len(tt.expectedParams) {
+			t.Fatalf("wrong number of parameters. want=%d, got=%d", len(tt.expectedParams), len(exp.Parameters))
+		}
+		for i, param := range exp.Parameters {
+			if !testIdentifier(t, param, tt.expectedParams[i]) {
+				return
+			}
+
+			actual := ""
+			if exp.Defaults[i] != nil {
+				actual = exp.Defaults[i].String()
+			}
+			if actual != tt.expectedDefaults[i] {
+				t.Errorf("wrong default for %s. want=%q, got=%q", param.Value, tt.expectedDefaults[i], actual)
+			}
+		}
+
+		if tt.expectedRest == "" {
+			if exp.Rest != nil {
+				t.Errorf("exp.Rest is not nil. got=%q", exp.Rest.Value)
+			}
+		} else if !testIdentifier(t, exp.Rest, tt.expectedRest) {
+			return
+		}
+
+		if exp.String() != tt.expectedString {
+			t.Errorf("wrong String(). want=%q, got=%q", tt.expectedString, exp.String())
+		}
+	}
+}
+
 func TestCallExpressionParsing(t *testing.T) {
 	input := `add(1, 2 * 3, 4 + 5)`
 
@@ -831,6 +1041,47 @@ func TestParsingArrayLiterals(t *testing.T) {
 	testInfixExpression(t, array.Elements[2], 3, "+", 3)
 }
 
+func TestParsingSliceExpressions(t *testing.T) {
+	tests := []struct {
+		input        string
+		expectedLow  interface{} // nil なら省略
+		expectedHigh interface{}
+	}{
+		{"arr[1:3]", 1, 3},
+		{"arr[1:]", 1, nil},
+		{"arr[:3]", nil, 3},
+		{"arr[:]", nil, nil},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParseError(t, p)
+
+		stmt := program.Statements[0].(*ast.ExpressionStatement)
+		slice, ok := stmt.Expression.(*ast.SliceExpression)
+		if !ok {
+			t.Fatalf("exp not *ast.SliceExpression. got=%T", stmt.Expression)
+		}
+		if !testIdentifier(t, slice.Left, "arr") {
+			return
+		}
+		for _, bound := range []struct {
+			exp      ast.Expression
+			expected interface{}
+		}{{slice.Low, tt.expectedLow}, {slice.High, tt.expectedHigh}} {
+			if bound.expected == nil {
+				if bound.exp != nil {
+					t.Errorf("%s: bound is not nil. got=%s", tt.input, bound.exp)
+				}
+				continue
+			}
+			testLiteralExpression(t, bound.exp, bound.expected)
+		}
+	}
+}
+
 func TestParsingHashLiterals(t *testing.T) {
 	input := `{"one": 1, "two": 2, "three": 3}`
 
@@ -1076,3 +1327,502 @@ func TestParsingWhileExpression(t *testing.T) {
 
 	testInfixExpression(t, bodyLet.Value, "a", "+", 1)
 }
+
+func TestParserErrorPosition(t *testing.T) {
+	tests := []struct {
+		input         string
+		expectedError string
+	}{
+		{
+			"let x 5;",
+			"test.monkey:1:7: expected next token to be =, got INT instead",
+		},
+		{
+			"let x = 1;\nlet = 2;",
+			"test.monkey:2:5: expected next token to be IDENT, got = instead",
+		},
+		{
+			"let x = 1;\n  ) + 1",
+			"test.monkey:2:3: no prefix parse function for ) found.",
+		},
+		{
+			"let x = 1; /* oops",
+			"test.monkey:1:12: unterminated block comment",
+		},
+		{
+			"let x = 1 @ 2;",
+			"test.monkey:1:11: illegal character '@'",
+		},
+		{
+			"let 名前\xff = \"値\";",
+			"test.monkey:1:7: invalid UTF-8 encoding \"\\xff\"",
+		},
+		{
+			"fn(a = 1, b) {}",
+			"test.monkey:1:11: parameter b without default value follows parameter with default value",
+		},
+		{
+			"fn(...a, b) {}",
+			"test.monkey:1:8: rest parameter must be last",
+		},
+		{
+			"fn(...) {}",
+			"test.monkey:1:7: expected next token to be IDENT, got ) instead",
+		},
+		{
+			"fn(a, a) { a }",
+			"test.monkey:1:7: duplicate parameter a",
+		},
+		{
+			"fn(a, b = 1, ...a) {}",
+			"test.monkey:1:17: duplicate parameter a",
+		},
+		{
+			"a[1:2:3]",
+			"test.monkey:1:6: expected next token to be ], got : instead",
+		},
+	}
+
+	for _, tt := range tests {
+		l := lexer.NewWithFilename("test.monkey", tt.input)
+		p := New(l)
+		p.ParseProgram()
+
+		errors := p.Errors()
+		if len(errors) == 0 {
+			t.Fatalf("parser has no errors. input=%q", tt.input)
+		}
+
+		if errors[0] != tt.expectedError {
+			t.Errorf("wrong error message. expected=%q, got=%q", tt.expectedError, errors[0])
+		}
+	}
+}
+
+func TestNodePosition(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"a + b * c", "1:1-1:10"},
+		{"let x = -5;", "1:1-1:11"},
+		{"add(1, 2)", "1:1-1:10"},
+		{"arr[1]", "1:1-1:7"},
+		{"[1, 2]", "1:1-1:7"},
+		{`{"a": 1}`, "1:1-1:9"},
+		{"fn(x) {\n  x\n}", "1:1-3:2"},
+		{"if (x) { 1 } else { 2 }", "1:1-1:24"},
+		{"while (x) {\n}", "1:1-2:2"},
+		{"  return x", "1:3-1:11"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParseError(t, p)
+
+		stmt := program.Statements[0]
+		actual := fmt.Sprintf("%s-%s", stmt.Pos(), stmt.End())
+		if actual != tt.expected {
+			t.Errorf("wrong position for %q. expected=%q, got=%q", tt.input, tt.expected, actual)
+		}
+	}
+}
+
+func TestAssignExpression(t *testing.T) {
+	tests := []struct {
+		input            string
+		expectedOperator string
+		expectedTarget   string
+		expectedValue    interface{}
+	}{
+		{"x = 5;", "=", "x", 5},
+		{"x += y;", "+=", "x", "y"},
+		{"x -= 1;", "-=", "x", 1},
+		{"x *= 2;", "*=", "x", 2},
+		{"x /= 2;", "/=", "x", 2},
+		{"x %= 2;", "%=", "x", 2},
+		{"arr[0] = 1;", "=", "(arr[0])", 1},
+		{`h["k"] += 1;`, "+=", "(h[k])", 1},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+
+		program := p.ParseProgram()
+		checkParseError(t, p)
+
+		lenStatements := 1
+		if len(program.Statements) != lenStatements {
+			t.Fatalf("program.Statements does not contain %d statements. got=%d", lenStatements, len(program.Statements))
+		}
+
+		stmt, ok := program.Statements[0].(*ast.ExpressionStatement)
+		if !ok {
+			t.Fatalf("program.Statements[0] is not ast.ExpressionStatement. got=%T", program.Statements[0])
+		}
+
+		assign, ok := stmt.Expression.(*ast.AssignExpression)
+		if !ok {
+			t.Fatalf("exp not *ast.AssignExpression. got=%T", stmt.Expression)
+		}
+
+		if assign.Operator != tt.expectedOperator {
+			t.Errorf("assign.Operator not %s. got=%s", tt.expectedOperator, assign.Operator)
+		}
+
+		if assign.Target.String() != tt.expectedTarget {
+			t.Errorf("assign.Target not %s. got=%s", tt.expectedTarget, assign.Target.String())
+		}
+
+		if !testLiteralExpression(t, assign.Value, tt.expectedValue) {
+			return
+		}
+	}
+}
+
+func TestInvalidAssignTarget(t *testing.T) {
+	l := lexer.New("1 + 2 = 3")
+	p := New(l)
+	p.ParseProgram()
+
+	expected := "1:1: invalid assignment target: (1 + 2)"
+	errors := p.Errors()
+	if len(errors) == 0 || errors[0] != expected {
+		t.Errorf("wrong errors. expected=%q, got=%q", expected, errors)
+	}
+}
+
+func TestBreakContinueStatement(t *testing.T) {
+	input := `
+	while (true) {
+		if (a) { break; }
+		continue
+	}
+	`
+
+	l := lexer.New(input)
+	p := New(l)
+
+	program := p.ParseProgram()
+	checkParseError(t, p)
+
+	while, ok := program.Statements[0].(*ast.WhileStatement)
+	if !ok {
+		t.Fatalf("program.Statements[0] is not ast.WhileStatement. got=%T", program.Statements[0])
+	}
+
+	lenBlockStatements := 2
+	if len(while.Body.Statements) != lenBlockStatements {
+		t.Fatalf("while.Body.Statements does not contain %d statements. got=%d", lenBlockStatements, len(while.Body.Statements))
+	}
+
+	ifExp := while.Body.Statements[0].(*ast.ExpressionStatement).Expression.(*ast.IfExpression)
+	if _, ok := ifExp.Consequence.Statements[0].(*ast.BreakStatement); !ok {
+		t.Errorf("consequence is not ast.BreakStatement. got=%T", ifExp.Consequence.Statements[0])
+	}
+
+	if _, ok := while.Body.Statements[1].(*ast.ContinueStatement); !ok {
+		t.Errorf("while.Body.Statements[1] is not ast.ContinueStatement. got=%T", while.Body.Statements[1])
+	}
+}
+
+func TestBreakContinueOutsideLoop(t *testing.T) {
+	tests := []struct {
+		input         string
+		expectedError string
+	}{
+		{"break;", "1:1: break is not in a loop"},
+		{"continue", "1:1: continue is not in a loop"},
+		{"if (true) { break }", "1:13: break is not in a loop"},
+		{"while (true) { fn() { continue } }", "1:23: continue is not in a loop"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		p.ParseProgram()
+
+		errors := p.Errors()
+		if len(errors) != 1 || errors[0] != tt.expectedError {
+			t.Errorf("wrong errors. expected=%q, got=%q", tt.expectedError, errors)
+		}
+	}
+}
+
+func TestParsingForStatement(t *testing.T) {
+	tests := []struct {
+		input            string
+		expectedKey      string
+		expectedValue    string
+		expectedIterable string
+	}{
+		{"for (x in arr) { x }", "", "x", "arr"},
+		{"for (k, v in h) { k }", "k", "v", "h"},
+		{"for (i in 0..len(arr)) { break; }", "", "i", "(0 .. len(arr))"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+
+		program := p.ParseProgram()
+		checkParseError(t, p)
+
+		lenStatements := 1
+		if len(program.Statements) != lenStatements {
+			t.Fatalf("program.Statements does not contain %d statements. got=%d", lenStatements, len(program.Statements))
+		}
+
+		stmt, ok := program.Statements[0].(*ast.ForStatement)
+		if !ok {
+			t.Fatalf("program.Statements[0] is not ast.ForStatement. got=%T", program.Statements[0])
+		}
+
+		if tt.expectedKey == "" {
+			if stmt.Key != nil {
+				t.Errorf("stmt.Key is not nil. got=%q", stmt.Key.Value)
+			}
+		} else if !testIdentifier(t, stmt.Key, tt.expectedKey) {
+			return
+		}
+
+		if !testIdentifier(t, stmt.Value, tt.expectedValue) {
+			return
+		}
+
+		if stmt.Iterable.String() != tt.expectedIterable {
+			t.Errorf("stmt.Iterable not %q. got=%q", tt.expectedIterable, stmt.Iterable.String())
+		}
+
+		if len(stmt.Body.Statements) != 1 {
+			t.Errorf("stmt.Body.Statements does not contain 1 statement. got=%d", len(stmt.Body.Statements))
+		}
+	}
+}
+
+func TestTryExpression(t *testing.T) {
+	tests := []struct {
+		input           string
+		expectedParam   string
+		expectedCatch   bool
+		expectedFinally bool
+		expectedString  string
+	}{
+		{"try { f(1) } catch (e) { e }", "e", true, false, "try { f(1) } catch (e) { e }"},
+		{"try { f(1) } finally { g() }", "", false, true, "try { f(1) } finally { g() }"},
+		{"let x = try { f(1) } catch (err) { 0 } finally { g() }", "err", true, true, "let x = try { f(1) } catch (err) { 0 } finally { g() };"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParseError(t, p)
+
+		if len(program.Statements) != 1 {
+			t.Fatalf("program.Statements does not contain 1 statement. got=%d", len(program.Statements))
+		}
+
+		var exp ast.Expression
+		switch stmt := program.Statements[0].(type) {
+		case *ast.ExpressionStatement:
+			exp = stmt.Expression
+		case *ast.LetStatement:
+			exp = stmt.Value
+		}
+		try, ok := exp.(*ast.TryExpression)
+		if !ok {
+			t.Fatalf("exp is not ast.TryExpression. got=%T", exp)
+		}
+
+		if len(try.Block.Statements) != 1 {
+			t.Errorf("try.Block.Statements does not contain 1 statement. got=%d", len(try.Block.Statements))
+		}
+		if (try.Catch != nil) != tt.expectedCatch {
+			t.Errorf("try.Catch wrong. want catch=%t, got=%v", tt.expectedCatch, try.Catch)
+		}
+		if tt.expectedCatch && !testIdentifier(t, try.Param, tt.expectedParam) {
+			return
+		}
+		if (try.Finally != nil) != tt.expectedFinally {
+			t.Errorf("try.Finally wrong. want finally=%t, got=%v", tt.expectedFinally, try.Finally)
+		}
+		if program.String() != tt.expectedString {
+			t.Errorf("program.String() wrong. want=%q, got=%q", tt.expectedString, program.String())
+		}
+	}
+}
+
+func TestThrowStatement(t *testing.T) {
+	l := lexer.New(`throw {"message": "bad"};`)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParseError(t, p)
+
+	stmt, ok := program.Statements[0].(*ast.ThrowStatement)
+	if !ok {
+		t.Fatalf("program.Statements[0] is not ast.ThrowStatement. got=%T", program.Statements[0])
+	}
+	if _, ok := stmt.Value.(*ast.HashLiteral); !ok {
+		t.Errorf("stmt.Value is not ast.HashLiteral. got=%T", stmt.Value)
+	}
+}
+
+func TestImportExpression(t *testing.T) {
+	l := lexer.New(`let lib = import "lib/math.monkey"; import "a.monkey"["f"]`)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParseError(t, p)
+
+	if len(program.Statements) != 2 {
+		t.Fatalf("program.Statements does not contain 2 statements. got=%d", len(program.Statements))
+	}
+
+	stmt := program.Statements[0].(*ast.LetStatement)
+	exp, ok := stmt.Value.(*ast.ImportExpression)
+	if !ok {
+		t.Fatalf("stmt.Value is not ast.ImportExpression. got=%T", stmt.Value)
+	}
+	if exp.Path.Value != "lib/math.monkey" {
+		t.Errorf("exp.Path.Value is not %q. got=%q", "lib/math.monkey", exp.Path.Value)
+	}
+
+	// import の結果はそのまま添字で参照できる
+	index, ok := program.Statements[1].(*ast.ExpressionStatement).Expression.(*ast.IndexExpression)
+	if !ok {
+		t.Fatalf("expression is not ast.IndexExpression. got=%T", program.Statements[1].(*ast.ExpressionStatement).Expression)
+	}
+	if index.Left.String() != `import "a.monkey"` {
+		t.Errorf("index.Left.String() wrong. got=%q", index.Left.String())
+	}
+
+	l = lexer.New(`import lib`)
+	p = New(l)
+	p.ParseProgram()
+	expectedError := "1:8: expected next token to be STRING, got IDENT instead"
+	if len(p.Errors()) == 0 || p.Errors()[0] != expectedError {
+		t.Errorf("wrong errors. expected=%q, got=%q", expectedError, p.Errors())
+	}
+}
+
+func TestTryErrors(t *testing.T) {
+	tests := []struct {
+		input         string
+		expectedError string
+	}{
+		{"try { 1 }; 2", "1:10: expected catch or finally after try block"},
+		{"fn() { try { 1 } finally { return 2 } }", "1:28: cannot return from finally block"},
+		{"while (true) { try { 1 } finally { break } }", "1:36: cannot break out of finally block"},
+		{"while (true) { try { 1 } finally { if (a) { continue } } }", "1:45: cannot continue out of finally block"},
+		{"try { 1 } finally { while (true) { break } }", ""},
+		{"try { 1 } finally { fn() { return 2 } }", ""},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		p.ParseProgram()
+
+		errors := p.Errors()
+		if tt.expectedError == "" {
+			if len(errors) != 0 {
+				t.Errorf("%q: unexpected errors: %q", tt.input, errors)
+			}
+			continue
+		}
+		if len(errors) != 1 || errors[0] != tt.expectedError {
+			t.Errorf("%q: wrong errors. expected=%q, got=%q", tt.input, tt.expectedError, errors)
+		}
+	}
+}
+
+func TestTailCallMarking(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []string // 末尾呼び出しに印が付く呼び出し
+	}{
+		{"f(1)", nil},
+		{"fn() { f(1) }", []string{"f(1)"}},
+		{"fn() { f(1); g(2) }", []string{"g(2)"}},
+		{"fn() { f(1) + 1 }", nil},
+		{"fn() { return f(g(1)) }", []string{"f(g(1))"}},
+		{"fn() { if (a) { f(1) } else if (b) { g(1) } else { h(1) } }", []string{"f(1)", "g(1)", "h(1)"}},
+		{"fn() { if (a) { f(1) }; 2 }", nil},
+		{"fn() { if (a) { return f(1) }; 2 }", []string{"f(1)"}},
+		{"fn() { while (a) { f(1); return g(1) } }", []string{"g(1)"}},
+		{"fn() { for (x in a) { f(x) } }", nil},
+		{"fn() { let x = f(1) }", nil},
+		{"fn() { fn() { f(1) }() }", []string{"f(1)", "fn()f(1)()"}},
+		{"fn() { try { return f(1) } catch (e) { g(e) } }", nil},
+		{"fn() { try { f(1) } finally { g(1) } }", nil},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParseError(t, p)
+
+		var tails []string
+		collectTailCalls(program, &tails)
+
+		if strings.Join(tails, ", ") != strings.Join(tt.expected, ", ") {
+			t.Errorf("%q: wrong tail calls. want=%q, got=%q", tt.input, tt.expected, tails)
+		}
+	}
+}
+
+func collectTailCalls(node ast.Node, tails *[]string) {
+	switch node := node.(type) {
+	case *ast.Program:
+		for _, s := range node.Statements {
+			collectTailCalls(s, tails)
+		}
+	case *ast.BlockStatement:
+		for _, s := range node.Statements {
+			collectTailCalls(s, tails)
+		}
+	case *ast.ExpressionStatement:
+		collectTailCalls(node.Expression, tails)
+	case *ast.LetStatement:
+		collectTailCalls(node.Value, tails)
+	case *ast.ReturnStatement:
+		collectTailCalls(node.ReturnValue, tails)
+	case *ast.WhileStatement:
+		collectTailCalls(node.Body, tails)
+	case *ast.ForStatement:
+		collectTailCalls(node.Body, tails)
+	case *ast.TryExpression:
+		collectTailCalls(node.Block, tails)
+		if node.Catch != nil {
+			collectTailCalls(node.Catch, tails)
+		}
+		if node.Finally != nil {
+			collectTailCalls(node.Finally, tails)
+		}
+	case *ast.InfixExpression:
+		collectTailCalls(node.Left, tails)
+		collectTailCalls(node.Right, tails)
+	case *ast.IfExpression:
+		collectTailCalls(node.Consequence, tails)
+		for _, branch := range node.ElseIfs {
+			collectTailCalls(branch.Consequence, tails)
+		}
+		if node.Alternative != nil {
+			collectTailCalls(node.Alternative, tails)
+		}
+	case *ast.FunctionLiteral:
+		collectTailCalls(node.Body, tails)
+	case *ast.CallExpression:
+		collectTailCalls(node.Function, tails)
+		for _, a := range node.Arguments {
+			collectTailCalls(a, tails)
+		}
+		if node.Tail {
+			*tails = append(*tails, node.String())
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package parser
+
+import "monkey/ast"
+
+// 関数本体の末尾位置にある呼び出しに印を付ける。末尾位置は
+//   - 本体の最後の式文
+//   - return の値 (ループの中も含む)
+//   - 末尾位置にある if のそれぞれの分岐の最後の式文
+//
+// try の中はエラーの捕捉や finally のために呼び出し元に戻る必要があるので、末尾位置にしない。
+// 内側の関数リテラルはそれぞれを構文解析したときに処理済み
+func markTailCalls(body *ast.BlockStatement) {
+	markTailBlock(body, true)
+}
+
+// last が true ならブロックの最後の式文も末尾位置
+func markTailBlock(block *ast.BlockStatement, last bool) {
+	if block == nil {
+		return
+	}
+
+	for i, stmt := range block.Statements {
+		tail := last && i == len(block.Statements)-1
+
+		switch stmt := stmt.(type) {
+		case *ast.ReturnStatement:
+			markTailExpression(stmt.ReturnValue, true)
+		case *ast.ExpressionStatement:
+			markTailExpression(stmt.Expression, tail)
+		case *ast.WhileStatement:
+			markTailBlock(stmt.Body, false)
+		case *ast.ForStatement:
+			markTailBlock(stmt.Body, false)
+		}
+	}
+}
+
+// 末尾位置でない if の中にも return があり得るので、tail が false でも分岐はたどる
+func markTailExpression(exp ast.Expression, tail bool) {
+	switch exp := exp.(type) {
+	case *ast.CallExpression:
+		if tail {
+			exp.Tail = true
+		}
+	case *ast.IfExpression:
+		markTailBlock(exp.Consequence, tail)
+		for _, branch := range exp.ElseIfs {
+			markTailBlock(branch.Consequence, tail)
+		}
+		markTailBlock(exp.Alternative, tail)
+	case *ast.TryExpression:
+		// return も含めて印を付けない
+	}
+}
@@ -2,19 +2,44 @@ package repl
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io"
+	"monkey/compiler"
 	"monkey/evaluator"
 	"monkey/lexer"
 	"monkey/object"
 	"monkey/parser"
+	"monkey/vm"
+	"os"
+	"path/filepath"
 )
 
 const PROMPT = ">> "
 
-func Start(in io.Reader, out io.Writer) {
+// import するファイルを探すディレクトリのリストを指定する環境変数
+const SearchPathEnv = "MONKEY_PATH"
+
+// 環境変数で指定された import の検索パス
+func SearchPath() []string {
+	return filepath.SplitList(os.Getenv(SearchPathEnv))
+}
+
+// 実行方式
+const (
+	EngineEval = "eval" // ASTを直接評価する
+	EngineVM   = "vm"   // バイトコードにコンパイルしてVMで実行する
+)
+
+func Start(in io.Reader, out io.Writer, engine string) {
+	if engine == EngineVM {
+		startVM(in, out)
+		return
+	}
+
 	scanner := bufio.NewScanner(in)
 	env := object.NewEnvironment()
+	modules := evaluator.NewModules(nil, SearchPath())
 	for {
 		fmt.Printf(PROMPT)
 		scanned := scanner.Scan()
@@ -33,7 +58,11 @@ func Start(in io.Reader, out io.Writer) {
 			continue
 		}
 
-		evaluated := evaluator.Eval(program, env)
+		evaluated := evaluator.EvalContext(context.Background(), program, env, evaluator.Limits{}, evaluator.WithModules(modules))
+		if err, ok := evaluated.(*object.Error); ok {
+			PrintRuntimeError(out, err)
+			continue
+		}
 		if evaluated != nil {
 			io.WriteString(out, evaluated.Inspect())
 			io.WriteString(out, "\n")
@@ -41,8 +70,82 @@ func Start(in io.Reader, out io.Writer) {
 	}
 }
 
+func startVM(in io.Reader, out io.Writer) {
+	scanner := bufio.NewScanner(in)
+
+	// グローバル変数と定数は入力をまたいで引き継ぐ
+	constants := []object.Object{}
+	globals := make([]object.Object, vm.GlobalsSize)
+	symbolTable := compiler.NewSymbolTable()
+
+	// 標準ライブラリを読み込んでおく
+	comp := compiler.NewWithState(symbolTable, constants)
+	if err := comp.CompilePrelude(); err != nil {
+		fmt.Fprintf(out, "compilation failed: %s\n", err)
+		return
+	}
+	constants = comp.Bytecode().Constants
+	if err := vm.NewWithGlobalsStore(comp.Bytecode(), globals).Run(); err != nil {
+		PrintVMError(out, err)
+		return
+	}
+
+	for {
+		fmt.Printf(PROMPT)
+		scanned := scanner.Scan()
+
+		if !scanned {
+			return
+		}
+
+		input := scanner.Text()
+		l := lexer.New(input)
+		p := parser.New(l)
+
+		program := p.ParseProgram()
+		if len(p.Errors()) != 0 {
+			PrintParserError(out, p.Errors())
+			continue
+		}
+
+		comp := compiler.NewWithState(symbolTable, constants)
+		if err := comp.Compile(program); err != nil {
+			fmt.Fprintf(out, "compilation failed: %s\n", err)
+			continue
+		}
+
+		code := comp.Bytecode()
+		constants = code.Constants
+
+		machine := vm.NewWithGlobalsStore(code, globals)
+		if err := machine.Run(); err != nil {
+			PrintVMError(out, err)
+			continue
+		}
+
+		result := machine.LastPoppedStackElem()
+		if result != nil {
+			io.WriteString(out, result.Inspect())
+			io.WriteString(out, "\n")
+		}
+	}
+}
+
 func PrintParserError(out io.Writer, errors []string) {
 	for _, msg := range errors {
 		io.WriteString(out, "\t"+msg+"\n")
 	}
 }
+
+func PrintRuntimeError(out io.Writer, err *object.Error) {
+	io.WriteString(out, err.StackTrace())
+}
+
+// VMのエラーは実行時エラーならスタックトレースを表示する
+func PrintVMError(out io.Writer, err error) {
+	if rtErr, ok := err.(*object.Error); ok {
+		PrintRuntimeError(out, rtErr)
+		return
+	}
+	fmt.Fprintf(out, "executing bytecode failed: %s\n", err)
+}
@@ -1,18 +1,50 @@
 package token
 
+import "fmt"
+
 type TokenType string
 
+// ソース上の位置
+type Position struct {
+	Filename string
+	Offset   int // バイトオフセット(0始まり)
+	Line     int // 行番号(1始まり)
+	Column   int // 列番号(1始まり、文字単位)
+}
+
+func (p Position) IsValid() bool {
+	return p.Line > 0
+}
+
+// file:line:col 形式(ファイル名が無い場合は line:col)
+func (p Position) String() string {
+	if !p.IsValid() {
+		if p.Filename != "" {
+			return p.Filename
+		}
+		return "-"
+	}
+	if p.Filename == "" {
+		return fmt.Sprintf("%d:%d", p.Line, p.Column)
+	}
+	return fmt.Sprintf("%s:%d:%d", p.Filename, p.Line, p.Column)
+}
+
 type Token struct {
 	Type    TokenType
 	Literal string
+	Pos     Position // トークンの先頭
+	End     Position // トークンの直後
 }
 
 const (
 	ILLEGAL = "ILLEGAL"
 	EOF     = "EOF"
+	COMMENT = "COMMENT"
 
 	IDENT  = "IDENT"
 	INT    = "INT"
+	FLOAT  = "FLOAT"
 	STRING = "STRING"
 
 	ASSIGN   = "="
@@ -23,14 +55,26 @@ const (
 	SLASH    = "/"
 	PERSENT  = "%"
 
+	PLUS_ASSIGN     = "+="
+	MINUS_ASSIGN    = "-="
+	ASTERISK_ASSIGN = "*="
+	SLASH_ASSIGN    = "/="
+	PERSENT_ASSIGN  = "%="
+
 	LT     = "<"
 	GT     = ">"
+	LT_EQ  = "<="
+	GT_EQ  = ">="
 	EQ     = "=="
 	NOT_EQ = "!="
+	AND    = "&&"
+	OR     = "||"
 
 	COMMA     = ","
 	SEMICOLON = ";"
 	COLON     = ":"
+	DOTDOT    = ".."
+	ELLIPSIS  = "..."
 
 	LPAREN   = "("
 	RPAREN   = ")"
@@ -47,6 +91,15 @@ const (
 	ELSE     = "ELSE"
 	RETURN   = "RETURN"
 	WHILE    = "WHILE"
+	BREAK    = "BREAK"
+	CONTINUE = "CONTINUE"
+	FOR      = "FOR"
+	IN       = "IN"
+	TRY      = "TRY"
+	CATCH    = "CATCH"
+	FINALLY  = "FINALLY"
+	THROW    = "THROW"
+	IMPORT   = "IMPORT"
 )
 
 var keywords = map[string]TokenType{
@@ -58,6 +111,18 @@ var keywords = map[string]TokenType{
 	"else":   ELSE,
 	"return": RETURN,
 	"while":  WHILE,
+
+	"break":    BREAK,
+	"continue": CONTINUE,
+	"for":      FOR,
+	"in":       IN,
+
+	"try":     TRY,
+	"catch":   CATCH,
+	"finally": FINALLY,
+	"throw":   THROW,
+
+	"import": IMPORT,
 }
 
 func LookupIdent(ident string) TokenType {
@@ -0,0 +1,71 @@
+package vm
+
+import "monkey/object"
+
+const (
+	CELL_OBJ     = "CELL"
+	ITERATOR_OBJ = "ITERATOR"
+)
+
+// クロージャに捕捉されるローカル変数の入れ物。
+// クロージャと外側の関数が同じセルを共有するので、代入がお互いに見える
+type cell struct {
+	value object.Object
+}
+
+func (c *cell) Type() object.ObjectType { return CELL_OBJ }
+func (c *cell) Inspect() string         { return "cell" }
+
+// for-in で使うイテレータ。評価器の for と同じ順序で列挙する
+type iterator struct {
+	next func() (key, value object.Object, ok bool)
+	hash bool // 変数が1つならキーを列挙する
+}
+
+func (it *iterator) Type() object.ObjectType { return ITERATOR_OBJ }
+func (it *iterator) Inspect() string         { return "iterator" }
+
+func newIterator(obj object.Object) (*iterator, bool) {
+	switch obj := obj.(type) {
+	case *object.Array:
+		i := 0
+		return &iterator{next: func() (object.Object, object.Object, bool) {
+			if i >= len(obj.Elements) {
+				return nil, nil, false
+			}
+			i++
+			return &object.Integer{Value: int64(i - 1)}, obj.Elements[i-1], true
+		}}, true
+	case *object.String:
+		chars := []rune(obj.Value)
+		i := 0
+		return &iterator{next: func() (object.Object, object.Object, bool) {
+			if i >= len(chars) {
+				return nil, nil, false
+			}
+			i++
+			return &object.Integer{Value: int64(i - 1)}, &object.String{Value: string(chars[i-1])}, true
+		}}, true
+	case *object.Hash:
+		pairs := obj.SortedPairs()
+		i := 0
+		return &iterator{hash: true, next: func() (object.Object, object.Object, bool) {
+			if i >= len(pairs) {
+				return nil, nil, false
+			}
+			i++
+			return pairs[i-1].Key, pairs[i-1].Value, true
+		}}, true
+	case *object.Range:
+		i := obj.Start
+		return &iterator{next: func() (object.Object, object.Object, bool) {
+			if i >= obj.End {
+				return nil, nil, false
+			}
+			i++
+			return &object.Integer{Value: i - 1 - obj.Start}, &object.Integer{Value: i - 1}, true
+		}}, true
+	default:
+		return nil, false
+	}
+}
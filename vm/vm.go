@@ -0,0 +1,682 @@
+package vm
+
+import (
+	"fmt"
+	"io"
+	"monkey/code"
+	"monkey/compiler"
+	"monkey/evaluator"
+	"monkey/object"
+)
+
+const StackSize = 2048
+const GlobalsSize = 65536
+const MaxFrames = 1024
+
+var (
+	NULL  = evaluator.NULL
+	TRUE  = evaluator.TRUE
+	FALSE = evaluator.FALSE
+)
+
+// オペコードに対応する演算子。演算の意味は評価器と共有する
+var operators = map[code.Opcode]string{
+	code.OpAdd:          "+",
+	code.OpSub:          "-",
+	code.OpMul:          "*",
+	code.OpDiv:          "/",
+	code.OpMod:          "%",
+	code.OpEqual:        "==",
+	code.OpNotEqual:     "!=",
+	code.OpLessThan:     "<",
+	code.OpGreaterThan:  ">",
+	code.OpLessEqual:    "<=",
+	code.OpGreaterEqual: ">=",
+	code.OpRange:        "..",
+}
+
+type VM struct {
+	bytecode    *compiler.Bytecode
+	constants   []object.Object
+	globals     []object.Object
+	globalNames []string
+
+	stack []object.Object
+	sp    int // 常に次の空きを指す。スタックトップは stack[sp-1]
+
+	frames      []*Frame
+	framesIndex int
+
+	handlers []handler // 実行中の try。内側のものが後ろに並ぶ
+
+	lastPopped object.Object
+
+	trace io.Writer // nilでなければ実行した命令を書き出す
+}
+
+// try で登録されたエラーの飛び先
+type handler struct {
+	framesIndex int // OpTry を実行したときのフレームの数
+	sp          int
+	catchPos    int
+}
+
+func New(bytecode *compiler.Bytecode) *VM {
+	mainClosure := &object.Closure{Fn: bytecode.Main}
+	mainFrame := NewFrame(mainClosure, 0)
+
+	frames := make([]*Frame, MaxFrames)
+	frames[0] = mainFrame
+
+	return &VM{
+		bytecode:    bytecode,
+		constants:   bytecode.Constants,
+		globals:     make([]object.Object, GlobalsSize),
+		globalNames: bytecode.GlobalNames,
+
+		stack: make([]object.Object, StackSize),
+		// トップレベルのブロック内の変数の分を空けておく
+		sp: bytecode.Main.NumLocals,
+
+		frames:      frames,
+		framesIndex: 1,
+	}
+}
+
+// REPLのように前回までのグローバル変数を引き継ぐ
+func NewWithGlobalsStore(bytecode *compiler.Bytecode, s []object.Object) *VM {
+	vm := New(bytecode)
+	vm.globals = s
+	return vm
+}
+
+// 実行した命令とその直後のスタックトップを w に書き出す
+func (vm *VM) SetTrace(w io.Writer) {
+	vm.trace = w
+}
+
+// 最後に捨てた値。プログラム全体の結果になる
+func (vm *VM) LastPoppedStackElem() object.Object {
+	return vm.lastPopped
+}
+
+func (vm *VM) currentFrame() *Frame {
+	return vm.frames[vm.framesIndex-1]
+}
+
+func (vm *VM) pushFrame(f *Frame) error {
+	if vm.framesIndex >= MaxFrames {
+		return vm.newError("stack overflow")
+	}
+	vm.frames[vm.framesIndex] = f
+	vm.framesIndex++
+	return nil
+}
+
+func (vm *VM) popFrame() *Frame {
+	vm.framesIndex--
+	return vm.frames[vm.framesIndex]
+}
+
+// 実行時エラーは *object.Error として返す。位置とスタックトレースは評価器と同じ形になる
+func (vm *VM) Run() error {
+	var ip int
+	var ins code.Instructions
+	var op code.Opcode
+
+	for vm.currentFrame().ip < len(vm.currentFrame().Instructions())-1 {
+		vm.currentFrame().ip++
+
+		ip = vm.currentFrame().ip
+		ins = vm.currentFrame().Instructions()
+		op = code.Opcode(ins[ip])
+
+		var err error
+		var traced string
+		if vm.trace != nil {
+			traced = vm.traceText(ip)
+		}
+
+		switch op {
+		case code.OpConstant:
+			constIndex := code.ReadUint16(ins[ip+1:])
+			vm.currentFrame().ip += 2
+			err = vm.push(vm.constants[constIndex])
+
+		case code.OpPop:
+			vm.lastPopped = vm.pop()
+
+		case code.OpTrue:
+			err = vm.push(TRUE)
+		case code.OpFalse:
+			err = vm.push(FALSE)
+		case code.OpNull:
+			err = vm.push(NULL)
+
+		case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv, code.OpMod,
+			code.OpEqual, code.OpNotEqual, code.OpLessThan, code.OpGreaterThan,
+			code.OpLessEqual, code.OpGreaterEqual, code.OpRange:
+			err = vm.executeBinaryOperation(op)
+
+		case code.OpMinus:
+			err = vm.pushResult(evaluator.EvalPrefixExpression("-", vm.pop()))
+		case code.OpBang:
+			err = vm.pushResult(evaluator.EvalPrefixExpression("!", vm.pop()))
+
+		case code.OpJump:
+			pos := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip = pos - 1
+		case code.OpJumpNotTruthy:
+			pos := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+
+			condition := vm.pop()
+			if !evaluator.IsTruthy(condition) {
+				vm.currentFrame().ip = pos - 1
+			}
+		case code.OpJumpIfBound:
+			localIndex := int(code.ReadUint16(ins[ip+1:]))
+			pos := int(code.ReadUint16(ins[ip+3:]))
+			vm.currentFrame().ip += 4
+
+			if vm.stack[vm.currentFrame().basePointer+localIndex] != nil {
+				vm.currentFrame().ip = pos - 1
+			}
+		case code.OpAndJump, code.OpOrJump:
+			pos := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+
+			// 結果が決まった場合は左辺の値をそのまま結果にする
+			if evaluator.IsTruthy(vm.stack[vm.sp-1]) == (op == code.OpOrJump) {
+				vm.currentFrame().ip = pos - 1
+			} else {
+				vm.pop()
+			}
+
+		case code.OpGetGlobal:
+			globalIndex := code.ReadUint16(ins[ip+1:])
+			vm.currentFrame().ip += 2
+
+			value := vm.globals[globalIndex]
+			if value == nil {
+				err = vm.identifierNotFound(vm.globalNames, int(globalIndex))
+			} else {
+				err = vm.push(value)
+			}
+		case code.OpSetGlobal:
+			globalIndex := code.ReadUint16(ins[ip+1:])
+			vm.currentFrame().ip += 2
+
+			vm.globals[globalIndex] = vm.pop()
+
+		case code.OpGetLocal:
+			localIndex := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+
+			value := vm.stack[vm.currentFrame().basePointer+localIndex]
+			if value == nil {
+				err = vm.identifierNotFound(vm.currentFrame().cl.Fn.LocalNames, localIndex)
+			} else {
+				err = vm.push(value)
+			}
+		case code.OpSetLocal:
+			localIndex := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+
+			vm.stack[vm.currentFrame().basePointer+localIndex] = vm.pop()
+
+		case code.OpGetCell:
+			localIndex := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+
+			c, ok := vm.stack[vm.currentFrame().basePointer+localIndex].(*cell)
+			if !ok || c.value == nil {
+				err = vm.identifierNotFound(vm.currentFrame().cl.Fn.LocalNames, localIndex)
+			} else {
+				err = vm.push(c.value)
+			}
+		case code.OpSetCell:
+			localIndex := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+
+			slot := vm.currentFrame().basePointer + localIndex
+			if c, ok := vm.stack[slot].(*cell); ok {
+				c.value = vm.pop()
+			} else {
+				vm.stack[slot] = &cell{value: vm.pop()}
+			}
+		case code.OpLoadCell:
+			localIndex := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+
+			slot := vm.currentFrame().basePointer + localIndex
+			if _, ok := vm.stack[slot].(*cell); !ok {
+				// まだ代入されていない変数も後から代入された値が見えるよう先にセルを作る
+				vm.stack[slot] = &cell{}
+			}
+			err = vm.push(vm.stack[slot])
+		case code.OpBoxLocal:
+			localIndex := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+
+			slot := vm.currentFrame().basePointer + localIndex
+			vm.stack[slot] = &cell{value: vm.stack[slot]}
+		case code.OpClearLocals:
+			start := int(code.ReadUint16(ins[ip+1:]))
+			count := int(code.ReadUint16(ins[ip+3:]))
+			vm.currentFrame().ip += 4
+
+			base := vm.currentFrame().basePointer + start
+			for i := 0; i < count; i++ {
+				vm.stack[base+i] = nil
+			}
+
+		case code.OpGetFree:
+			freeIndex := int(code.ReadUint8(ins[ip+1:]))
+			vm.currentFrame().ip += 1
+
+			c := vm.currentFrame().cl.Free[freeIndex].(*cell)
+			if c.value == nil {
+				err = vm.identifierNotFound(vm.currentFrame().cl.Fn.FreeNames, freeIndex)
+			} else {
+				err = vm.push(c.value)
+			}
+		case code.OpSetFree:
+			freeIndex := int(code.ReadUint8(ins[ip+1:]))
+			vm.currentFrame().ip += 1
+
+			vm.currentFrame().cl.Free[freeIndex].(*cell).value = vm.pop()
+		case code.OpLoadFree:
+			freeIndex := int(code.ReadUint8(ins[ip+1:]))
+			vm.currentFrame().ip += 1
+
+			err = vm.push(vm.currentFrame().cl.Free[freeIndex])
+		case code.OpMakeCell:
+			err = vm.push(&cell{value: vm.pop()})
+
+		case code.OpCurrentClosure:
+			err = vm.push(vm.currentFrame().cl)
+		case code.OpClosure:
+			constIndex := code.ReadUint16(ins[ip+1:])
+			numFree := code.ReadUint8(ins[ip+3:])
+			vm.currentFrame().ip += 3
+
+			err = vm.pushClosure(int(constIndex), int(numFree))
+
+		case code.OpArray:
+			numElements := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+
+			elements := make([]object.Object, numElements)
+			copy(elements, vm.stack[vm.sp-numElements:vm.sp])
+			vm.sp = vm.sp - numElements
+
+			err = vm.push(&object.Array{Elements: elements})
+		case code.OpHash:
+			numElements := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+
+			var hash object.Object
+			hash, err = vm.buildHash(vm.sp-numElements, vm.sp)
+			if err == nil {
+				vm.sp = vm.sp - numElements
+				err = vm.push(hash)
+			}
+		case code.OpIndex:
+			index := vm.pop()
+			left := vm.pop()
+			err = vm.pushResult(evaluator.EvalIndexExpression(left, index))
+		case code.OpSlice:
+			high := vm.pop()
+			low := vm.pop()
+			left := vm.pop()
+			err = vm.pushResult(evaluator.EvalSliceExpression(left, low, high))
+		case code.OpSetIndex:
+			value := vm.pop()
+			index := vm.pop()
+			left := vm.pop()
+			err = vm.pushResult(evaluator.EvalIndexAssignment(left, index, value))
+		case code.OpDupTwo:
+			a, b := vm.stack[vm.sp-2], vm.stack[vm.sp-1]
+			if err = vm.push(a); err == nil {
+				err = vm.push(b)
+			}
+
+		case code.OpCall:
+			numArgs := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+
+			err = vm.executeCall(int(numArgs))
+
+		case code.OpTailCall:
+			numArgs := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+
+			err = vm.executeTailCall(int(numArgs))
+
+		case code.OpReturnValue, code.OpReturn:
+			var returnValue object.Object = NULL
+			if op == code.OpReturnValue {
+				returnValue = vm.pop()
+			}
+
+			if vm.framesIndex == 1 {
+				// トップレベルの return はプログラムを終了する
+				vm.lastPopped = returnValue
+				vm.writeTrace(traced)
+				return nil
+			}
+
+			frame := vm.popFrame()
+			vm.sp = frame.basePointer - 1
+			err = vm.push(returnValue)
+
+		case code.OpTry:
+			pos := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+
+			vm.handlers = append(vm.handlers, handler{framesIndex: vm.framesIndex, sp: vm.sp, catchPos: pos})
+		case code.OpEndTry:
+			vm.handlers = vm.handlers[:len(vm.handlers)-1]
+		case code.OpCatch:
+			caught := vm.pop().(*object.Error)
+			err = vm.push(evaluator.ErrorValue(caught))
+		case code.OpThrow:
+			value := vm.pop()
+			if thrown, ok := value.(*object.Error); ok {
+				// finally を実行し終えたエラーを投げ直す
+				err = thrown
+			} else {
+				err = vm.fail(evaluator.NewThrownError(value))
+			}
+
+		case code.OpIterInit:
+			iterable := vm.pop()
+			it, ok := newIterator(iterable)
+			if !ok {
+				err = vm.newError("cannot iterate over %s", iterable.Type())
+			} else {
+				err = vm.push(it)
+			}
+		case code.OpIterNext:
+			numVars := code.ReadUint8(ins[ip+1:])
+			pos := int(code.ReadUint16(ins[ip+2:]))
+			vm.currentFrame().ip += 3
+
+			it := vm.stack[vm.sp-1].(*iterator)
+			key, value, ok := it.next()
+			switch {
+			case !ok:
+				vm.pop()
+				vm.currentFrame().ip = pos - 1
+			case numVars == 2:
+				if err = vm.push(key); err == nil {
+					err = vm.push(value)
+				}
+			case it.hash:
+				err = vm.push(key)
+			default:
+				err = vm.push(value)
+			}
+
+		default:
+			def, _ := code.Lookup(byte(op))
+			return fmt.Errorf("unknown opcode: %v", def)
+		}
+
+		if err != nil && !vm.catch(err) {
+			return err
+		}
+		vm.writeTrace(traced)
+	}
+
+	return nil
+}
+
+// 実行時エラーを最も内側の try で捕捉し、その飛び先にエラーを積んで続ける。
+// 捕捉できなければfalseを返す
+func (vm *VM) catch(err error) bool {
+	rtErr, ok := err.(*object.Error)
+	if !ok || len(vm.handlers) == 0 {
+		return false
+	}
+
+	h := vm.handlers[len(vm.handlers)-1]
+	vm.handlers = vm.handlers[:len(vm.handlers)-1]
+
+	vm.framesIndex = h.framesIndex
+	vm.sp = h.sp
+	vm.currentFrame().ip = h.catchPos - 1
+
+	return vm.push(rtErr) == nil
+}
+
+func (vm *VM) traceText(ip int) string {
+	fn := vm.currentFrame().cl.Fn
+	name := "<main>"
+	if vm.framesIndex > 1 {
+		name = fn.DisplayName()
+	}
+	text, _ := compiler.FormatInstruction(vm.bytecode, fn, ip)
+	return fmt.Sprintf("%-12s %04d %s", name, ip, text)
+}
+
+func (vm *VM) writeTrace(traced string) {
+	if vm.trace == nil {
+		return
+	}
+
+	top := "-"
+	if vm.sp > 0 && vm.stack[vm.sp-1] != nil {
+		top = vm.stack[vm.sp-1].Inspect()
+	}
+	fmt.Fprintf(vm.trace, "%-60s | %s\n", traced, top)
+}
+
+func (vm *VM) push(o object.Object) error {
+	if vm.sp >= StackSize {
+		return vm.newError("stack overflow")
+	}
+
+	vm.stack[vm.sp] = o
+	vm.sp++
+
+	return nil
+}
+
+func (vm *VM) pop() object.Object {
+	o := vm.stack[vm.sp-1]
+	vm.sp--
+	return o
+}
+
+// 評価器の関数が返した結果を積む。エラーならそこで実行を止める
+func (vm *VM) pushResult(result object.Object) error {
+	if err, ok := result.(*object.Error); ok {
+		return vm.fail(err)
+	}
+	if result == nil {
+		result = NULL
+	}
+	return vm.push(result)
+}
+
+func (vm *VM) executeBinaryOperation(op code.Opcode) error {
+	right := vm.pop()
+	left := vm.pop()
+
+	// 整数同士はよく使うので評価器を通さずに計算する
+	if l, ok := left.(*object.Integer); ok {
+		if r, ok := right.(*object.Integer); ok {
+			switch op {
+			case code.OpAdd:
+				return vm.push(&object.Integer{Value: l.Value + r.Value})
+			case code.OpSub:
+				return vm.push(&object.Integer{Value: l.Value - r.Value})
+			case code.OpMul:
+				return vm.push(&object.Integer{Value: l.Value * r.Value})
+			case code.OpLessThan:
+				return vm.push(nativeBoolToBooleanObject(l.Value < r.Value))
+			case code.OpGreaterThan:
+				return vm.push(nativeBoolToBooleanObject(l.Value > r.Value))
+			case code.OpEqual:
+				return vm.push(nativeBoolToBooleanObject(l.Value == r.Value))
+			case code.OpNotEqual:
+				return vm.push(nativeBoolToBooleanObject(l.Value != r.Value))
+			}
+		}
+	}
+
+	return vm.pushResult(evaluator.EvalInfixExpression(operators[op], left, right))
+}
+
+func (vm *VM) buildHash(startIndex, endIndex int) (object.Object, error) {
+	hashedPairs := make(map[object.HashKey]object.HashPair)
+
+	for i := startIndex; i < endIndex; i += 2 {
+		key := vm.stack[i]
+		value := vm.stack[i+1]
+
+		hashKey, ok := key.(object.Hashable)
+		if !ok {
+			return nil, vm.newError("unusable as hash key: %s", key.Type())
+		}
+
+		hashedPairs[hashKey.HashKey()] = object.HashPair{Key: key, Value: value}
+	}
+
+	return &object.Hash{Pairs: hashedPairs}, nil
+}
+
+func (vm *VM) pushClosure(constIndex, numFree int) error {
+	constant := vm.constants[constIndex]
+	function, ok := constant.(*object.CompiledFunction)
+	if !ok {
+		return fmt.Errorf("not a function: %+v", constant)
+	}
+
+	free := make([]object.Object, numFree)
+	copy(free, vm.stack[vm.sp-numFree:vm.sp])
+	vm.sp = vm.sp - numFree
+
+	return vm.push(&object.Closure{Fn: function, Free: free})
+}
+
+func (vm *VM) executeCall(numArgs int) error {
+	callee := vm.stack[vm.sp-1-numArgs]
+	switch callee := callee.(type) {
+	case *object.Closure:
+		return vm.callClosure(callee, numArgs)
+	case *object.Builtin:
+		return vm.callBuiltin(callee, numArgs)
+	default:
+		return vm.newError("not a function: %s", callee.Type())
+	}
+}
+
+// 現在のフレームを捨て、呼び出す関数と引数をその位置に移してから呼び出す。
+// 組み込み関数の呼び出しとエラーは OpCall と同じ
+func (vm *VM) executeTailCall(numArgs int) error {
+	cl, ok := vm.stack[vm.sp-1-numArgs].(*object.Closure)
+	if !ok || checkArguments(cl.Fn, numArgs) != nil {
+		return vm.executeCall(numArgs)
+	}
+
+	frame := vm.popFrame()
+	copy(vm.stack[frame.basePointer-1:], vm.stack[vm.sp-1-numArgs:vm.sp])
+	vm.sp = frame.basePointer + numArgs
+
+	return vm.callClosure(cl, numArgs)
+}
+
+func checkArguments(fn *object.CompiledFunction, numArgs int) *object.Error {
+	max := fn.NumParameters
+	if fn.Variadic {
+		max = -1
+	}
+	return evaluator.CheckArgumentCount(fn.NumRequired, max, numArgs)
+}
+
+func (vm *VM) callClosure(cl *object.Closure, numArgs int) error {
+	fn := cl.Fn
+	if err := checkArguments(fn, numArgs); err != nil {
+		return vm.fail(err)
+	}
+
+	basePointer := vm.sp - numArgs
+	if basePointer+fn.NumLocals >= StackSize {
+		return vm.newError("stack overflow")
+	}
+
+	frame := NewFrame(cl, basePointer)
+	if err := vm.pushFrame(frame); err != nil {
+		return err
+	}
+
+	// 省略された引数は空のままにして、関数の先頭で既定値を入れる
+	for i := numArgs; i < fn.NumParameters; i++ {
+		vm.stack[basePointer+i] = nil
+	}
+	if fn.Variadic {
+		rest := []object.Object{}
+		if numArgs > fn.NumParameters {
+			rest = append(rest, vm.stack[basePointer+fn.NumParameters:vm.sp]...)
+		}
+		vm.stack[basePointer+fn.NumParameters] = &object.Array{Elements: rest}
+		vm.sp = basePointer + fn.NumParameters + 1
+	} else if numArgs < fn.NumParameters {
+		vm.sp = basePointer + fn.NumParameters
+	}
+
+	// 前の呼び出しの値が残っていると未定義の変数を検出できないので空にする
+	for i := vm.sp; i < basePointer+fn.NumLocals; i++ {
+		vm.stack[i] = nil
+	}
+	vm.sp = basePointer + fn.NumLocals
+
+	return nil
+}
+
+func (vm *VM) callBuiltin(builtin *object.Builtin, numArgs int) error {
+	args := make([]object.Object, numArgs)
+	copy(args, vm.stack[vm.sp-numArgs:vm.sp])
+
+	result := builtin.Fn(args...)
+	vm.sp = vm.sp - numArgs - 1
+
+	return vm.pushResult(result)
+}
+
+func (vm *VM) identifierNotFound(names []string, index int) error {
+	name := ""
+	if index < len(names) {
+		name = names[index]
+	}
+	return vm.newError("identifier not found: " + name)
+}
+
+func (vm *VM) newError(format string, a ...interface{}) error {
+	return vm.fail(&object.Error{Message: fmt.Sprintf(format, a...)})
+}
+
+// 実行中の位置と呼び出し中の関数をエラーに記録する
+func (vm *VM) fail(err *object.Error) error {
+	frame := vm.currentFrame()
+	if !err.Pos.IsValid() {
+		err.Pos = frame.cl.Fn.PositionAt(frame.ip)
+	}
+
+	for i := vm.framesIndex - 1; i > 0; i-- {
+		caller := vm.frames[i-1]
+		err.PushFrame(vm.frames[i].cl.Fn.DisplayName(), caller.cl.Fn.PositionAt(caller.ip))
+	}
+
+	return err
+}
+
+func nativeBoolToBooleanObject(input bool) *object.Boolean {
+	if input {
+		return TRUE
+	}
+	return FALSE
+}
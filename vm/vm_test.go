@@ -0,0 +1,315 @@
+package vm
+
+import (
+	"bytes"
+	"monkey/ast"
+	"monkey/compiler"
+	"monkey/lexer"
+	"monkey/object"
+	"monkey/parser"
+	"strings"
+	"testing"
+)
+
+type vmTestCase struct {
+	input    string
+	expected interface{}
+}
+
+// エラーはメッセージで比べる
+type vmError string
+
+func TestIntegerArithmetic(t *testing.T) {
+	tests := []vmTestCase{
+		{"1", 1},
+		{"1 + 2 * 3 - 4", 3},
+		{"7 / 2 + 7 % 2", 4},
+		{"-5 + 10", 5},
+		{"1 / 0", vmError("division by zero: 1 / 0")},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestClosures(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			`let newAdder = fn(a) { fn(b) { a + b } }; newAdder(1)(2)`,
+			3,
+		},
+		{
+			// クロージャ同士が同じ変数を共有する
+			`let counter = fn() {
+				let n = 0;
+				let inc = fn() { n += 1 };
+				let get = fn() { n };
+				[inc, get]
+			};
+			let c = counter();
+			c[0](); c[0](); c[1]()`,
+			2,
+		},
+		{
+			`let f = fn(x) { let g = fn() { x = x * 2 }; g(); x }; f(5)`,
+			10,
+		},
+		{
+			`let outer = fn() { let a = 1; fn() { fn() { a += 1 } } }; let inc = outer()(); inc(); inc()`,
+			3,
+		},
+		{
+			`let fns = []; let i = 0;
+			while (i < 3) { let j = i; fns = push(fns, fn() { j }); i += 1 }
+			fns[0]() + fns[2]()`,
+			4,
+		},
+		{
+			`let fns = []; for (i in 0..3) { fns = push(fns, fn() { i }) }; fns[0]() + fns[2]() * 10`,
+			20,
+		},
+		{
+			`let wrapper = fn() { let countDown = fn(x) { if (x == 0) { 0 } else { countDown(x - 1) } }; countDown(3) }; wrapper()`,
+			0,
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestCallingFunctions(t *testing.T) {
+	tests := []vmTestCase{
+		{"let f = fn(a, b) { a + b }; f(1, 2, 3)", vmError("wrong number of arguments. got=3, want=2")},
+		{"let f = fn(a, b) { a + b }; f(1)", vmError("wrong number of arguments. got=1, want=2")},
+		{"let f = fn() { }; f()", nil},
+		{"1()", vmError("not a function: INTEGER")},
+		{"let f = fn(n) { 1 + f(n + 1) }; f(0)", vmError("stack overflow")},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestDefaultAndRestParameters(t *testing.T) {
+	tests := []vmTestCase{
+		{"let f = fn(a, b = 2) { a + b }; f(1)", 3},
+		{"let f = fn(a, b = 2) { a + b }; f(1, 5)", 6},
+		{"let f = fn(a, b = a * 2) { let c = 1; a + b + c }; f(3)", 10},
+		{"let f = fn(a, b = 2) { a + b }; f()", vmError("wrong number of arguments. got=0, want=1 to 2")},
+		{"let f = fn(...rest) { len(rest) }; f(1, 2, 3)", 3},
+		{"let f = fn(a, ...rest) { a + rest[0] }; f(1, 2)", 3},
+		{"let f = fn(a, ...rest) { a }; f()", vmError("wrong number of arguments. got=0, want>=1")},
+		{"let f = fn(a = 1, g = fn() { a }) { g() }; f() + f(5)", 6},
+		{"let f = fn(n, acc = 0) { if (n == 0) { acc } else { f(n - 1, acc + n) } }; f(10000)", 50005000},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestTailCalls(t *testing.T) {
+	tests := []vmTestCase{
+		// MaxFrames を超える深さでもフレームは増えない
+		{"let count = fn(n, acc) { if (n == 0) { acc } else { count(n - 1, acc + 1) } }; count(100000, 0)", 100000},
+		{"let count = fn(n) { while (true) { if (n == 0) { return 0 }; return count(n - 1) } }; count(100000)", 0},
+		{`let even = fn(n) { if (n == 0) { true } else { odd(n - 1) } };
+		  let odd = fn(n) { if (n == 0) { false } else { even(n - 1) } };
+		  if (even(100001)) { 1 } else { 0 }`, 0},
+		{"let f = fn(a) { push(a, 1) }; len(f([7]))", 2},
+		{"let f = fn() { 1() }; f()", vmError("not a function: INTEGER")},
+		{"let g = fn(a, b) { a }; let f = fn() { g(1) }; f()", vmError("wrong number of arguments. got=1, want=2")},
+		{"let add = fn(a, b) { a + b }; let f = fn(x) { add(x, 1) }; f(1) + f(2)", 5},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestSliceExpressions(t *testing.T) {
+	tests := []vmTestCase{
+		{"[1, 2, 3][-1]", 3},
+		{"len([1, 2, 3, 4][1:])", 3},
+		{"[1, 2, 3, 4][:-1][2]", 3},
+		{"len([1, 2, 3][5:])", 0},
+		{`len("日本語"[1:])`, 2},
+		{"let f = fn(a, lo, hi) { fn() { a[lo:hi] } }; len(f([1, 2, 3, 4], 1, 3)())", 2},
+		{`[1, 2][:"a"]`, vmError("slice index must be INTEGER, got STRING")},
+		{"true[:]", vmError("slice operator not supported: BOOLEAN")},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestTryExpressions(t *testing.T) {
+	tests := []vmTestCase{
+		// 捕捉するとスタックを try の時点まで戻す
+		{"let f = fn(x) { [1, 2, x + true] }; 1 + try { 2 * f(3)[0] } catch (e) { 10 }", 11},
+		{"let f = fn(n) { if (n == 0) { throw n }; 1 + f(n - 1) }; try { f(100) } catch (e) { e[\"value\"] }", 0},
+		{"let f = fn(n) { 1 + f(n + 1) }; try { f(0) } catch (e) { 5 }; f(0)", vmError("stack overflow")},
+		{"let f = fn(n) { 1 + f(n + 1) }; let g = fn(x) { x * 2 }; try { f(0) } catch (e) { g(21) }", 42},
+		// ループで何度も登録・解除しても飛び先は残らない
+		{"let n = 0; for (i in 0..10000) { try { if (i % 2 == 0) { continue }; n += 1 } finally { n += 1 } }; n", 15000},
+		{"let f = fn(i) { try { return i } finally { 0 } }; let s = 0; for (i in 0..10000) { s += f(1) }; try { 1 + true } catch (e) { s }", 10000},
+		{"try { throw 1 } catch (e) { 2 }; 1 + true", vmError("type mismatch: INTEGER + BOOLEAN")},
+		{"try { try { throw 1 } finally { 2 } } catch (e) { e[\"value\"] }", 1},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestTopLevelReturn(t *testing.T) {
+	tests := []vmTestCase{
+		{"return 10; 9", 10},
+		{"if (true) { return 1 }; 2", 1},
+		{"for (x in [1, 2]) { return x }; 0", 1},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestUndefinedVariables(t *testing.T) {
+	tests := []vmTestCase{
+		{"x", vmError("identifier not found: x")},
+		{"let f = fn() { g }; f()", vmError("identifier not found: g")},
+		{"let f = fn() { g }; let g = 7; f()", 7},
+		{"let f = fn() { if (false) { let a = 1 }; a }; f()", vmError("identifier not found: a")},
+		{"y = 1", vmError("identifier not found: y")},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestGlobalsStore(t *testing.T) {
+	globals := make([]object.Object, GlobalsSize)
+	symbolTable := compiler.NewSymbolTable()
+	constants := []object.Object{}
+
+	var result object.Object
+	for _, input := range []string{"let a = 1;", "let f = fn() { a + 1 };", "a = f(); a"} {
+		comp := compiler.NewWithState(symbolTable, constants)
+		if err := comp.Compile(parse(input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		bytecode := comp.Bytecode()
+		constants = bytecode.Constants
+
+		vm := NewWithGlobalsStore(bytecode, globals)
+		if err := vm.Run(); err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+		result = vm.LastPoppedStackElem()
+	}
+
+	testExpectedObject(t, "a = f(); a", 2, result)
+}
+
+func TestErrorPosition(t *testing.T) {
+	input := "let inner = fn(x) {\n  x + true\n};\nlet outer = fn() { inner(1) + 0 };\nouter();"
+
+	comp := compiler.New()
+	if err := comp.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	err := New(comp.Bytecode()).Run()
+	rtErr, ok := err.(*object.Error)
+	if !ok {
+		t.Fatalf("error is not *object.Error. got=%T (%+v)", err, err)
+	}
+
+	expected := `ERROR: type mismatch: INTEGER + BOOLEAN
+
+inner(...)
+	2:3
+outer(...)
+	4:20
+<main>
+	5:1
+`
+	if rtErr.StackTrace() != expected {
+		t.Errorf("wrong stack trace.\nwant=%q\ngot =%q", expected, rtErr.StackTrace())
+	}
+}
+
+func TestTrace(t *testing.T) {
+	comp := compiler.New()
+	if err := comp.Compile(parse("let f = fn(x) { x * 2 }; f(3)")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	var out bytes.Buffer
+	vm := New(comp.Bytecode())
+	vm.SetTrace(&out)
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	expected := []string{
+		"<main>       0000 OpClosure 1 0            ; fn f",
+		"<main>       0004 OpSetGlobal 0            ; f               | -",
+		"<main>       0013 OpCall 1                                   | 3",
+		"f            0000 OpGetLocal 0             ; x               | 3",
+		"f            0006 OpMul                                      | 6",
+		"f            0007 OpReturnValue                              | 6",
+		"<main>       0015 OpPop                                      | -",
+	}
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != 10 {
+		t.Fatalf("wrong number of trace lines. want=10, got=%d\n%s", len(lines), out.String())
+	}
+	for _, want := range expected {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("trace does not contain %q.\n%s", want, out.String())
+		}
+	}
+}
+
+func parse(input string) *ast.Program {
+	l := lexer.New(input)
+	p := parser.New(l)
+	return p.ParseProgram()
+}
+
+func runVmTests(t *testing.T, tests []vmTestCase) {
+	t.Helper()
+
+	for _, tt := range tests {
+		program := parse(tt.input)
+
+		comp := compiler.New()
+		if err := comp.Compile(program); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode())
+		err := vm.Run()
+
+		if expected, ok := tt.expected.(vmError); ok {
+			if err == nil {
+				t.Errorf("expected error %q for %q, got none", expected, tt.input)
+				continue
+			}
+			if err.Error() != string(expected) {
+				t.Errorf("wrong error for %q. want=%q, got=%q", tt.input, expected, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("vm error for %q: %s", tt.input, err)
+			continue
+		}
+
+		testExpectedObject(t, tt.input, tt.expected, vm.LastPoppedStackElem())
+	}
+}
+
+func testExpectedObject(t *testing.T, input string, expected interface{}, actual object.Object) {
+	t.Helper()
+
+	switch expected := expected.(type) {
+	case int:
+		integer, ok := actual.(*object.Integer)
+		if !ok || integer.Value != int64(expected) {
+			t.Errorf("wrong result for %q. want=%d, got=%+v", input, expected, actual)
+		}
+	case nil:
+		if actual != NULL {
+			t.Errorf("wrong result for %q. want=null, got=%+v", input, actual)
+		}
+	}
+}